@@ -0,0 +1,326 @@
+// Command tms-keys backs up key pairs wrapped under a backup key-encryption
+// key and restores them, for instance into a freshly initialized token. It
+// also rotates the master key document content is encrypted under.
+//
+//	tms-keys backup  -config config.yaml -out keys.backup [-label a,b] [-user id]
+//	tms-keys restore -config config.yaml -in keys.backup [-label a,b] [-user id]
+//	tms-keys inspect -in keys.backup
+//	tms-keys rotate-document-key -config config.yaml
+//	tms-keys rewrap-documents -config config.yaml
+//
+// The KEK is read from -kek-file, or keys.backup.kek_file in the config.
+// rotate-document-key makes a new master key version current and rewraps
+// every document data key under it; rewrap-documents resumes an
+// interrupted rewrap and destroys retired versions nothing is wrapped
+// under anymore.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"os"
+	"strings"
+	"time"
+	"tms/internal/app"
+	"tms/internal/config"
+	"tms/internal/services/auth"
+	"tms/internal/services/backup"
+	"tms/internal/services/crypto"
+	"tms/internal/services/document"
+	"tms/internal/storage/mongodb"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	log := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	var err error
+	switch command, args := os.Args[1], os.Args[2:]; command {
+	case "backup":
+		err = runBackup(log, args)
+	case "restore":
+		err = runRestore(log, args)
+	case "inspect":
+		err = runInspect(args)
+	case "rotate-document-key":
+		err = runRewrap(log, "rotate-document-key", true, args)
+	case "rewrap-documents":
+		err = runRewrap(log, "rewrap-documents", false, args)
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tms-keys: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: tms-keys backup|restore|inspect|rotate-document-key|rewrap-documents [flags]")
+	os.Exit(2)
+}
+
+// options are the flags shared by every command.
+type options struct {
+	configPath string
+	kekFile    string
+	labels     string
+	userId     string
+}
+
+func (o *options) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.configPath, "config", os.Getenv("CONFIG_PATH"), "path to the config file")
+	flags.StringVar(&o.kekFile, "kek-file", "", "file holding the backup KEK (default keys.backup.kek_file)")
+	flags.StringVar(&o.labels, "label", "", "comma-separated key labels (default all)")
+	flags.StringVar(&o.userId, "user", "", "only keys owned by this user")
+}
+
+func (o *options) selector() backup.Selector {
+	selector := backup.Selector{UserId: o.userId}
+	if o.labels != "" {
+		selector.Labels = strings.Split(o.labels, ",")
+	}
+
+	return selector
+}
+
+func runBackup(log *slog.Logger, args []string) error {
+	var (
+		opts options
+		out  string
+	)
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	opts.register(flags)
+	flags.StringVar(&out, "out", "", "archive to write")
+	_ = flags.Parse(args)
+
+	if out == "" {
+		return fmt.Errorf("-out is required")
+	}
+
+	return withService(log, opts, func(ctx context.Context, service *backup.Service, kek []byte) error {
+		archive, results, err := service.Backup(ctx, kek, opts.selector())
+		if err != nil {
+			return err
+		}
+		printResults(results)
+
+		sealed, err := archive.Seal(kek)
+		if err != nil {
+			return err
+		}
+		// The archive only holds wrapped keys, but there is no reason for
+		// anyone else to read it.
+		if err := os.WriteFile(out, sealed, 0o600); err != nil {
+			return err
+		}
+
+		fmt.Printf("wrote %d keys to %s\n", len(archive.Keys), out)
+		return failed(results)
+	})
+}
+
+func runRestore(log *slog.Logger, args []string) error {
+	var (
+		opts options
+		in   string
+	)
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	opts.register(flags)
+	flags.StringVar(&in, "in", "", "archive to restore")
+	_ = flags.Parse(args)
+
+	if in == "" {
+		return fmt.Errorf("-in is required")
+	}
+
+	return withService(log, opts, func(ctx context.Context, service *backup.Service, kek []byte) error {
+		archive, err := openArchive(in, kek)
+		if err != nil {
+			return err
+		}
+
+		results, err := service.Restore(ctx, kek, archive, opts.selector())
+		if err != nil {
+			return err
+		}
+		printResults(results)
+
+		return failed(results)
+	})
+}
+
+// runInspect checks an archive and lists its keys without touching the
+// token or the database.
+func runInspect(args []string) error {
+	var (
+		opts options
+		in   string
+	)
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	opts.register(flags)
+	flags.StringVar(&in, "in", "", "archive to inspect")
+	_ = flags.Parse(args)
+
+	if in == "" {
+		return fmt.Errorf("-in is required")
+	}
+
+	var cfg *config.Config
+	if opts.kekFile == "" {
+		var err error
+		if cfg, err = config.Load(opts.configPath); err != nil {
+			return err
+		}
+	}
+
+	kek, err := loadKEK(opts, cfg)
+	if err != nil {
+		return err
+	}
+
+	archive, err := openArchive(in, kek)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("created %s with KEK %s\n", archive.CreatedAt.Format(time.RFC3339), archive.KEKID)
+	for _, key := range archive.Keys {
+		fmt.Printf("%s\towner=%s\tstate=%s\tversions=%d\n", key.Key.Label, key.Key.User.ID, key.Key.CurrentState(), len(key.Versions))
+	}
+
+	return nil
+}
+
+// runRewrap rotates the document master key first when rotate is set,
+// then rewraps the document data keys.
+func runRewrap(log *slog.Logger, name string, rotate bool, args []string) error {
+	var configPath string
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.StringVar(&configPath, "config", os.Getenv("CONFIG_PATH"), "path to the config file")
+	_ = flags.Parse(args)
+
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return err
+	}
+
+	return connect(log, cfg, func(ctx context.Context, storage *mongodb.Storage, keyManager crypto.KeyManager) error {
+		service := document.New(log, keyManager, storage, storage, auth.NewAuthorizer(storage, storage))
+
+		if rotate {
+			masterKey, err := service.RotateMasterKey(ctx)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("master key rotated to version %d\n", masterKey.Version)
+		}
+
+		result, err := service.RewrapDataKeys(ctx)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("rewrapped %d data keys, sealed %d plaintext documents\n", result.Rewrapped, result.Sealed)
+		for _, label := range result.Destroyed {
+			fmt.Printf("destroyed retired master key %s\n", label)
+		}
+		if result.Failed > 0 {
+			return fmt.Errorf("%d documents failed", result.Failed)
+		}
+
+		return nil
+	})
+}
+
+// withService connects to the key backend and MongoDB configured in
+// opts.configPath and runs fn with a backup service.
+func withService(log *slog.Logger, opts options, fn func(ctx context.Context, service *backup.Service, kek []byte) error) error {
+	cfg, err := config.Load(opts.configPath)
+	if err != nil {
+		return err
+	}
+
+	kek, err := loadKEK(opts, cfg)
+	if err != nil {
+		return err
+	}
+
+	return connect(log, cfg, func(ctx context.Context, storage *mongodb.Storage, keyManager crypto.KeyManager) error {
+		return fn(ctx, backup.New(log, keyManager, storage), kek)
+	})
+}
+
+// connect opens MongoDB and the key backend configured in cfg for fn.
+func connect(log *slog.Logger, cfg *config.Config, fn func(ctx context.Context, storage *mongodb.Storage, keyManager crypto.KeyManager) error) error {
+	storage, err := mongodb.New(cfg.Storage.URI, cfg.Storage.Database, cfg.Storage.ConnectTimeout, cfg.Storage.Timeout)
+	if err != nil {
+		return err
+	}
+	defer storage.Close(context.Background())
+
+	keyManager, err := app.NewKeyManager(log, cfg)
+	if err != nil {
+		return err
+	}
+	defer keyManager.Close()
+
+	return fn(context.Background(), storage, keyManager)
+}
+
+func loadKEK(opts options, cfg *config.Config) ([]byte, error) {
+	path := opts.kekFile
+	if path == "" && cfg != nil {
+		path = cfg.Keys.Backup.KEKFile
+	}
+	if path == "" {
+		return nil, fmt.Errorf("no KEK: pass -kek-file or set keys.backup.kek_file")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read KEK: %w", err)
+	}
+
+	return backup.ParseKEK(data)
+}
+
+func openArchive(path string, kek []byte) (*backup.Archive, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return backup.Open(kek, raw)
+}
+
+func printResults(results []backup.Result) {
+	for _, result := range results {
+		if result.Reason == "" {
+			fmt.Printf("%s\t%s\n", result.Label, result.Status)
+			continue
+		}
+		fmt.Printf("%s\t%s\t%s\n", result.Label, result.Status, result.Reason)
+	}
+}
+
+// failed turns failed keys into a non-zero exit. Skipped keys are expected.
+func failed(results []backup.Result) error {
+	count := 0
+	for _, result := range results {
+		if result.Status == backup.StatusFailed {
+			count++
+		}
+	}
+	if count > 0 {
+		return fmt.Errorf("%d keys failed", count)
+	}
+
+	return nil
+}
@@ -1,128 +1,80 @@
 package main
 
 import (
-	"fmt"
 	"golang.org/x/exp/slog"
-	"google.golang.org/grpc"
-	"net"
 	"os"
+	"os/signal"
+	"syscall"
+	"tms/internal/app"
 	"tms/internal/config"
-	"tms/internal/grpc/documents"
-	"tms/internal/grpc/keys"
-	"tms/internal/grpc/signature_issuer"
-	"tms/internal/grpc/users"
 	"tms/internal/lib/logger/handlers/slogpretty"
-	"tms/internal/services/crypto"
-	"tms/internal/services/document"
-	si_service "tms/internal/services/signature_issuer"
-	"tms/internal/services/user"
-	"tms/internal/storage/mongodb"
-)
-
-const (
-	envLocal = "local"
-	envDev   = "dev"
-	envProd  = "production"
 )
 
 func main() {
 	// Configuration and logger setup
 	cfg := config.MustLoad()
-	log := setupLogger(cfg.Env)
+	log := setupLogger(cfg.Env, cfg.Log)
 	log.Info("Starting application", slog.String("env", cfg.Env))
 
-	libPath := os.Getenv("HSM_LIBPATH")
-	tokenLabel := os.Getenv("HSM_TOKEN_LABEL")
-	pin := os.Getenv("HSM_PIN")
-
-	client, err := mongodb.New(
-		os.Getenv("MONGODB_URI"),
-		os.Getenv("MONGODB_DATABASE"),
-	)
-
+	application, err := app.New(log, cfg)
 	if err != nil {
-		fmt.Println(err.Error())
+		log.Error("failed to initialize application", slog.Any("error", err))
 		os.Exit(-1)
 	}
 
-	operator := crypto.Operator{
-		Pkcs11Lib:   libPath,
-		TokenLabel:  tokenLabel,
-		Pin:         pin,
-		MongoClient: client,
-	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- application.GRPCServer.Run()
+	}()
 
-	err = operator.Init()
-	if err != nil {
-		log.Error("Softhsm init error", slog.Any("error", err))
-		os.Exit(-1)
-	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
 
-	gRPCServer := grpc.NewServer()
-	documents.Register(
-		gRPCServer,
-		log,
-		document.New(log, client),
-	)
-	keys.Register(
-		gRPCServer,
-		log,
-		operator,
-	)
-	users.Register(
-		gRPCServer,
-		log,
-		user.New(
-			log,
-			client,
-		),
-	)
-	signature_issuer.Register(
-		gRPCServer,
-		log,
-		si_service.New(
-			log,
-			operator,
-			client,
-		),
-	)
-
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", 44047))
-	if err != nil {
-		log.Error("error listening", slog.Any("err", err))
-		return
+	select {
+	case sig := <-stop:
+		log.Info("stopping application", slog.String("signal", sig.String()))
+	case err := <-serveErr:
+		log.Error("error serving", slog.Any("error", err))
 	}
 
-	if err := gRPCServer.Serve(l); err != nil {
-		log.Error("error serving", slog.Any("err", err))
-		return
-	}
+	application.Stop()
+	log.Info("application stopped")
 }
 
-func setupLogger(env string) *slog.Logger {
-	var log *slog.Logger
+func setupLogger(env string, logCfg config.LogConfig) *slog.Logger {
+	format, level := "text", slog.LevelInfo
 
 	switch env {
-	case envLocal:
-		log = setupPrettySlog()
-	case envDev:
-		log = slog.New(
-			slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}),
-		)
-	case envProd:
-		log = slog.New(
-			slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}),
-		)
+	case config.EnvLocal:
+		format, level = "pretty", slog.LevelDebug
+	case config.EnvDev:
+		level = slog.LevelDebug
+	}
+
+	if logCfg.Format != "" {
+		format = logCfg.Format
 	}
 
-	return log
+	if logCfg.Level != "" {
+		// Values are checked by config validation, so the error can be ignored.
+		_ = level.UnmarshalText([]byte(logCfg.Level))
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch format {
+	case "pretty":
+		return setupPrettySlog(opts)
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stdout, opts))
+	default:
+		return slog.New(slog.NewTextHandler(os.Stdout, opts))
+	}
 }
 
-func setupPrettySlog() *slog.Logger {
+func setupPrettySlog(slogOpts *slog.HandlerOptions) *slog.Logger {
 	opts := slogpretty.PrettyHandlerOptions{
-		SlogOpts: &slog.HandlerOptions{
-			Level: slog.LevelDebug,
-		},
+		SlogOpts: slogOpts,
 	}
 
 	handler := opts.NewPrettyHandler(os.Stdout)
@@ -131,5 +83,5 @@ func setupPrettySlog() *slog.Logger {
 }
 
 func runningInProduction(cfg *config.Config) bool {
-	return cfg.Env == "production"
+	return cfg.Env == config.EnvProd
 }
@@ -0,0 +1,355 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	tmsv1 "github.com/alexprishmont/masters-protos/gen/go/trustmanagement"
+	"golang.org/x/exp/slog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"time"
+	grpcapp "tms/internal/app/grpc"
+	"tms/internal/config"
+	"tms/internal/grpc/cipher"
+	"tms/internal/grpc/documents"
+	"tms/internal/grpc/interceptors"
+	"tms/internal/grpc/keys"
+	"tms/internal/grpc/signature_issuer"
+	"tms/internal/grpc/users"
+	"tms/internal/grpc/validation"
+	"tms/internal/lib/certs"
+	"tms/internal/services/auth"
+	cipher_service "tms/internal/services/cipher"
+	"tms/internal/services/crypto"
+	"tms/internal/services/crypto/hsm"
+	"tms/internal/services/crypto/software"
+	"tms/internal/services/document"
+	"tms/internal/services/externalkey"
+	"tms/internal/services/health"
+	"tms/internal/services/keypair"
+	si_service "tms/internal/services/signature_issuer"
+	"tms/internal/services/user"
+	"tms/internal/storage/mongodb"
+)
+
+// Names of the dependency probes behind the per-service health statuses.
+const (
+	probeMongo      = "mongodb"
+	probeKeys       = "keys"
+	probeBlockchain = "blockchain"
+)
+
+// disconnectTimeout bounds the MongoDB disconnect on Stop. It does not share
+// the shutdown deadline, which a slow drain may already have used up.
+const disconnectTimeout = 5 * time.Second
+
+type App struct {
+	log             *slog.Logger
+	GRPCServer      *grpcapp.App
+	shutdownTimeout time.Duration
+	storage         *mongodb.Storage
+	keyManager      crypto.KeyManager
+	issuer          *si_service.IssuerService
+	health          *health.Checker
+	stopBackground  context.CancelFunc
+}
+
+// New connects to the dependencies described by cfg and wires the services
+// onto a gRPC server. Everything opened here is released by Stop.
+func New(log *slog.Logger, cfg *config.Config) (*App, error) {
+	const op = "app.New"
+
+	// Background work (health probes, certificate reloads) stops with the app.
+	background, stopBackground := context.WithCancel(context.Background())
+
+	serverCreds, err := serverCredentials(background, log, cfg.GRPC.TLS)
+	if err != nil {
+		stopBackground()
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	blockchainCreds, err := blockchainCredentials(background, log, cfg.Blockchain)
+	if err != nil {
+		stopBackground()
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	storage, err := mongodb.New(
+		cfg.Storage.URI,
+		cfg.Storage.Database,
+		cfg.Storage.ConnectTimeout,
+		cfg.Storage.Timeout,
+	)
+	if err != nil {
+		stopBackground()
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	keyManager, err := NewKeyManager(log, cfg)
+	if err != nil {
+		stopBackground()
+		_ = storage.Close(context.Background())
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	authorizer := auth.NewAuthorizer(storage, storage)
+	documentService := document.New(log, keyManager, storage, storage, authorizer)
+
+	// The issuer reads documents through the document service, which checks
+	// that they belong to the signing user and decrypts their content.
+	issuer := si_service.New(
+		log,
+		keyManager,
+		documentService,
+		storage,
+		authorizer,
+		cfg.Blockchain.Address,
+		cfg.Blockchain.Timeout,
+		blockchainCreds,
+	)
+
+	unary := []grpc.UnaryServerInterceptor{interceptors.Timeout(cfg.GRPC.Timeout)}
+	var stream []grpc.StreamServerInterceptor
+
+	if !cfg.Auth.Disabled {
+		authenticator, err := newAuthenticator(log, cfg.Auth, storage)
+		if err != nil {
+			stopBackground()
+			_ = keyManager.Close()
+			_ = storage.Close(context.Background())
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		public := healthpb.Health_ServiceDesc.ServiceName
+		unary = append(unary, interceptors.UnaryAuth(log, authenticator, public))
+		stream = append(stream, interceptors.StreamAuth(log, authenticator, public))
+	} else {
+		log.Warn("authentication is disabled, every caller is trusted")
+	}
+
+	rules := validation.New(validation.Limits{
+		MaxContentBytes: cfg.Limits.MaxContentBytes,
+		MaxTitleLength:  cfg.Limits.MaxTitleLength,
+	})
+	unary = append(unary, interceptors.Validate(log, rules))
+	stream = append(stream, interceptors.StreamValidate(log, rules))
+
+	gRPCServer := grpc.NewServer(
+		grpc.Creds(serverCreds),
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...),
+	)
+	documents.Register(
+		gRPCServer,
+		log,
+		documentService,
+	)
+	keyPairs := keypair.New(log, keyManager, storage, authorizer, cfg.Keys.Deletion.GracePeriod)
+	keys.Register(
+		gRPCServer,
+		log,
+		keyPairs,
+		externalkey.New(log, storage, authorizer),
+	)
+	users.Register(
+		gRPCServer,
+		log,
+		user.New(
+			log,
+			storage,
+		),
+	)
+	signature_issuer.Register(
+		gRPCServer,
+		log,
+		issuer,
+	)
+	cipher.Register(
+		gRPCServer,
+		log,
+		cipher_service.New(log, keyManager, storage, authorizer),
+	)
+
+	healthServer := grpchealth.NewServer()
+	healthpb.RegisterHealthServer(gRPCServer, healthServer)
+
+	checker := health.New(log, healthServer, cfg.Health.Interval, cfg.Health.Timeout)
+	checker.AddProbe(probeMongo, storage.Ping)
+	checker.AddProbe(probeKeys, keyManager.Ping)
+	checker.AddProbe(probeBlockchain, issuer.Ping)
+	checker.AddService(tmsv1.DocumentService_ServiceDesc.ServiceName, probeMongo, probeKeys)
+	checker.AddService(tmsv1.UsersService_ServiceDesc.ServiceName, probeMongo)
+	checker.AddService(tmsv1.KeysService_ServiceDesc.ServiceName, probeMongo, probeKeys)
+	checker.AddService(tmsv1.CipherService_ServiceDesc.ServiceName, probeMongo, probeKeys)
+	checker.AddService(
+		tmsv1.SignatureIssuerService_ServiceDesc.ServiceName,
+		probeMongo,
+		probeKeys,
+		probeBlockchain,
+	)
+
+	// Only MongoDB decides readiness. The services that need the key
+	// backend or the blockchain processor report NOT_SERVING on their own
+	// while the others keep serving.
+	checker.SetReadiness(probeMongo)
+
+	go checker.Run(background)
+
+	go keyPairs.RunDeletion(background, cfg.Keys.Deletion.Interval, cfg.Keys.Deletion.Lease)
+	if cfg.Keys.Rotation.MaxAge > 0 {
+		go keyPairs.RunRotation(background, cfg.Keys.Rotation.Interval, cfg.Keys.Rotation.MaxAge)
+	}
+
+	return &App{
+		log:             log,
+		GRPCServer:      grpcapp.New(log, gRPCServer, cfg.GRPC.Address),
+		shutdownTimeout: cfg.GRPC.ShutdownTimeout,
+		storage:         storage,
+		keyManager:      keyManager,
+		issuer:          issuer,
+		health:          checker,
+		stopBackground:  stopBackground,
+	}, nil
+}
+
+// Stop shuts the application down in dependency order: health reports
+// NOT_SERVING and the gRPC server is drained first, which also waits for
+// the blockchain anchoring of in-flight signing calls. Then the blockchain
+// processor connection is closed, the key backend is released, and MongoDB
+// is disconnected last.
+func (a *App) Stop() {
+	const op = "app.Stop"
+
+	log := a.log.With(slog.String("op", op))
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.shutdownTimeout)
+	defer cancel()
+
+	a.health.Shutdown()
+	a.stopBackground()
+
+	a.GRPCServer.Stop(ctx)
+
+	if err := a.issuer.Close(); err != nil {
+		log.Error("failed to close blockchain processor connection", slog.Any("error", err))
+	}
+
+	if err := a.keyManager.Close(); err != nil {
+		log.Error("failed to release key backend", slog.Any("error", err))
+	}
+
+	disconnectCtx, cancelDisconnect := context.WithTimeout(context.Background(), disconnectTimeout)
+	defer cancelDisconnect()
+
+	if err := a.storage.Close(disconnectCtx); err != nil {
+		log.Error("failed to disconnect from MongoDB", slog.Any("error", err))
+	}
+}
+
+// serverCredentials returns TLS credentials for the listener when enabled,
+// with certificates reloaded from disk as they are rotated.
+func serverCredentials(
+	ctx context.Context,
+	log *slog.Logger,
+	cfg config.ServerTLSConfig,
+) (credentials.TransportCredentials, error) {
+	if !cfg.Enabled {
+		log.Warn("gRPC listener TLS is disabled, serving plaintext")
+		return insecure.NewCredentials(), nil
+	}
+
+	caFile := cfg.ClientCAFile
+	if cfg.ClientAuthType() == tls.NoClientCert {
+		caFile = ""
+	}
+
+	reloader, err := certs.NewReloader(log, cfg.CertFile, cfg.KeyFile, caFile)
+	if err != nil {
+		return nil, fmt.Errorf("listener TLS: %w", err)
+	}
+	go reloader.Watch(ctx, cfg.ReloadInterval)
+
+	return credentials.NewTLS(reloader.ServerConfig(cfg.ClientAuthType())), nil
+}
+
+// blockchainCredentials returns TLS credentials pinned to the configured CA
+// for the blockchain processor connection when enabled.
+func blockchainCredentials(
+	ctx context.Context,
+	log *slog.Logger,
+	cfg config.BlockchainConfig,
+) (credentials.TransportCredentials, error) {
+	if !cfg.TLS.Enabled {
+		log.Warn("blockchain processor TLS is disabled, dialing plaintext")
+		return insecure.NewCredentials(), nil
+	}
+
+	reloader, err := certs.NewReloader(log, cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("blockchain TLS: %w", err)
+	}
+	go reloader.Watch(ctx, cfg.TLS.ReloadInterval)
+
+	return credentials.NewTLS(reloader.ClientConfig(cfg.TLS.ServerName)), nil
+}
+
+// NewKeyManager opens the key backend selected by cfg.Keys.Backend.
+func NewKeyManager(log *slog.Logger, cfg *config.Config) (crypto.KeyManager, error) {
+	switch cfg.Keys.Backend {
+	case config.KeysBackendPKCS11:
+		token, err := hsm.New(log, hsm.Options{
+			LibPath:          cfg.HSM.LibPath,
+			TokenLabel:       cfg.HSM.TokenLabel,
+			Pin:              cfg.HSM.Pin,
+			PoolSize:         cfg.HSM.PoolSize,
+			OperationTimeout: cfg.HSM.OperationTimeout,
+			RetryAttempts:    cfg.HSM.RetryAttempts,
+			RetryBackoff:     cfg.HSM.RetryBackoff,
+			Extractable:      cfg.Keys.Backup.Extractable,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return token, nil
+	case config.KeysBackendSoftware:
+		store, err := software.New(log, software.Options{
+			Path:       cfg.Keys.Software.Path,
+			Passphrase: cfg.Keys.Software.Passphrase,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown key backend %q", cfg.Keys.Backend)
+	}
+}
+
+func newAuthenticator(
+	log *slog.Logger,
+	cfg config.AuthConfig,
+	storage *mongodb.Storage,
+) (*auth.Authenticator, error) {
+	jwtKeys, err := auth.LoadVerificationKeys(cfg.JWT.HMACSecret, cfg.JWT.PublicKeyFiles, cfg.JWT.JWKSFile)
+	if err != nil {
+		return nil, fmt.Errorf("auth keys: %w", err)
+	}
+
+	opts := auth.Options{
+		JWTKeys:       jwtKeys,
+		Algorithms:    cfg.JWT.Algorithms,
+		Issuer:        cfg.JWT.Issuer,
+		Audience:      cfg.JWT.Audience,
+		Certificates:  cfg.MTLS.Enabled,
+		AdminSubjects: cfg.MTLS.AdminSubjects,
+	}
+	if cfg.APIKeys.Enabled {
+		opts.APIKeys = storage
+	}
+
+	return auth.New(log, opts), nil
+}
@@ -0,0 +1,69 @@
+package grpcapp
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"google.golang.org/grpc"
+	"net"
+)
+
+type App struct {
+	log        *slog.Logger
+	gRPCServer *grpc.Server
+	address    string
+}
+
+// New wraps an already configured gRPC server with its listen address.
+func New(
+	log *slog.Logger,
+	gRPCServer *grpc.Server,
+	address string,
+) *App {
+	return &App{
+		log:        log,
+		gRPCServer: gRPCServer,
+		address:    address,
+	}
+}
+
+// Run listens on the configured address and serves until Stop is called.
+func (a *App) Run() error {
+	const op = "grpcapp.Run"
+
+	l, err := net.Listen("tcp", a.address)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	a.log.Info("gRPC server started", slog.String("address", l.Addr().String()))
+
+	if err := a.gRPCServer.Serve(l); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// Stop drains in-flight calls and refuses new ones. When ctx expires before
+// the drain completes, the remaining calls are cancelled.
+func (a *App) Stop(ctx context.Context) {
+	const op = "grpcapp.Stop"
+
+	a.log.With(slog.String("op", op)).Info("stopping gRPC server")
+
+	done := make(chan struct{})
+
+	go func() {
+		a.gRPCServer.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		a.log.Warn("graceful stop deadline exceeded, cancelling in-flight calls")
+		a.gRPCServer.Stop()
+		<-done
+	}
+}
@@ -1,33 +1,415 @@
 package config
 
 import (
+	"crypto/tls"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/ilyakaznacheev/cleanenv"
+	"net"
 	"os"
+	"strings"
+	"time"
+)
+
+const (
+	EnvLocal = "local"
+	EnvDev   = "dev"
+	EnvProd  = "production"
+)
+
+// Key backends selectable with keys.backend.
+const (
+	KeysBackendPKCS11   = "pkcs11"
+	KeysBackendSoftware = "software"
 )
 
 type Config struct {
-	Env string `yaml:"env" env-required:"true"`
+	Env        string           `yaml:"env" env:"ENV" env-default:"local"`
+	GRPC       GRPCConfig       `yaml:"grpc"`
+	Storage    StorageConfig    `yaml:"storage"`
+	Keys       KeysConfig       `yaml:"keys"`
+	HSM        HSMConfig        `yaml:"hsm"`
+	Blockchain BlockchainConfig `yaml:"blockchain"`
+	Log        LogConfig        `yaml:"log"`
+	Health     HealthConfig     `yaml:"health"`
+	Auth       AuthConfig       `yaml:"auth"`
+	Limits     LimitsConfig     `yaml:"limits"`
+}
+
+type GRPCConfig struct {
+	Address string        `yaml:"address" env:"GRPC_ADDRESS" env-default:":44047"`
+	Timeout time.Duration `yaml:"timeout" env:"GRPC_TIMEOUT" env-default:"10s"`
+	// ShutdownTimeout bounds how long in-flight calls may drain on shutdown.
+	ShutdownTimeout time.Duration   `yaml:"shutdown_timeout" env:"GRPC_SHUTDOWN_TIMEOUT" env-default:"30s"`
+	TLS             ServerTLSConfig `yaml:"tls" env-prefix:"GRPC_TLS_"`
+}
+
+type ServerTLSConfig struct {
+	Enabled  bool   `yaml:"enabled" env:"ENABLED"`
+	CertFile string `yaml:"cert_file" env:"CERT_FILE"`
+	KeyFile  string `yaml:"key_file" env:"KEY_FILE"`
+	// ClientCAFile is the CA bundle client certificates are verified against.
+	ClientCAFile string `yaml:"client_ca_file" env:"CLIENT_CA_FILE"`
+	// ClientAuth is one of none, request (verify if presented) or require.
+	ClientAuth     string        `yaml:"client_auth" env:"CLIENT_AUTH" env-default:"none"`
+	ReloadInterval time.Duration `yaml:"reload_interval" env:"RELOAD_INTERVAL" env-default:"1m"`
+}
+
+type StorageConfig struct {
+	URI            string        `yaml:"uri" env:"MONGODB_URI"`
+	Database       string        `yaml:"database" env:"MONGODB_DATABASE"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout" env:"MONGODB_CONNECT_TIMEOUT" env-default:"10s"`
+	Timeout        time.Duration `yaml:"timeout" env:"MONGODB_TIMEOUT" env-default:"5s"`
+}
+
+type KeysConfig struct {
+	// Backend selects where private keys live: pkcs11 or, outside
+	// production, software.
+	Backend  string         `yaml:"backend" env:"KEYS_BACKEND" env-default:"pkcs11"`
+	Software SoftwareConfig `yaml:"software" env-prefix:"KEYS_SOFTWARE_"`
+	Rotation RotationConfig `yaml:"rotation" env-prefix:"KEYS_ROTATION_"`
+	Deletion DeletionConfig `yaml:"deletion" env-prefix:"KEYS_DELETION_"`
+	Backup   BackupConfig   `yaml:"backup" env-prefix:"KEYS_BACKUP_"`
+}
+
+type BackupConfig struct {
+	// Extractable lets keys generated from now on be backed up, wrapped
+	// under the backup KEK. Keys generated without it cannot be.
+	Extractable bool `yaml:"extractable" env:"EXTRACTABLE"`
+	// KEKFile holds the 32-byte backup key-encryption key, raw or hex
+	// encoded. Only tms-keys reads it.
+	KEKFile string `yaml:"kek_file" env:"KEK_FILE"`
+}
+
+type DeletionConfig struct {
+	// GracePeriod is how long a deleted key can still be restored before
+	// it is destroyed.
+	GracePeriod time.Duration `yaml:"grace_period" env:"GRACE_PERIOD" env-default:"168h"`
+	// Interval is how often keys past their grace period are destroyed.
+	Interval time.Duration `yaml:"interval" env:"INTERVAL" env-default:"1m"`
+	// Lease is how long a replica owns a destruction it claimed. Another
+	// replica only resumes it once the lease has run out, so it must be
+	// longer than destroying one key takes.
+	Lease time.Duration `yaml:"lease" env:"LEASE" env-default:"10m"`
+}
+
+type RotationConfig struct {
+	// MaxAge rotates a key once its current version is older; zero turns
+	// automatic rotation off.
+	MaxAge time.Duration `yaml:"max_age" env:"MAX_AGE"`
+	// Interval is how often keys are checked against MaxAge.
+	Interval time.Duration `yaml:"interval" env:"INTERVAL" env-default:"1h"`
+}
+
+type SoftwareConfig struct {
+	// Path is the encrypted keystore file; empty keeps keys in memory only.
+	Path string `yaml:"path" env:"PATH"`
+	// Passphrase encrypts the keystore file. PassphraseFile takes precedence.
+	Passphrase     string `yaml:"passphrase" env:"PASSPHRASE"`
+	PassphraseFile string `yaml:"passphrase_file" env:"PASSPHRASE_FILE"`
+}
+
+type HSMConfig struct {
+	LibPath    string `yaml:"lib_path" env:"HSM_LIBPATH"`
+	TokenLabel string `yaml:"token_label" env:"HSM_TOKEN_LABEL"`
+	// Pin is the user PIN of the token. PinFile takes precedence when set,
+	// so the PIN can be mounted as a secret instead of living in the environment.
+	Pin     string `yaml:"pin" env:"HSM_PIN"`
+	PinFile string `yaml:"pin_file" env:"HSM_PIN_FILE"`
+	// PoolSize is the number of logged-in sessions shared by concurrent calls.
+	PoolSize int `yaml:"pool_size" env:"HSM_POOL_SIZE" env-default:"8"`
+	// OperationTimeout bounds waiting for a session plus the HSM call itself.
+	OperationTimeout time.Duration `yaml:"operation_timeout" env:"HSM_OPERATION_TIMEOUT" env-default:"5s"`
+	// RetryAttempts bounds how often an idempotent operation is tried after
+	// the session fails and the token is reinitialized.
+	RetryAttempts int           `yaml:"retry_attempts" env:"HSM_RETRY_ATTEMPTS" env-default:"3"`
+	RetryBackoff  time.Duration `yaml:"retry_backoff" env:"HSM_RETRY_BACKOFF" env-default:"100ms"`
+}
+
+type BlockchainConfig struct {
+	Address string          `yaml:"address" env:"BLOCKCHAIN_ADDRESS" env-default:"localhost:44046"`
+	Timeout time.Duration   `yaml:"timeout" env:"BLOCKCHAIN_TIMEOUT" env-default:"5s"`
+	TLS     ClientTLSConfig `yaml:"tls" env-prefix:"BLOCKCHAIN_TLS_"`
+}
+
+type ClientTLSConfig struct {
+	Enabled bool `yaml:"enabled" env:"ENABLED"`
+	// CAFile is the pinned CA bundle; the server must chain to it.
+	CAFile string `yaml:"ca_file" env:"CA_FILE"`
+	// ServerName overrides the name verified against the server certificate.
+	ServerName string `yaml:"server_name" env:"SERVER_NAME"`
+	// CertFile and KeyFile are the optional client certificate for mTLS.
+	CertFile       string        `yaml:"cert_file" env:"CERT_FILE"`
+	KeyFile        string        `yaml:"key_file" env:"KEY_FILE"`
+	ReloadInterval time.Duration `yaml:"reload_interval" env:"RELOAD_INTERVAL" env-default:"1m"`
+}
+
+// ClientAuthType maps ClientAuth onto the crypto/tls policy.
+func (c ServerTLSConfig) ClientAuthType() tls.ClientAuthType {
+	switch c.ClientAuth {
+	case "request":
+		return tls.VerifyClientCertIfGiven
+	case "require":
+		return tls.RequireAndVerifyClientCert
+	default:
+		return tls.NoClientCert
+	}
+}
+
+type HealthConfig struct {
+	Interval time.Duration `yaml:"interval" env:"HEALTH_INTERVAL" env-default:"10s"`
+	// Timeout bounds every single dependency probe.
+	Timeout time.Duration `yaml:"timeout" env:"HEALTH_TIMEOUT" env-default:"3s"`
+}
+
+type AuthConfig struct {
+	// Disabled lets every RPC through unauthenticated. Authentication is on
+	// unless turned off explicitly, which production does not allow.
+	Disabled bool          `yaml:"disabled" env:"AUTH_DISABLED"`
+	JWT      JWTConfig     `yaml:"jwt" env-prefix:"AUTH_JWT_"`
+	APIKeys  APIKeysConfig `yaml:"api_keys" env-prefix:"AUTH_API_KEYS_"`
+	MTLS     MTLSConfig    `yaml:"mtls" env-prefix:"AUTH_MTLS_"`
+}
+
+type JWTConfig struct {
+	HMACSecret     string   `yaml:"hmac_secret" env:"HMAC_SECRET"`
+	PublicKeyFiles []string `yaml:"public_key_files" env:"PUBLIC_KEY_FILES"`
+	JWKSFile       string   `yaml:"jwks_file" env:"JWKS_FILE"`
+	Algorithms     []string `yaml:"algorithms" env:"ALGORITHMS" env-default:"RS256,ES256"`
+	Issuer         string   `yaml:"issuer" env:"ISSUER"`
+	Audience       string   `yaml:"audience" env:"AUDIENCE"`
+}
+
+type APIKeysConfig struct {
+	// Enabled accepts hashed API keys stored in the apiKeys collection.
+	Enabled bool `yaml:"enabled" env:"ENABLED"`
+}
+
+type MTLSConfig struct {
+	// Enabled maps verified client certificate subjects to callers.
+	Enabled       bool     `yaml:"enabled" env:"ENABLED"`
+	AdminSubjects []string `yaml:"admin_subjects" env:"ADMIN_SUBJECTS"`
+}
+
+func (c JWTConfig) Configured() bool {
+	return c.HMACSecret != "" || len(c.PublicKeyFiles) > 0 || c.JWKSFile != ""
+}
+
+type LimitsConfig struct {
+	// MaxContentBytes caps the size of a document's content.
+	MaxContentBytes int `yaml:"max_content_bytes" env:"LIMITS_MAX_CONTENT_BYTES" env-default:"1048576"`
+	MaxTitleLength  int `yaml:"max_title_length" env:"LIMITS_MAX_TITLE_LENGTH" env-default:"256"`
+}
+
+type LogConfig struct {
+	// Level overrides the level implied by Env: debug, info, warn or error.
+	Level string `yaml:"level" env:"LOG_LEVEL"`
+	// Format overrides the handler implied by Env: pretty, text or json.
+	Format string `yaml:"format" env:"LOG_FORMAT"`
 }
 
 func MustLoad() *Config {
-	path := fetchConfigPath()
+	config, err := Load(fetchConfigPath())
+
+	if err != nil {
+		panic(err.Error())
+	}
+
+	return config
+}
+
+// Load reads the config file at path, applies environment overrides and
+// validates the result. An empty path reads the configuration from the
+// environment only.
+func Load(path string) (*Config, error) {
+	var config Config
 
 	if path == "" {
-		panic("Config path is empty")
+		if err := cleanenv.ReadEnv(&config); err != nil {
+			return nil, fmt.Errorf("failed to read config from environment: %w", err)
+		}
+	} else {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return nil, fmt.Errorf("config file does not exist: %s", path)
+		}
+
+		if err := cleanenv.ReadConfig(path, &config); err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
 	}
 
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		panic("Config file does not exist: " + path)
+	if err := config.resolveSecrets(); err != nil {
+		return nil, err
 	}
 
-	var config Config
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	return &config, nil
+}
+
+// Validate reports every problem in the configuration at once, one per line.
+func (c *Config) Validate() error {
+	var problems []error
+
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			problems = append(problems, fmt.Errorf("  - "+format, args...))
+		}
+	}
+
+	check(
+		c.Env == EnvLocal || c.Env == EnvDev || c.Env == EnvProd,
+		"env: must be one of %s, %s, %s (got %q)", EnvLocal, EnvDev, EnvProd, c.Env,
+	)
+
+	check(validAddress(c.GRPC.Address), "grpc.address: must be host:port (got %q)", c.GRPC.Address)
+	check(c.GRPC.Timeout > 0, "grpc.timeout: must be positive")
+	check(c.GRPC.ShutdownTimeout > 0, "grpc.shutdown_timeout: must be positive")
+
+	if c.GRPC.TLS.Enabled {
+		check(c.GRPC.TLS.CertFile != "", "grpc.tls.cert_file: is required when TLS is enabled")
+		check(c.GRPC.TLS.KeyFile != "", "grpc.tls.key_file: is required when TLS is enabled")
+		check(
+			oneOf(c.GRPC.TLS.ClientAuth, "none", "request", "require"),
+			"grpc.tls.client_auth: must be one of none, request, require (got %q)", c.GRPC.TLS.ClientAuth,
+		)
+		check(
+			c.GRPC.TLS.ClientAuth == "none" || c.GRPC.TLS.ClientCAFile != "",
+			"grpc.tls.client_ca_file: is required when client_auth is %q", c.GRPC.TLS.ClientAuth,
+		)
+		check(c.GRPC.TLS.ReloadInterval > 0, "grpc.tls.reload_interval: must be positive")
+	}
+
+	check(c.Storage.URI != "", "storage.uri: is required (MONGODB_URI)")
+	check(c.Storage.Database != "", "storage.database: is required (MONGODB_DATABASE)")
+	check(c.Storage.ConnectTimeout > 0, "storage.connect_timeout: must be positive")
+	check(c.Storage.Timeout > 0, "storage.timeout: must be positive")
+
+	check(
+		oneOf(c.Keys.Backend, KeysBackendPKCS11, KeysBackendSoftware),
+		"keys.backend: must be one of %s, %s (got %q)", KeysBackendPKCS11, KeysBackendSoftware, c.Keys.Backend,
+	)
+
+	if c.Keys.Backend == KeysBackendSoftware {
+		check(c.Env != EnvProd, "keys.backend: %s keys are not allowed in %s", KeysBackendSoftware, EnvProd)
+		check(
+			c.Keys.Software.Path == "" || c.Keys.Software.Passphrase != "",
+			"keys.software.passphrase: is required with a keystore path (KEYS_SOFTWARE_PASSPHRASE or KEYS_SOFTWARE_PASSPHRASE_FILE)",
+		)
+	}
+
+	check(c.Keys.Rotation.MaxAge >= 0, "keys.rotation.max_age: must not be negative")
+	if c.Keys.Rotation.MaxAge > 0 {
+		check(c.Keys.Rotation.Interval > 0, "keys.rotation.interval: must be positive")
+	}
+
+	check(c.Keys.Deletion.GracePeriod >= 0, "keys.deletion.grace_period: must not be negative")
+	check(c.Keys.Deletion.Interval > 0, "keys.deletion.interval: must be positive")
+	check(c.Keys.Deletion.Lease > 0, "keys.deletion.lease: must be positive")
+
+	if c.Keys.Backend == KeysBackendPKCS11 {
+		check(c.HSM.LibPath != "", "hsm.lib_path: is required (HSM_LIBPATH)")
+		check(c.HSM.TokenLabel != "", "hsm.token_label: is required (HSM_TOKEN_LABEL)")
+		check(c.HSM.Pin != "", "hsm.pin: is required (HSM_PIN or HSM_PIN_FILE)")
+		check(c.HSM.PoolSize > 0, "hsm.pool_size: must be positive")
+		check(c.HSM.OperationTimeout > 0, "hsm.operation_timeout: must be positive")
+		check(c.HSM.RetryAttempts > 0, "hsm.retry_attempts: must be positive")
+		check(c.HSM.RetryBackoff >= 0, "hsm.retry_backoff: must not be negative")
+	}
+
+	check(validAddress(c.Blockchain.Address), "blockchain.address: must be host:port (got %q)", c.Blockchain.Address)
+	check(c.Blockchain.Timeout > 0, "blockchain.timeout: must be positive")
+	if c.Blockchain.TLS.Enabled {
+		check(c.Blockchain.TLS.CAFile != "", "blockchain.tls.ca_file: is required when TLS is enabled")
+		check(
+			(c.Blockchain.TLS.CertFile == "") == (c.Blockchain.TLS.KeyFile == ""),
+			"blockchain.tls.cert_file, blockchain.tls.key_file: must be set together",
+		)
+		check(c.Blockchain.TLS.ReloadInterval > 0, "blockchain.tls.reload_interval: must be positive")
+	}
+
+	check(c.Health.Interval > 0, "health.interval: must be positive")
+	check(c.Health.Timeout > 0, "health.timeout: must be positive")
+
+	if !c.Auth.Disabled {
+		check(
+			c.Auth.JWT.Configured() || c.Auth.APIKeys.Enabled || c.Auth.MTLS.Enabled,
+			"auth: at least one of jwt, api_keys or mtls must be configured unless auth is disabled",
+		)
+		for _, alg := range c.Auth.JWT.Algorithms {
+			check(
+				oneOf(alg, "HS256", "HS384", "HS512", "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"),
+				"auth.jwt.algorithms: unsupported algorithm %q", alg,
+			)
+		}
+		check(
+			!c.Auth.MTLS.Enabled || (c.GRPC.TLS.Enabled && c.GRPC.TLS.ClientAuth != "none"),
+			"auth.mtls: requires grpc.tls with client_auth request or require",
+		)
+	} else {
+		check(c.Env != EnvProd, "auth.disabled: must not be set in %s", EnvProd)
+	}
+
+	check(c.Limits.MaxContentBytes > 0, "limits.max_content_bytes: must be positive")
+	check(c.Limits.MaxTitleLength > 0, "limits.max_title_length: must be positive")
+
+	check(
+		c.Log.Level == "" || oneOf(c.Log.Level, "debug", "info", "warn", "error"),
+		"log.level: must be one of debug, info, warn, error (got %q)", c.Log.Level,
+	)
+	check(
+		c.Log.Format == "" || oneOf(c.Log.Format, "pretty", "text", "json"),
+		"log.format: must be one of pretty, text, json (got %q)", c.Log.Format,
+	)
+
+	return errors.Join(problems...)
+}
+
+// resolveSecrets replaces secrets with the contents of their *_file
+// counterparts, so they can be mounted instead of living in the environment.
+func (c *Config) resolveSecrets() error {
+	secrets := []struct {
+		name  string
+		file  string
+		value *string
+	}{
+		{"hsm.pin_file", c.HSM.PinFile, &c.HSM.Pin},
+		{"keys.software.passphrase_file", c.Keys.Software.PassphraseFile, &c.Keys.Software.Passphrase},
+	}
+
+	for _, secret := range secrets {
+		if secret.file == "" {
+			continue
+		}
+
+		value, err := os.ReadFile(secret.file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", secret.name, err)
+		}
+
+		*secret.value = strings.TrimSpace(string(value))
+	}
+
+	return nil
+}
+
+func validAddress(address string) bool {
+	_, port, err := net.SplitHostPort(address)
+
+	return err == nil && port != ""
+}
 
-	if err := cleanenv.ReadConfig(path, &config); err != nil {
-		panic("Failed to read config file: " + err.Error())
+func oneOf(value string, options ...string) bool {
+	for _, option := range options {
+		if value == option {
+			return true
+		}
 	}
 
-	return &config
+	return false
 }
 
 func fetchConfigPath() string {
@@ -0,0 +1,174 @@
+// Package errs is the error taxonomy shared by storage, crypto and services.
+// Every error carries a Kind that transport layers translate into their own
+// status codes; errors.Is(err, errs.KindNotFound) works through any amount of
+// fmt.Errorf wrapping.
+package errs
+
+import (
+	"errors"
+	"fmt"
+)
+
+type Kind uint8
+
+const (
+	KindInternal Kind = iota
+	KindNotFound
+	KindAlreadyExists
+	KindInvalidArgument
+	KindPermissionDenied
+	KindUnauthenticated
+	KindUnavailable
+	KindFailedPrecondition
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindNotFound:
+		return "not found"
+	case KindAlreadyExists:
+		return "already exists"
+	case KindInvalidArgument:
+		return "invalid argument"
+	case KindPermissionDenied:
+		return "permission denied"
+	case KindUnauthenticated:
+		return "unauthenticated"
+	case KindUnavailable:
+		return "unavailable"
+	case KindFailedPrecondition:
+		return "failed precondition"
+	default:
+		return "internal"
+	}
+}
+
+// Error makes a Kind usable as an errors.Is target.
+func (k Kind) Error() string {
+	return k.String()
+}
+
+// Violation describes a single invalid request field.
+type Violation struct {
+	Field       string
+	Description string
+}
+
+type Error struct {
+	Kind Kind
+	// Message is safe to show to callers.
+	Message string
+	// ResourceType and ResourceName identify the object a not-found,
+	// already-exists or permission-denied error is about.
+	ResourceType string
+	ResourceName string
+	Violations   []Violation
+	Err          error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+
+	return []error{e.Kind, e.Err}
+}
+
+// New returns an error of the given kind.
+func New(kind Kind, message string) error {
+	return &Error{Kind: kind, Message: message}
+}
+
+// Wrap classifies err as kind, keeping it in the chain.
+func Wrap(kind Kind, err error, message string) error {
+	return &Error{Kind: kind, Message: message, Err: err}
+}
+
+// NotFound reports a missing resource. name may be empty.
+func NotFound(resourceType, name string) error {
+	return &Error{
+		Kind:         KindNotFound,
+		Message:      describe(resourceType, name, "not found"),
+		ResourceType: resourceType,
+		ResourceName: name,
+	}
+}
+
+// AlreadyExists reports a resource that collides with an existing one.
+func AlreadyExists(resourceType, name string) error {
+	return &Error{
+		Kind:         KindAlreadyExists,
+		Message:      describe(resourceType, name, "already exists"),
+		ResourceType: resourceType,
+		ResourceName: name,
+	}
+}
+
+// PermissionDenied reports that the caller may not act on a resource.
+func PermissionDenied(resourceType, name, reason string) error {
+	return &Error{
+		Kind:         KindPermissionDenied,
+		Message:      fmt.Sprintf("%s: %s", describe(resourceType, name, "access denied"), reason),
+		ResourceType: resourceType,
+		ResourceName: name,
+	}
+}
+
+// InvalidArgument reports one or more invalid request fields.
+func InvalidArgument(violations ...Violation) error {
+	message := "invalid argument"
+	if len(violations) == 1 {
+		message = fmt.Sprintf("invalid %s: %s", violations[0].Field, violations[0].Description)
+	} else if len(violations) > 1 {
+		message = fmt.Sprintf("%d invalid fields", len(violations))
+	}
+
+	return &Error{
+		Kind:       KindInvalidArgument,
+		Message:    message,
+		Violations: violations,
+	}
+}
+
+// InvalidField is InvalidArgument for a single field.
+func InvalidField(field, description string) error {
+	return InvalidArgument(Violation{Field: field, Description: description})
+}
+
+// Unavailable reports a dependency that cannot be reached right now.
+func Unavailable(err error, message string) error {
+	return Wrap(KindUnavailable, err, message)
+}
+
+// FailedPrecondition reports an operation that is not allowed in the
+// current state of the system.
+func FailedPrecondition(message string) error {
+	return New(KindFailedPrecondition, message)
+}
+
+// KindOf returns the kind of the outermost classified error in the chain,
+// or KindInternal when the chain has none.
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+
+	return KindInternal
+}
+
+func describe(resourceType, name, what string) string {
+	if name == "" {
+		return fmt.Sprintf("%s %s", resourceType, what)
+	}
+
+	return fmt.Sprintf("%s %q %s", resourceType, name, what)
+}
@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// APIKey is a static credential. Only the SHA-256 hash of the key is stored.
+type APIKey struct {
+	Hash      string    `bson:"hash"`
+	Name      string    `bson:"name"`
+	UserId    string    `bson:"userId"`
+	Roles     []string  `bson:"roles"`
+	Revoked   bool      `bson:"revoked"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
@@ -0,0 +1,11 @@
+package models
+
+// Ciphertext is data encrypted to one version of a key.
+type Ciphertext struct {
+	Label   string
+	Version int
+	// Scheme names the format of Ciphertext, one of the crypto.Cipher
+	// constants.
+	Scheme     string
+	Ciphertext []byte
+}
@@ -1,14 +1,32 @@
 package models
 
 type Document struct {
-	Id      string `bson:"_id"`
-	Title   string `bson:"title"`
-	Content string `bson:"content"`
-	Owner   Owner  `bson:"owner"`
+	Id    string `bson:"_id"`
+	Title string `bson:"title"`
+	// Content is the plaintext. Storage only holds it for documents written
+	// before content was encrypted at rest; the others have Sealed instead.
+	Content string         `bson:"content,omitempty"`
+	Sealed  *SealedContent `bson:"sealed,omitempty"`
+	Owner   Owner          `bson:"owner"`
+}
+
+// SealedContent is document content under envelope encryption: the content
+// is encrypted with a data key of its own, which is stored wrapped by a
+// master key that never leaves the key backend.
+type SealedContent struct {
+	// MasterKey is the backend label of the master key version DataKey is
+	// wrapped under.
+	MasterKey string `bson:"masterKey"`
+	DataKey   []byte `bson:"dataKey"`
+	// Ciphertext is the AES-256-GCM nonce followed by the sealed content.
+	// The format and the document id are bound to it as associated data,
+	// so it cannot be opened as another document.
+	Ciphertext []byte `bson:"ciphertext"`
+	Format     int    `bson:"format"`
 }
 
 type Owner struct {
-	Id    string `bson:"_id"`
+	Id    string `bson:"id"`
 	Name  string `bson:"name"`
 	Email string `bson:"email"`
 }
@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// Kinds of external key.
+const (
+	ExternalKeyPublicKey   = "public_key"
+	ExternalKeyCertificate = "certificate"
+)
+
+// ExternalKey is a public key or certificate of a partner, registered so
+// that signatures made outside this service can be verified. Its label
+// shares the namespace of key pair labels.
+type ExternalKey struct {
+	Label  string `bson:"label"`
+	UserId string `bson:"userId"`
+	Kind   string `bson:"kind"`
+	// PEM is the public key or certificate as it was imported.
+	PEM       string `bson:"pem"`
+	Algorithm string `bson:"algorithm"`
+	// Fingerprint is the hex SHA-256 of the SubjectPublicKeyInfo.
+	Fingerprint string `bson:"fingerprint"`
+	// Subject, Issuer and the validity period are set for certificates.
+	Subject   string    `bson:"subject,omitempty"`
+	Issuer    string    `bson:"issuer,omitempty"`
+	NotBefore time.Time `bson:"notBefore,omitempty"`
+	NotAfter  time.Time `bson:"notAfter,omitempty"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
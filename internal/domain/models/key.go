@@ -1,8 +1,102 @@
 package models
 
+import (
+	"fmt"
+	"time"
+)
+
+// Key lifecycle states. A key signs only while active; suspended and
+// revoked keys still verify, destroyed keys no longer exist in the backend.
+const (
+	KeyStatePreActive = "pre_active"
+	KeyStateActive    = "active"
+	KeyStateSuspended = "suspended"
+	KeyStateRevoked   = "revoked"
+	KeyStateDestroyed = "destroyed"
+)
+
+// Key provenances. Generated keys never existed outside the backend;
+// imported keys were generated by their owner and unwrapped into it.
+const (
+	KeyProvenanceGenerated = "generated"
+	KeyProvenanceImported  = "imported"
+)
+
 type Key struct {
-	Label string  `bson:"label"`
-	User  KeyUser `bson:"user"`
+	Label string `bson:"label"`
+	// Algorithm is the key type and size, e.g. RSA_2048 or EC_P256. Keys
+	// created before it was recorded are RSA_2048.
+	Algorithm string `bson:"algorithm,omitempty"`
+	// Scheme is the signature scheme the key signs with unless a request
+	// overrides it. Keys created before it was recorded use the default
+	// scheme of their algorithm.
+	Scheme string  `bson:"scheme,omitempty"`
+	User   KeyUser `bson:"user"`
+	// Version is the version new signatures are made with. Keys created
+	// before rotation existed have no version and are version 1.
+	Version  int          `bson:"version,omitempty"`
+	Versions []KeyVersion `bson:"versions,omitempty"`
+	// VersionCreatedAt is when the current version was created.
+	VersionCreatedAt time.Time `bson:"versionCreatedAt,omitempty"`
+	// RotationClaimedAt is when a rotation last took the key on. Other
+	// rotations leave it alone until the lease has run out; recording or
+	// abandoning the rotation releases it.
+	RotationClaimedAt time.Time `bson:"rotationClaimedAt,omitempty"`
+	// State is one of the KeyState constants. Keys created before states
+	// existed have none and are active.
+	State          string    `bson:"state,omitempty"`
+	StateReason    string    `bson:"stateReason,omitempty"`
+	StateChangedAt time.Time `bson:"stateChangedAt,omitempty"`
+	// CompromisedAt is set on revocation: signatures made from then on are
+	// not trusted.
+	CompromisedAt time.Time        `bson:"compromisedAt,omitempty"`
+	StateHistory  []KeyStateChange `bson:"stateHistory,omitempty"`
+	// Deletion is set while the key is scheduled for destruction.
+	Deletion *KeyDeletion `bson:"deletion,omitempty"`
+	// Provenance is one of the KeyProvenance constants. Keys created before
+	// it was recorded were generated.
+	Provenance string `bson:"provenance,omitempty"`
+}
+
+// KeyDeletion schedules the destruction of every version of a key and its
+// metadata. It doubles as the journal of the destruction once it started.
+type KeyDeletion struct {
+	RequestedAt  time.Time `bson:"requestedAt"`
+	DestroyAfter time.Time `bson:"destroyAfter"`
+	// KeepMetadata is set when the key is destroyed rather than deleted:
+	// its versions are destroyed, but its metadata stays in the destroyed
+	// state with Reason, so verifying an old signature reports the key as
+	// destroyed rather than unknown.
+	KeepMetadata bool   `bson:"keepMetadata,omitempty"`
+	Reason       string `bson:"reason,omitempty"`
+	// StartedAt is set when destruction began. From then on the deletion
+	// can no longer be cancelled and is resumed after a failure or restart.
+	StartedAt time.Time `bson:"startedAt,omitempty"`
+	// ClaimedAt is when a replica last took the destruction on. Other
+	// replicas leave it alone until the lease has run out; a failed
+	// attempt releases it.
+	ClaimedAt time.Time `bson:"claimedAt,omitempty"`
+	Attempts  int       `bson:"attempts,omitempty"`
+	LastError string    `bson:"lastError,omitempty"`
+}
+
+// KeyStateChange is one lifecycle transition of a key.
+type KeyStateChange struct {
+	From   string    `bson:"from"`
+	To     string    `bson:"to"`
+	Reason string    `bson:"reason,omitempty"`
+	At     time.Time `bson:"at"`
+}
+
+// KeyVersion is one generation of a key. Only the current version signs;
+// older versions are kept to verify the signatures they made.
+type KeyVersion struct {
+	Version int `bson:"version"`
+	// BackendLabel addresses the key pair in the key backend.
+	BackendLabel string    `bson:"backendLabel"`
+	CreatedAt    time.Time `bson:"createdAt"`
+	// RetiredAt is set once a newer version took over.
+	RetiredAt time.Time `bson:"retiredAt,omitempty"`
 }
 
 type KeyUser struct {
@@ -10,3 +104,69 @@ type KeyUser struct {
 	Name  string `bson:"name"`
 	Email string `bson:"email"`
 }
+
+// CurrentVersion returns the version new signatures are made with.
+func (k Key) CurrentVersion() int {
+	if k.Version == 0 {
+		return 1
+	}
+
+	return k.Version
+}
+
+// CurrentState returns the lifecycle state of the key.
+func (k Key) CurrentState() string {
+	if k.State == "" {
+		return KeyStateActive
+	}
+
+	return k.State
+}
+
+// CurrentProvenance returns where the key material comes from.
+func (k Key) CurrentProvenance() string {
+	if k.Provenance == "" {
+		return KeyProvenanceGenerated
+	}
+
+	return k.Provenance
+}
+
+// BackendLabels returns the backend label of every version of the key.
+func (k Key) BackendLabels() []string {
+	if len(k.Versions) == 0 {
+		return []string{k.Label}
+	}
+
+	labels := make([]string, 0, len(k.Versions))
+	for _, v := range k.Versions {
+		labels = append(labels, v.BackendLabel)
+	}
+
+	return labels
+}
+
+// BackendLabel returns the backend label of version. Version 1 of a key is
+// stored under the key label itself.
+func (k Key) BackendLabel(version int) (string, bool) {
+	for _, v := range k.Versions {
+		if v.Version == version {
+			return v.BackendLabel, true
+		}
+	}
+	if version == 1 {
+		return k.Label, true
+	}
+
+	return "", false
+}
+
+// VersionLabel is the backend label of version of the key labelled label.
+// The '#' cannot appear in labels users choose.
+func VersionLabel(label string, version int) string {
+	if version <= 1 {
+		return label
+	}
+
+	return fmt.Sprintf("%s#v%d", label, version)
+}
@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// MasterKey is a key in the key backend that wraps data keys. It is rotated
+// like a key pair: the current version wraps new data keys and retired
+// versions are kept until nothing is wrapped under them anymore.
+type MasterKey struct {
+	Name     string       `bson:"_id"`
+	Version  int          `bson:"version"`
+	Versions []KeyVersion `bson:"versions"`
+	// RotationClaimedAt is when a rotation last took the key on. Other
+	// rotations leave it alone until the lease has run out; recording or
+	// abandoning the rotation releases it.
+	RotationClaimedAt time.Time `bson:"rotationClaimedAt,omitempty"`
+}
+
+// Current returns the version new data keys are wrapped under.
+func (k MasterKey) Current() KeyVersion {
+	for _, v := range k.Versions {
+		if v.Version == k.Version {
+			return v
+		}
+	}
+
+	return KeyVersion{}
+}
@@ -0,0 +1,28 @@
+package models
+
+const (
+	AuthMethodJWT         = "jwt"
+	AuthMethodAPIKey      = "api_key"
+	AuthMethodCertificate = "certificate"
+
+	// RoleAdmin may act on behalf of any user.
+	RoleAdmin = "admin"
+)
+
+// Principal is the authenticated caller of an RPC.
+type Principal struct {
+	// Subject is the user id the caller acts as.
+	Subject string
+	Method  string
+	Roles   []string
+}
+
+func (p Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,27 @@
+package models
+
+// PublicKey is the public half of one version of a key, in the encodings
+// offered to verifiers.
+type PublicKey struct {
+	Label     string
+	Version   int
+	Algorithm string
+	Scheme    string
+	State     string
+	// DER is the SubjectPublicKeyInfo; PEM wraps the same bytes.
+	DER []byte
+	PEM string
+	// JWK is the key as a JSON Web Key.
+	JWK string
+	// Fingerprint is the hex SHA-256 of DER.
+	Fingerprint string
+}
+
+// WrappingKey is the public key keys are wrapped for before import.
+type WrappingKey struct {
+	Algorithm string
+	// Scheme names the format wrapped keys are submitted in.
+	Scheme      string
+	PEM         string
+	Fingerprint string
+}
@@ -1,6 +1,44 @@
 package models
 
+import "time"
+
 type Signature struct {
 	Valid     bool
 	Signature string
+	Scheme    string
+	// KeyState is the lifecycle state of the key when it was verified.
+	KeyState string
+	// PredatesRevocation is false when the key is revoked and the signature
+	// was made at or after its compromise, or when that cannot be told.
+	PredatesRevocation bool
+}
+
+// SignatureRecord remembers how a signature anchored on the blockchain was
+// made, so that verification does not have to guess the scheme.
+type SignatureRecord struct {
+	Id         string    `bson:"_id"`
+	DocumentId string    `bson:"documentId"`
+	UserId     string    `bson:"userId"`
+	KeyLabel   string    `bson:"keyLabel"`
+	KeyVersion int       `bson:"keyVersion"`
+	Scheme     string    `bson:"scheme"`
+	Signature  string    `bson:"signature"`
+	SignedAt   time.Time `bson:"signedAt"`
+}
+
+// PayloadSignature is a signature over content that is not a stored
+// document.
+type PayloadSignature struct {
+	Signature  string
+	Scheme     string
+	KeyLabel   string
+	KeyVersion int
+	// Digest is the hash of the signed content under the hash of Scheme.
+	Digest []byte
+	// Size is the length of the signed content in bytes, or 0 when only its
+	// digest was given.
+	Size int64
+	// AnchorId is the id the signature is saved under on the blockchain, if
+	// it was anchored.
+	AnchorId string
 }
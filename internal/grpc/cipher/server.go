@@ -0,0 +1,94 @@
+package cipher
+
+import (
+	"context"
+	tmsv1 "github.com/alexprishmont/masters-protos/gen/go/trustmanagement"
+	"golang.org/x/exp/slog"
+	"google.golang.org/grpc"
+	"tms/internal/domain/models"
+	"tms/internal/grpc/grpcerr"
+	"tms/internal/services/auth"
+)
+
+type serverAPI struct {
+	tmsv1.UnimplementedCipherServiceServer
+	log    *slog.Logger
+	cipher Cipher
+}
+
+type Cipher interface {
+	Encrypt(ctx context.Context, label string, plaintext []byte, associatedData []byte) (models.Ciphertext, error)
+	Decrypt(
+		ctx context.Context,
+		userId string,
+		label string,
+		version int,
+		ciphertext []byte,
+		associatedData []byte,
+	) ([]byte, error)
+}
+
+func Register(
+	gRPC *grpc.Server,
+	log *slog.Logger,
+	cipher Cipher,
+) {
+	tmsv1.RegisterCipherServiceServer(gRPC, &serverAPI{
+		log:    log,
+		cipher: cipher,
+	})
+}
+
+func (s *serverAPI) Encrypt(
+	ctx context.Context,
+	request *tmsv1.EncryptRequest,
+) (*tmsv1.EncryptResponse, error) {
+	// Anyone may encrypt to a key, but callers still may not act as
+	// another user.
+	if _, err := auth.ResolveUser(ctx, request.GetUserId()); err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	ciphertext, err := s.cipher.Encrypt(
+		ctx,
+		request.GetKeyLabel(),
+		request.GetPlaintext(),
+		request.GetAssociatedData(),
+	)
+
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	return &tmsv1.EncryptResponse{
+		KeyLabel:   ciphertext.Label,
+		KeyVersion: int32(ciphertext.Version),
+		Scheme:     ciphertext.Scheme,
+		Ciphertext: ciphertext.Ciphertext,
+	}, nil
+}
+
+func (s *serverAPI) Decrypt(
+	ctx context.Context,
+	request *tmsv1.DecryptRequest,
+) (*tmsv1.DecryptResponse, error) {
+	userId, err := auth.ResolveUser(ctx, request.GetUserId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	plaintext, err := s.cipher.Decrypt(
+		ctx,
+		userId,
+		request.GetKeyLabel(),
+		int(request.GetKeyVersion()),
+		request.GetCiphertext(),
+		request.GetAssociatedData(),
+	)
+
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	return &tmsv1.DecryptResponse{Plaintext: plaintext}, nil
+}
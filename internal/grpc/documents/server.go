@@ -5,9 +5,11 @@ import (
 	tmsv1 "github.com/alexprishmont/masters-protos/gen/go/trustmanagement"
 	"golang.org/x/exp/slog"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
+	"tms/internal/domain/errs"
 	"tms/internal/domain/models"
+	"tms/internal/grpc/grpcerr"
+	"tms/internal/services/auth"
+	"tms/internal/storage"
 )
 
 type serverAPI struct {
@@ -42,15 +44,20 @@ func (s *serverAPI) CreateDocument(
 	ctx context.Context,
 	request *tmsv1.CreateRequest,
 ) (*tmsv1.Document, error) {
+	ownerId, err := auth.ResolveUser(ctx, request.GetOwnerId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
 	id, err := s.document.CreateDocument(
 		ctx,
 		request.GetTitle(),
-		request.GetOwnerId(),
+		ownerId,
 		request.GetContent(),
 	)
 
 	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, err.Error())
+		return nil, grpcerr.Status(s.log, err)
 	}
 
 	return &tmsv1.Document{
@@ -58,7 +65,7 @@ func (s *serverAPI) CreateDocument(
 		Title:   request.GetTitle(),
 		Content: request.GetContent(),
 		Owner: &tmsv1.Owner{
-			Id: request.GetOwnerId(),
+			Id: ownerId,
 		},
 	}, nil
 }
@@ -70,7 +77,7 @@ func (s *serverAPI) GetDocument(
 	document, err := s.document.Document(ctx, request.GetId())
 
 	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, "Invalid request")
+		return nil, grpcerr.Status(s.log, err)
 	}
 
 	return &tmsv1.Document{
@@ -89,16 +96,21 @@ func (s *serverAPI) UpdateDocument(
 	ctx context.Context,
 	request *tmsv1.UpdateRequest,
 ) (*tmsv1.Document, error) {
+	ownerId, err := auth.ResolveUser(ctx, request.GetOwnerId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
 	document, err := s.document.UpdateDocument(
 		ctx,
 		request.GetId(),
 		request.GetTitle(),
 		request.GetContent(),
-		request.GetOwnerId(),
+		ownerId,
 	)
 
 	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, err.Error())
+		return nil, grpcerr.Status(s.log, err)
 	}
 
 	return &tmsv1.Document{
@@ -120,11 +132,11 @@ func (s *serverAPI) DeleteDocument(
 	success, err := s.document.DeleteDocument(ctx, request.GetId())
 
 	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, "Invalid request")
+		return nil, grpcerr.Status(s.log, err)
 	}
 
 	if success == false {
-		return nil, status.Error(codes.InvalidArgument, "Deletion is not successful.")
+		return nil, grpcerr.Status(s.log, errs.NotFound(storage.ResourceDocument, request.GetId()))
 	}
 
 	return &tmsv1.Document{
@@ -0,0 +1,98 @@
+// Package grpcerr translates errs taxonomy errors into gRPC statuses.
+package grpcerr
+
+import (
+	"context"
+	"errors"
+	"golang.org/x/exp/slog"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+	"tms/internal/domain/errs"
+)
+
+// Status converts err into a gRPC status error. Classified errors keep their
+// caller-safe message and gain errdetails: BadRequest field violations for
+// invalid arguments and ResourceInfo for errors about a resource. Anything
+// unclassified is logged and reported as a bare Internal error.
+func Status(log *slog.Logger, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, "deadline exceeded")
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, "request cancelled")
+	}
+
+	var e *errs.Error
+	if !errors.As(err, &e) || e.Kind == errs.KindInternal {
+		log.Error("internal error", slog.Any("error", err))
+		return status.Error(codes.Internal, "internal error")
+	}
+
+	if e.Kind == errs.KindUnavailable {
+		log.Warn("dependency unavailable", slog.Any("error", err))
+	}
+
+	st := status.New(code(e.Kind), e.Message)
+
+	if detailed, detailErr := st.WithDetails(details(e)...); detailErr == nil {
+		st = detailed
+	}
+
+	return st.Err()
+}
+
+func code(kind errs.Kind) codes.Code {
+	switch kind {
+	case errs.KindNotFound:
+		return codes.NotFound
+	case errs.KindAlreadyExists:
+		return codes.AlreadyExists
+	case errs.KindInvalidArgument:
+		return codes.InvalidArgument
+	case errs.KindPermissionDenied:
+		return codes.PermissionDenied
+	case errs.KindUnauthenticated:
+		return codes.Unauthenticated
+	case errs.KindUnavailable:
+		return codes.Unavailable
+	case errs.KindFailedPrecondition:
+		return codes.FailedPrecondition
+	default:
+		return codes.Internal
+	}
+}
+
+func details(e *errs.Error) []protoadapt.MessageV1 {
+	var result []protoadapt.MessageV1
+
+	if len(e.Violations) > 0 {
+		violations := make([]*errdetails.BadRequest_FieldViolation, 0, len(e.Violations))
+		for _, v := range e.Violations {
+			violations = append(violations, &errdetails.BadRequest_FieldViolation{
+				Field:       v.Field,
+				Description: v.Description,
+			})
+		}
+		result = append(result, &errdetails.BadRequest{FieldViolations: violations})
+	}
+
+	if e.ResourceType != "" {
+		result = append(result, &errdetails.ResourceInfo{
+			ResourceType: e.ResourceType,
+			ResourceName: e.ResourceName,
+			Description:  e.Message,
+		})
+	}
+
+	return result
+}
@@ -0,0 +1,146 @@
+package interceptors
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"golang.org/x/exp/slog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"strings"
+	"tms/internal/domain/models"
+	"tms/internal/services/auth"
+)
+
+const apiKeyHeader = "x-api-key"
+
+type Authenticator interface {
+	AuthenticateToken(ctx context.Context, token string) (models.Principal, error)
+	AuthenticateAPIKey(ctx context.Context, key string) (models.Principal, error)
+	AuthenticateCertificate(ctx context.Context, cert *x509.Certificate) (models.Principal, error)
+}
+
+// UnaryAuth authenticates every unary call and stores the caller in the
+// context. Methods of the services listed in public are not authenticated.
+func UnaryAuth(log *slog.Logger, authenticator Authenticator, public ...string) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req any,
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (any, error) {
+		if isPublic(info.FullMethod, public) {
+			return handler(ctx, req)
+		}
+
+		ctx, err := authenticate(ctx, log, authenticator, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// StreamAuth is the streaming counterpart of UnaryAuth.
+func StreamAuth(log *slog.Logger, authenticator Authenticator, public ...string) grpc.StreamServerInterceptor {
+	return func(
+		srv any,
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		if isPublic(info.FullMethod, public) {
+			return handler(srv, stream)
+		}
+
+		ctx, err := authenticate(stream.Context(), log, authenticator, info.FullMethod)
+		if err != nil {
+			return err
+		}
+
+		return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+// authenticate tries, in order, a bearer token, an API key and a verified
+// client certificate. The first credential presented decides the outcome.
+func authenticate(
+	ctx context.Context,
+	log *slog.Logger,
+	authenticator Authenticator,
+	method string,
+) (context.Context, error) {
+	var (
+		principal models.Principal
+		err       error
+	)
+
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	switch {
+	case len(md.Get("authorization")) > 0:
+		token, ok := strings.CutPrefix(md.Get("authorization")[0], "Bearer ")
+		if !ok {
+			return nil, status.Error(codes.Unauthenticated, "authorization header must be a bearer token")
+		}
+		principal, err = authenticator.AuthenticateToken(ctx, strings.TrimSpace(token))
+	case len(md.Get(apiKeyHeader)) > 0:
+		principal, err = authenticator.AuthenticateAPIKey(ctx, md.Get(apiKeyHeader)[0])
+	default:
+		cert := verifiedClientCertificate(ctx)
+		if cert == nil {
+			return nil, status.Error(codes.Unauthenticated, "no credentials provided")
+		}
+		principal, err = authenticator.AuthenticateCertificate(ctx, cert)
+	}
+
+	if err != nil {
+		if errors.Is(err, auth.ErrUnauthenticated) {
+			log.Debug("authentication failed", slog.String("method", method), slog.Any("error", err))
+			return nil, status.Error(codes.Unauthenticated, "invalid credentials")
+		}
+
+		log.Error("authentication error", slog.String("method", method), slog.Any("error", err))
+		return nil, status.Error(codes.Unavailable, "authentication is temporarily unavailable")
+	}
+
+	return auth.WithPrincipal(ctx, principal), nil
+}
+
+func verifiedClientCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return tlsInfo.State.VerifiedChains[0][0]
+}
+
+func isPublic(fullMethod string, public []string) bool {
+	for _, service := range public {
+		if strings.HasPrefix(fullMethod, "/"+service+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
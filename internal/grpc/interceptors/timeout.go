@@ -0,0 +1,26 @@
+package interceptors
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"time"
+)
+
+// Timeout applies a default deadline to unary calls that arrive without one.
+func Timeout(timeout time.Duration) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req any,
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (any, error) {
+		if _, ok := ctx.Deadline(); ok {
+			return handler(ctx, req)
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		return handler(ctx, req)
+	}
+}
@@ -0,0 +1,64 @@
+package interceptors
+
+import (
+	"context"
+	"golang.org/x/exp/slog"
+	"google.golang.org/grpc"
+	"tms/internal/grpc/grpcerr"
+)
+
+type Validator interface {
+	Validate(request any) error
+}
+
+// Validate rejects requests that break their validation rules with
+// InvalidArgument before they reach a handler.
+func Validate(log *slog.Logger, validator Validator) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req any,
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (any, error) {
+		if err := validator.Validate(req); err != nil {
+			log.Debug("request rejected", slog.String("method", info.FullMethod), slog.Any("error", err))
+			return nil, grpcerr.Status(log, err)
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// StreamValidate is the streaming counterpart of Validate. Every message
+// received on a stream is checked; a message that breaks its rules fails
+// the receive with InvalidArgument.
+func StreamValidate(log *slog.Logger, validator Validator) grpc.StreamServerInterceptor {
+	return func(
+		srv any,
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		return handler(srv, &validatedStream{ServerStream: stream, log: log, validator: validator, method: info.FullMethod})
+	}
+}
+
+type validatedStream struct {
+	grpc.ServerStream
+	log       *slog.Logger
+	validator Validator
+	method    string
+}
+
+func (s *validatedStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	if err := s.validator.Validate(m); err != nil {
+		s.log.Debug("request rejected", slog.String("method", s.method), slog.Any("error", err))
+		return grpcerr.Status(s.log, err)
+	}
+
+	return nil
+}
@@ -3,29 +3,68 @@ package keys
 import (
 	"context"
 	tmsv1 "github.com/alexprishmont/masters-protos/gen/go/trustmanagement"
-	"github.com/miekg/pkcs11"
 	"golang.org/x/exp/slog"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"time"
+	"tms/internal/domain/models"
+	"tms/internal/grpc/grpcerr"
+	"tms/internal/services/auth"
 	"tms/internal/services/crypto"
 )
 
 type serverAPI struct {
 	tmsv1.UnimplementedKeysServiceServer
-	log      *slog.Logger
-	session  pkcs11.SessionHandle
-	operator crypto.Operator
+	log          *slog.Logger
+	keyPair      KeyPair
+	externalKeys ExternalKeys
+}
+
+type KeyPair interface {
+	CreateKeyPair(
+		ctx context.Context,
+		userId string,
+		label string,
+		algorithm crypto.Algorithm,
+		scheme crypto.Scheme,
+		preActive bool,
+	) (models.Key, error)
+	DeleteKeyPair(ctx context.Context, userId string, label string) (models.Key, error)
+	CancelKeyDeletion(ctx context.Context, userId string, label string) (models.Key, error)
+	RotateKey(ctx context.Context, userId string, label string) (models.Key, error)
+	ActivateKey(ctx context.Context, userId string, label string, reason string) (models.Key, error)
+	SuspendKey(ctx context.Context, userId string, label string, reason string) (models.Key, error)
+	RevokeKey(ctx context.Context, userId string, label string, reason string, compromisedAt time.Time) (models.Key, error)
+	DestroyKey(ctx context.Context, userId string, label string, reason string) (models.Key, error)
+	PublicKey(ctx context.Context, userId string, label string, version int) (models.PublicKey, error)
+	PublicKeySet(ctx context.Context, userId string) ([]models.PublicKey, string, error)
+	WrappingKey(ctx context.Context) (models.WrappingKey, error)
+	ImportKeyPair(
+		ctx context.Context,
+		userId string,
+		label string,
+		publicKeyPEM string,
+		wrapped []byte,
+		scheme crypto.Scheme,
+		preActive bool,
+	) (models.Key, error)
+}
+
+type ExternalKeys interface {
+	ImportExternalKey(ctx context.Context, userId string, label string, pemData string) (models.ExternalKey, error)
+	DeleteExternalKey(ctx context.Context, userId string, label string) (models.ExternalKey, error)
 }
 
 func Register(
 	gRPC *grpc.Server,
 	log *slog.Logger,
-	operator crypto.Operator,
+	keyPair KeyPair,
+	externalKeys ExternalKeys,
 ) {
 	tmsv1.RegisterKeysServiceServer(gRPC, &serverAPI{
-		log:      log,
-		operator: operator,
+		log:          log,
+		keyPair:      keyPair,
+		externalKeys: externalKeys,
 	})
 }
 
@@ -33,38 +72,371 @@ func (s *serverAPI) CreateKeyPair(
 	ctx context.Context,
 	request *tmsv1.CreateKeyPairRequest,
 ) (*tmsv1.KeyPair, error) {
-	err := s.operator.GenerateKeyPair(
+	userId, err := auth.ResolveUser(ctx, request.GetUserId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	algorithm, err := crypto.ParseAlgorithm(
+		request.GetAlgorithm(),
+		int(request.GetKeySize()),
+		request.GetCurve(),
+	)
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	scheme, err := crypto.ParseScheme(request.GetScheme())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	key, err := s.keyPair.CreateKeyPair(
 		ctx,
-		request.GetUserId(),
+		userId,
 		request.GetKeyLabel(),
+		algorithm,
+		scheme,
+		request.GetPreActive(),
 	)
 
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, grpcerr.Status(s.log, err)
 	}
 
-	return &tmsv1.KeyPair{
-		UserId:   request.GetUserId(),
-		KeyLabel: request.GetKeyLabel(),
-	}, nil
+	return keyPairResponse(userId, key), nil
 }
 
 func (s *serverAPI) DeleteKeyPair(
 	ctx context.Context,
 	request *tmsv1.GetKeyPairRequest,
 ) (*tmsv1.KeyPair, error) {
-	err := s.operator.DeleteKeyPair(
+	userId, err := auth.ResolveUser(ctx, request.GetUserId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	key, err := s.keyPair.DeleteKeyPair(
+		ctx,
+		userId,
+		request.GetKeyLabel(),
+	)
+
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	return keyPairResponse(userId, key), nil
+}
+
+func (s *serverAPI) CancelKeyDeletion(
+	ctx context.Context,
+	request *tmsv1.GetKeyPairRequest,
+) (*tmsv1.KeyPair, error) {
+	userId, err := auth.ResolveUser(ctx, request.GetUserId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	key, err := s.keyPair.CancelKeyDeletion(
+		ctx,
+		userId,
+		request.GetKeyLabel(),
+	)
+
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	return keyPairResponse(userId, key), nil
+}
+
+func (s *serverAPI) RotateKey(
+	ctx context.Context,
+	request *tmsv1.GetKeyPairRequest,
+) (*tmsv1.KeyPair, error) {
+	userId, err := auth.ResolveUser(ctx, request.GetUserId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	key, err := s.keyPair.RotateKey(
+		ctx,
+		userId,
+		request.GetKeyLabel(),
+	)
+
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	return keyPairResponse(userId, key), nil
+}
+
+func (s *serverAPI) ActivateKey(
+	ctx context.Context,
+	request *tmsv1.ChangeKeyStateRequest,
+) (*tmsv1.KeyPair, error) {
+	userId, err := auth.ResolveUser(ctx, request.GetUserId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	key, err := s.keyPair.ActivateKey(ctx, userId, request.GetKeyLabel(), request.GetReason())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	return keyPairResponse(userId, key), nil
+}
+
+func (s *serverAPI) SuspendKey(
+	ctx context.Context,
+	request *tmsv1.ChangeKeyStateRequest,
+) (*tmsv1.KeyPair, error) {
+	userId, err := auth.ResolveUser(ctx, request.GetUserId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	key, err := s.keyPair.SuspendKey(ctx, userId, request.GetKeyLabel(), request.GetReason())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	return keyPairResponse(userId, key), nil
+}
+
+func (s *serverAPI) RevokeKey(
+	ctx context.Context,
+	request *tmsv1.ChangeKeyStateRequest,
+) (*tmsv1.KeyPair, error) {
+	userId, err := auth.ResolveUser(ctx, request.GetUserId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	var compromisedAt time.Time
+	if request.GetCompromisedAt() != nil {
+		compromisedAt = request.GetCompromisedAt().AsTime()
+	}
+
+	key, err := s.keyPair.RevokeKey(ctx, userId, request.GetKeyLabel(), request.GetReason(), compromisedAt)
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	return keyPairResponse(userId, key), nil
+}
+
+func (s *serverAPI) DestroyKey(
+	ctx context.Context,
+	request *tmsv1.ChangeKeyStateRequest,
+) (*tmsv1.KeyPair, error) {
+	userId, err := auth.ResolveUser(ctx, request.GetUserId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	key, err := s.keyPair.DestroyKey(ctx, userId, request.GetKeyLabel(), request.GetReason())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	return keyPairResponse(userId, key), nil
+}
+
+func (s *serverAPI) GetPublicKey(
+	ctx context.Context,
+	request *tmsv1.GetPublicKeyRequest,
+) (*tmsv1.PublicKey, error) {
+	userId, err := auth.ResolveUser(ctx, request.GetUserId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	publicKey, err := s.keyPair.PublicKey(
 		ctx,
-		request.GetUserId(),
+		userId,
 		request.GetKeyLabel(),
+		int(request.GetVersion()),
 	)
 
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, grpcerr.Status(s.log, err)
 	}
 
-	return &tmsv1.KeyPair{
-		UserId:   request.GetUserId(),
-		KeyLabel: "Deleted.",
+	return publicKeyResponse(publicKey), nil
+}
+
+func (s *serverAPI) ListPublicKeys(
+	ctx context.Context,
+	request *tmsv1.ListPublicKeysRequest,
+) (*tmsv1.PublicKeySet, error) {
+	userId, err := auth.ResolveUser(ctx, request.GetUserId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	publicKeys, jwks, err := s.keyPair.PublicKeySet(ctx, userId)
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	response := &tmsv1.PublicKeySet{Jwks: jwks}
+	for _, publicKey := range publicKeys {
+		response.Keys = append(response.Keys, publicKeyResponse(publicKey))
+	}
+
+	return response, nil
+}
+
+func (s *serverAPI) GetWrappingKey(
+	ctx context.Context,
+	request *tmsv1.GetWrappingKeyRequest,
+) (*tmsv1.WrappingKey, error) {
+	if _, err := auth.ResolveUser(ctx, request.GetUserId()); err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	key, err := s.keyPair.WrappingKey(ctx)
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	return &tmsv1.WrappingKey{
+		Algorithm:   key.Algorithm,
+		Scheme:      key.Scheme,
+		Pem:         key.PEM,
+		Fingerprint: key.Fingerprint,
 	}, nil
 }
+
+func (s *serverAPI) ImportKeyPair(
+	ctx context.Context,
+	request *tmsv1.ImportKeyPairRequest,
+) (*tmsv1.KeyPair, error) {
+	userId, err := auth.ResolveUser(ctx, request.GetUserId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	scheme, err := crypto.ParseScheme(request.GetScheme())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	key, err := s.keyPair.ImportKeyPair(
+		ctx,
+		userId,
+		request.GetKeyLabel(),
+		request.GetPem(),
+		request.GetWrappedKey(),
+		scheme,
+		request.GetPreActive(),
+	)
+
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	return keyPairResponse(userId, key), nil
+}
+
+func (s *serverAPI) ImportExternalKey(
+	ctx context.Context,
+	request *tmsv1.ImportExternalKeyRequest,
+) (*tmsv1.ExternalKey, error) {
+	userId, err := auth.ResolveUser(ctx, request.GetUserId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	key, err := s.externalKeys.ImportExternalKey(
+		ctx,
+		userId,
+		request.GetKeyLabel(),
+		request.GetPem(),
+	)
+
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	return externalKeyResponse(key), nil
+}
+
+func (s *serverAPI) DeleteExternalKey(
+	ctx context.Context,
+	request *tmsv1.GetKeyPairRequest,
+) (*tmsv1.ExternalKey, error) {
+	userId, err := auth.ResolveUser(ctx, request.GetUserId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	key, err := s.externalKeys.DeleteExternalKey(
+		ctx,
+		userId,
+		request.GetKeyLabel(),
+	)
+
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	return externalKeyResponse(key), nil
+}
+
+func externalKeyResponse(key models.ExternalKey) *tmsv1.ExternalKey {
+	response := &tmsv1.ExternalKey{
+		UserId:      key.UserId,
+		KeyLabel:    key.Label,
+		Kind:        key.Kind,
+		Algorithm:   key.Algorithm,
+		Fingerprint: key.Fingerprint,
+		Subject:     key.Subject,
+		Issuer:      key.Issuer,
+	}
+	if key.Kind == models.ExternalKeyCertificate {
+		response.NotBefore = timestamppb.New(key.NotBefore)
+		response.NotAfter = timestamppb.New(key.NotAfter)
+	}
+
+	return response
+}
+
+func publicKeyResponse(publicKey models.PublicKey) *tmsv1.PublicKey {
+	return &tmsv1.PublicKey{
+		KeyLabel:    publicKey.Label,
+		Version:     int32(publicKey.Version),
+		Algorithm:   publicKey.Algorithm,
+		Scheme:      publicKey.Scheme,
+		State:       publicKey.State,
+		Pem:         publicKey.PEM,
+		Der:         publicKey.DER,
+		Jwk:         publicKey.JWK,
+		Fingerprint: publicKey.Fingerprint,
+	}
+}
+
+func keyPairResponse(userId string, key models.Key) *tmsv1.KeyPair {
+	response := &tmsv1.KeyPair{
+		UserId:      userId,
+		KeyLabel:    key.Label,
+		Algorithm:   key.Algorithm,
+		Scheme:      key.Scheme,
+		Version:     int32(key.CurrentVersion()),
+		State:       key.CurrentState(),
+		StateReason: key.StateReason,
+		Provenance:  key.CurrentProvenance(),
+	}
+	if !key.StateChangedAt.IsZero() {
+		response.StateChangedAt = timestamppb.New(key.StateChangedAt)
+	}
+	if key.Deletion != nil {
+		response.DestroyAfter = timestamppb.New(key.Deletion.DestroyAfter)
+	}
+
+	return response
+}
@@ -2,12 +2,16 @@ package signature_issuer
 
 import (
 	"context"
+	"encoding/hex"
 	tmsv1 "github.com/alexprishmont/masters-protos/gen/go/trustmanagement"
 	"golang.org/x/exp/slog"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
+	"io"
+	"tms/internal/domain/errs"
 	"tms/internal/domain/models"
+	"tms/internal/grpc/grpcerr"
+	"tms/internal/services/auth"
+	"tms/internal/services/crypto"
 )
 
 type serverAPI struct {
@@ -22,6 +26,7 @@ type IssuerService interface {
 		keyLabel string,
 		userId string,
 		documentId string,
+		scheme crypto.Scheme,
 	) (models.Signature, error)
 	VerifySignature(
 		ctx context.Context,
@@ -29,6 +34,50 @@ type IssuerService interface {
 		documentId string,
 		keyLabel string,
 		userId string,
+		scheme crypto.Scheme,
+	) (models.Signature, error)
+	SignReader(
+		ctx context.Context,
+		keyLabel string,
+		userId string,
+		scheme crypto.Scheme,
+		r io.Reader,
+	) (models.PayloadSignature, error)
+	SignPayload(
+		ctx context.Context,
+		keyLabel string,
+		userId string,
+		payload []byte,
+		scheme crypto.Scheme,
+		anchor bool,
+	) (models.PayloadSignature, error)
+	SignDigest(
+		ctx context.Context,
+		keyLabel string,
+		userId string,
+		digest []byte,
+		scheme crypto.Scheme,
+		anchor bool,
+	) (models.PayloadSignature, error)
+	VerifyPayload(
+		ctx context.Context,
+		signature string,
+		payload []byte,
+		keyLabel string,
+		userId string,
+		scheme crypto.Scheme,
+		keyVersion int,
+		anchored bool,
+	) (models.Signature, error)
+	VerifyDigest(
+		ctx context.Context,
+		signature string,
+		digest []byte,
+		keyLabel string,
+		userId string,
+		scheme crypto.Scheme,
+		keyVersion int,
+		anchored bool,
 	) (models.Signature, error)
 }
 
@@ -47,22 +96,36 @@ func (s *serverAPI) Sign(
 	ctx context.Context,
 	request *tmsv1.SignRequest,
 ) (*tmsv1.SignResponse, error) {
+	userId, err := auth.ResolveUser(ctx, request.GetUserId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	scheme, err := crypto.ParseScheme(request.GetScheme())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
 	signature, err := s.issuerService.SignData(
 		ctx,
 		request.GetKeyLabel(),
-		request.GetUserId(),
+		userId,
 		request.GetDocumentId(),
+		scheme,
 	)
 
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, grpcerr.Status(s.log, err)
 	}
 
 	return &tmsv1.SignResponse{
-		Valid:      signature.Valid,
-		Signature:  signature.Signature,
-		DocumentId: request.GetDocumentId(),
-		UserId:     request.GetUserId(),
+		Valid:              signature.Valid,
+		Signature:          signature.Signature,
+		DocumentId:         request.GetDocumentId(),
+		UserId:             userId,
+		Scheme:             signature.Scheme,
+		KeyState:           signature.KeyState,
+		PredatesRevocation: signature.PredatesRevocation,
 	}, nil
 }
 
@@ -70,22 +133,254 @@ func (s *serverAPI) ValidateSignature(
 	ctx context.Context,
 	request *tmsv1.ValidateSignatureRequest,
 ) (*tmsv1.SignResponse, error) {
+	userId, err := auth.ResolveUser(ctx, request.GetUserId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	scheme, err := crypto.ParseScheme(request.GetScheme())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
 	signature, err := s.issuerService.VerifySignature(
 		ctx,
 		request.GetSignature(),
 		request.GetDocumentId(),
 		request.GetKeyLabel(),
-		request.GetUserId(),
+		userId,
+		scheme,
 	)
 
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, grpcerr.Status(s.log, err)
 	}
 
 	return &tmsv1.SignResponse{
-		Valid:      signature.Valid,
-		Signature:  signature.Signature,
-		DocumentId: request.GetDocumentId(),
-		UserId:     request.GetUserId(),
+		Valid:              signature.Valid,
+		Signature:          signature.Signature,
+		DocumentId:         request.GetDocumentId(),
+		UserId:             userId,
+		Scheme:             signature.Scheme,
+		KeyState:           signature.KeyState,
+		PredatesRevocation: signature.PredatesRevocation,
 	}, nil
 }
+
+func (s *serverAPI) SignPayload(
+	ctx context.Context,
+	request *tmsv1.SignPayloadRequest,
+) (*tmsv1.PayloadSignResponse, error) {
+	userId, err := auth.ResolveUser(ctx, request.GetUserId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	scheme, err := crypto.ParseScheme(request.GetScheme())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	signature, err := s.issuerService.SignPayload(
+		ctx,
+		request.GetKeyLabel(),
+		userId,
+		request.GetPayload(),
+		scheme,
+		request.GetAnchor(),
+	)
+
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	return payloadSignResponse(userId, signature), nil
+}
+
+func (s *serverAPI) SignDigest(
+	ctx context.Context,
+	request *tmsv1.SignDigestRequest,
+) (*tmsv1.PayloadSignResponse, error) {
+	userId, err := auth.ResolveUser(ctx, request.GetUserId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	scheme, err := crypto.ParseScheme(request.GetScheme())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	signature, err := s.issuerService.SignDigest(
+		ctx,
+		request.GetKeyLabel(),
+		userId,
+		request.GetDigest(),
+		scheme,
+		request.GetAnchor(),
+	)
+
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	return payloadSignResponse(userId, signature), nil
+}
+
+func (s *serverAPI) VerifyPayload(
+	ctx context.Context,
+	request *tmsv1.VerifyPayloadRequest,
+) (*tmsv1.VerifyPayloadResponse, error) {
+	userId, err := auth.ResolveUser(ctx, request.GetUserId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	scheme, err := crypto.ParseScheme(request.GetScheme())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	signature, err := s.issuerService.VerifyPayload(
+		ctx,
+		request.GetSignature(),
+		request.GetPayload(),
+		request.GetKeyLabel(),
+		userId,
+		scheme,
+		int(request.GetKeyVersion()),
+		request.GetAnchored(),
+	)
+
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	return verifyPayloadResponse(userId, signature), nil
+}
+
+func (s *serverAPI) VerifyDigest(
+	ctx context.Context,
+	request *tmsv1.VerifyDigestRequest,
+) (*tmsv1.VerifyPayloadResponse, error) {
+	userId, err := auth.ResolveUser(ctx, request.GetUserId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	scheme, err := crypto.ParseScheme(request.GetScheme())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	signature, err := s.issuerService.VerifyDigest(
+		ctx,
+		request.GetSignature(),
+		request.GetDigest(),
+		request.GetKeyLabel(),
+		userId,
+		scheme,
+		int(request.GetKeyVersion()),
+		request.GetAnchored(),
+	)
+
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
+	return verifyPayloadResponse(userId, signature), nil
+}
+
+func payloadSignResponse(userId string, signature models.PayloadSignature) *tmsv1.PayloadSignResponse {
+	return &tmsv1.PayloadSignResponse{
+		Signature:  signature.Signature,
+		UserId:     userId,
+		Scheme:     signature.Scheme,
+		KeyLabel:   signature.KeyLabel,
+		KeyVersion: int32(signature.KeyVersion),
+		Digest:     hex.EncodeToString(signature.Digest),
+		AnchorId:   signature.AnchorId,
+	}
+}
+
+func verifyPayloadResponse(userId string, signature models.Signature) *tmsv1.VerifyPayloadResponse {
+	return &tmsv1.VerifyPayloadResponse{
+		Valid:              signature.Valid,
+		Signature:          signature.Signature,
+		UserId:             userId,
+		Scheme:             signature.Scheme,
+		KeyState:           signature.KeyState,
+		PredatesRevocation: signature.PredatesRevocation,
+	}
+}
+
+// SignStream signs content uploaded in chunks. The first message carries
+// the header and no content; every later one a chunk. The signature is
+// returned once the client closes its side.
+func (s *serverAPI) SignStream(stream tmsv1.SignatureIssuerService_SignStreamServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	header := first.GetHeader()
+	if header == nil {
+		return grpcerr.Status(s.log, errs.InvalidField("header", "must be sent in the first message"))
+	}
+
+	userId, err := auth.ResolveUser(stream.Context(), header.GetUserId())
+	if err != nil {
+		return grpcerr.Status(s.log, err)
+	}
+
+	scheme, err := crypto.ParseScheme(header.GetScheme())
+	if err != nil {
+		return grpcerr.Status(s.log, err)
+	}
+
+	signature, err := s.issuerService.SignReader(
+		stream.Context(),
+		header.GetKeyLabel(),
+		userId,
+		scheme,
+		&chunkReader{stream: stream, chunk: first.GetChunk()},
+	)
+
+	if err != nil {
+		return grpcerr.Status(s.log, err)
+	}
+
+	return stream.SendAndClose(&tmsv1.SignStreamResponse{
+		Signature:  signature.Signature,
+		Scheme:     signature.Scheme,
+		KeyLabel:   signature.KeyLabel,
+		KeyVersion: int32(signature.KeyVersion),
+		Digest:     hex.EncodeToString(signature.Digest),
+		Size:       signature.Size,
+	})
+}
+
+// chunkReader reads the content chunks of a SignStream call as they
+// arrive, holding one chunk at a time.
+type chunkReader struct {
+	stream tmsv1.SignatureIssuerService_SignStreamServer
+	chunk  []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		request, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		if request.GetHeader() != nil {
+			return 0, errs.InvalidField("header", "must only be sent in the first message")
+		}
+		r.chunk = request.GetChunk()
+	}
+
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+
+	return n, nil
+}
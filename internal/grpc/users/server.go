@@ -5,9 +5,11 @@ import (
 	tmsv1 "github.com/alexprishmont/masters-protos/gen/go/trustmanagement"
 	"golang.org/x/exp/slog"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
+	"tms/internal/domain/errs"
 	"tms/internal/domain/models"
+	"tms/internal/grpc/grpcerr"
+	"tms/internal/services/auth"
+	"tms/internal/storage"
 )
 
 type serverAPI struct {
@@ -37,15 +39,20 @@ func (s *serverAPI) UpdateUser(
 	ctx context.Context,
 	request *tmsv1.UpdateUserRequest,
 ) (*tmsv1.User, error) {
+	id, err := auth.ResolveUser(ctx, request.GetId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
 	user, err := s.usersService.UpdateUser(
 		ctx,
-		request.GetId(),
+		id,
 		request.GetName(),
 		request.GetEmail(),
 	)
 
 	if err != nil {
-		return nil, status.Error(codes.Internal, "User update process failed.")
+		return nil, grpcerr.Status(s.log, err)
 	}
 
 	return &tmsv1.User{
@@ -59,21 +66,26 @@ func (s *serverAPI) DeleteUser(
 	ctx context.Context,
 	request *tmsv1.GetUserRequest,
 ) (*tmsv1.User, error) {
+	id, err := auth.ResolveUser(ctx, request.GetId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
 	success, err := s.usersService.DeleteUser(
 		ctx,
-		request.GetId(),
+		id,
 	)
 
 	if err != nil {
-		return nil, status.Error(codes.Internal, "User delete process failed.")
+		return nil, grpcerr.Status(s.log, err)
 	}
 
 	if success == false {
-		return nil, status.Error(codes.Internal, "User delete process has failed with status - FALSE")
+		return nil, grpcerr.Status(s.log, errs.NotFound(storage.ResourceUser, id))
 	}
 
 	return &tmsv1.User{
-		Id:    request.GetId(),
+		Id:    id,
 		Name:  "Removed.",
 		Email: "Removed.",
 	}, nil
@@ -83,13 +95,18 @@ func (s *serverAPI) GetUser(
 	ctx context.Context,
 	request *tmsv1.GetUserRequest,
 ) (*tmsv1.User, error) {
+	id, err := auth.ResolveUser(ctx, request.GetId())
+	if err != nil {
+		return nil, grpcerr.Status(s.log, err)
+	}
+
 	user, err := s.usersService.User(
 		ctx,
-		request.GetId(),
+		id,
 	)
 
 	if err != nil {
-		return nil, status.Error(codes.Internal, "User get process failed.")
+		return nil, grpcerr.Status(s.log, err)
 	}
 
 	return &tmsv1.User{
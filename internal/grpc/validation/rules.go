@@ -0,0 +1,161 @@
+package validation
+
+import (
+	tmsv1 "github.com/alexprishmont/masters-protos/gen/go/trustmanagement"
+	"tms/internal/lib/validator"
+	"tms/internal/services/crypto"
+)
+
+func documentRules(limits Limits) []entry {
+	return []entry{
+		bind(func(r *tmsv1.CreateRequest, v *validator.Validator) {
+			v.Field("title", r.GetTitle()).Required().MaxLength(limits.MaxTitleLength).Printable()
+			v.Field("content", r.GetContent()).MaxBytes(limits.MaxContentBytes)
+			userID(v, "owner_id", r.GetOwnerId())
+		}),
+		bind(func(r *tmsv1.GetRequest, v *validator.Validator) {
+			v.Field("id", r.GetId()).Required().ObjectID()
+		}),
+		bind(func(r *tmsv1.UpdateRequest, v *validator.Validator) {
+			v.Field("id", r.GetId()).Required().ObjectID()
+			v.Field("title", r.GetTitle()).Required().MaxLength(limits.MaxTitleLength).Printable()
+			v.Field("content", r.GetContent()).MaxBytes(limits.MaxContentBytes)
+			userID(v, "owner_id", r.GetOwnerId())
+		}),
+	}
+}
+
+func keyRules() []entry {
+	return []entry{
+		bind(func(r *tmsv1.CreateKeyPairRequest, v *validator.Validator) {
+			userID(v, "user_id", r.GetUserId())
+			label(v, "key_label", r.GetKeyLabel())
+			if _, err := crypto.ParseAlgorithm(r.GetAlgorithm(), int(r.GetKeySize()), r.GetCurve()); err != nil {
+				v.Error(err)
+			}
+			scheme(v, r.GetScheme())
+		}),
+		bind(func(r *tmsv1.GetKeyPairRequest, v *validator.Validator) {
+			userID(v, "user_id", r.GetUserId())
+			label(v, "key_label", r.GetKeyLabel())
+		}),
+		bind(func(r *tmsv1.ImportExternalKeyRequest, v *validator.Validator) {
+			userID(v, "user_id", r.GetUserId())
+			label(v, "key_label", r.GetKeyLabel())
+			v.Field("pem", r.GetPem()).Required().MaxBytes(maxPEMBytes)
+		}),
+		bind(func(r *tmsv1.GetWrappingKeyRequest, v *validator.Validator) {
+			userID(v, "user_id", r.GetUserId())
+		}),
+		bind(func(r *tmsv1.ImportKeyPairRequest, v *validator.Validator) {
+			userID(v, "user_id", r.GetUserId())
+			label(v, "key_label", r.GetKeyLabel())
+			v.Field("pem", r.GetPem()).Required().MaxBytes(maxPEMBytes)
+			v.Field("wrapped_key", string(r.GetWrappedKey())).Required().MaxBytes(maxWrappedKeyBytes)
+			scheme(v, r.GetScheme())
+		}),
+		bind(func(r *tmsv1.GetPublicKeyRequest, v *validator.Validator) {
+			userID(v, "user_id", r.GetUserId())
+			label(v, "key_label", r.GetKeyLabel())
+			v.Check(r.GetVersion() >= 0, "version", "must not be negative")
+		}),
+		bind(func(r *tmsv1.ListPublicKeysRequest, v *validator.Validator) {
+			userID(v, "user_id", r.GetUserId())
+		}),
+		bind(func(r *tmsv1.ChangeKeyStateRequest, v *validator.Validator) {
+			userID(v, "user_id", r.GetUserId())
+			label(v, "key_label", r.GetKeyLabel())
+			v.Field("reason", r.GetReason()).Optional().MaxLength(maxReasonLength).Printable()
+			if at := r.GetCompromisedAt(); at != nil {
+				v.Check(at.IsValid(), "compromised_at", "must be a valid timestamp")
+			}
+		}),
+	}
+}
+
+func signatureRules(limits Limits) []entry {
+	return []entry{
+		bind(func(r *tmsv1.SignRequest, v *validator.Validator) {
+			userID(v, "user_id", r.GetUserId())
+			label(v, "key_label", r.GetKeyLabel())
+			v.Field("document_id", r.GetDocumentId()).Required().ObjectID()
+			scheme(v, r.GetScheme())
+		}),
+		bind(func(r *tmsv1.ValidateSignatureRequest, v *validator.Validator) {
+			userID(v, "user_id", r.GetUserId())
+			label(v, "key_label", r.GetKeyLabel())
+			v.Field("document_id", r.GetDocumentId()).Required().ObjectID()
+			v.Field("signature", r.GetSignature()).Required().MaxLength(maxSignatureLength).Base64()
+			scheme(v, r.GetScheme())
+		}),
+		bind(func(r *tmsv1.SignPayloadRequest, v *validator.Validator) {
+			userID(v, "user_id", r.GetUserId())
+			label(v, "key_label", r.GetKeyLabel())
+			v.Field("payload", string(r.GetPayload())).MaxBytes(limits.MaxContentBytes)
+			scheme(v, r.GetScheme())
+		}),
+		bind(func(r *tmsv1.SignDigestRequest, v *validator.Validator) {
+			userID(v, "user_id", r.GetUserId())
+			label(v, "key_label", r.GetKeyLabel())
+			v.Field("digest", string(r.GetDigest())).Required().MaxBytes(maxDigestBytes)
+			scheme(v, r.GetScheme())
+		}),
+		bind(func(r *tmsv1.VerifyPayloadRequest, v *validator.Validator) {
+			userID(v, "user_id", r.GetUserId())
+			label(v, "key_label", r.GetKeyLabel())
+			v.Field("payload", string(r.GetPayload())).MaxBytes(limits.MaxContentBytes)
+			v.Field("signature", r.GetSignature()).Required().MaxLength(maxSignatureLength).Base64()
+			scheme(v, r.GetScheme())
+			v.Check(r.GetKeyVersion() >= 0, "key_version", "must not be negative")
+		}),
+		bind(func(r *tmsv1.VerifyDigestRequest, v *validator.Validator) {
+			userID(v, "user_id", r.GetUserId())
+			label(v, "key_label", r.GetKeyLabel())
+			v.Field("digest", string(r.GetDigest())).Required().MaxBytes(maxDigestBytes)
+			v.Field("signature", r.GetSignature()).Required().MaxLength(maxSignatureLength).Base64()
+			scheme(v, r.GetScheme())
+			v.Check(r.GetKeyVersion() >= 0, "key_version", "must not be negative")
+		}),
+		// Only each message is checked here; that the header comes first
+		// and only once is up to the handler.
+		bind(func(r *tmsv1.SignStreamRequest, v *validator.Validator) {
+			if header := r.GetHeader(); header != nil {
+				userID(v, "header.user_id", header.GetUserId())
+				label(v, "header.key_label", header.GetKeyLabel())
+				scheme(v, header.GetScheme())
+			}
+			v.Field("chunk", string(r.GetChunk())).MaxBytes(maxChunkBytes)
+		}),
+	}
+}
+
+func cipherRules(limits Limits) []entry {
+	return []entry{
+		bind(func(r *tmsv1.EncryptRequest, v *validator.Validator) {
+			userID(v, "user_id", r.GetUserId())
+			label(v, "key_label", r.GetKeyLabel())
+			v.Field("plaintext", string(r.GetPlaintext())).MaxBytes(limits.MaxContentBytes)
+			v.Field("associated_data", string(r.GetAssociatedData())).MaxBytes(maxAssociatedDataBytes)
+		}),
+		bind(func(r *tmsv1.DecryptRequest, v *validator.Validator) {
+			userID(v, "user_id", r.GetUserId())
+			label(v, "key_label", r.GetKeyLabel())
+			v.Check(r.GetKeyVersion() >= 0, "key_version", "must not be negative")
+			v.Field("ciphertext", string(r.GetCiphertext())).Required().MaxBytes(limits.MaxContentBytes + maxCiphertextOverhead)
+			v.Field("associated_data", string(r.GetAssociatedData())).MaxBytes(maxAssociatedDataBytes)
+		}),
+	}
+}
+
+func userRules() []entry {
+	return []entry{
+		bind(func(r *tmsv1.UpdateUserRequest, v *validator.Validator) {
+			userID(v, "id", r.GetId())
+			v.Field("name", r.GetName()).Required().MaxLength(maxNameLength).Printable()
+			v.Field("email", r.GetEmail()).Required().MaxLength(maxEmailLength).Email()
+		}),
+		bind(func(r *tmsv1.GetUserRequest, v *validator.Validator) {
+			userID(v, "id", r.GetId())
+		}),
+	}
+}
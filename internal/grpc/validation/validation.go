@@ -0,0 +1,116 @@
+// Package validation holds the declarative rules every request message is
+// checked against before it reaches a handler.
+package validation
+
+import (
+	"reflect"
+	"regexp"
+	"tms/internal/lib/validator"
+	"tms/internal/services/crypto"
+)
+
+const (
+	maxUserIDLength    = 128
+	maxKeyLabelLength  = 64
+	maxNameLength      = 128
+	maxEmailLength     = 254
+	maxSignatureLength = 8192
+	maxReasonLength    = 512
+	maxPEMBytes        = 16384
+	// maxWrappedKeyBytes fits an RSA 4096 private key wrapped for a wrapping
+	// key of up to 8192 bits.
+	maxWrappedKeyBytes = 4096
+	// maxCiphertextOverhead covers what encryption adds to the plaintext:
+	// an RSA 4096 encrypted key or an ephemeral P-384 point, the nonce and
+	// the GCM tag.
+	maxCiphertextOverhead  = 1024
+	maxAssociatedDataBytes = 4096
+	// maxChunkBytes keeps streamed chunks well below the default 4 MiB gRPC
+	// message limit.
+	maxChunkBytes = 1 << 20
+	// maxDigestBytes is the size of a SHA-512 digest. The exact size is
+	// checked against the scheme when signing.
+	maxDigestBytes = 64
+)
+
+// keyLabel is the charset accepted for HSM key labels.
+var keyLabel = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+type Limits struct {
+	MaxContentBytes int
+	MaxTitleLength  int
+}
+
+type rule func(request any, v *validator.Validator)
+
+// Rules maps request message types onto their validation rules.
+type Rules struct {
+	rules map[reflect.Type]rule
+}
+
+func New(limits Limits) *Rules {
+	r := &Rules{rules: make(map[reflect.Type]rule)}
+
+	register(r, documentRules(limits)...)
+	register(r, keyRules()...)
+	register(r, signatureRules(limits)...)
+	register(r, cipherRules(limits)...)
+	register(r, userRules()...)
+
+	return r
+}
+
+// Validate checks request against its rules. Messages without rules pass.
+func (r *Rules) Validate(request any) error {
+	check, ok := r.rules[reflect.TypeOf(request)]
+	if !ok {
+		return nil
+	}
+
+	v := validator.New()
+	check(request, v)
+
+	return v.Err()
+}
+
+type entry struct {
+	typ   reflect.Type
+	check rule
+}
+
+// bind binds a rule to the request type T.
+func bind[T any](check func(request T, v *validator.Validator)) entry {
+	var zero T
+
+	return entry{
+		typ: reflect.TypeOf(zero),
+		check: func(request any, v *validator.Validator) {
+			check(request.(T), v)
+		},
+	}
+}
+
+func register(r *Rules, entries ...entry) {
+	for _, e := range entries {
+		r.rules[e.typ] = e.check
+	}
+}
+
+// userID checks a user id. An empty id means "the caller" and is allowed.
+func userID(v *validator.Validator, field string, value string) {
+	v.Field(field, value).Optional().MaxLength(maxUserIDLength).Printable()
+}
+
+func label(v *validator.Validator, field string, value string) {
+	v.Field(field, value).
+		Required().
+		MaxLength(maxKeyLabelLength).
+		Matches(keyLabel, "must start with a letter or digit and contain only letters, digits, '.', '_' and '-'")
+}
+
+// scheme accepts an empty scheme, meaning the key's default.
+func scheme(v *validator.Validator, value string) {
+	if _, err := crypto.ParseScheme(value); err != nil {
+		v.Error(err)
+	}
+}
@@ -0,0 +1,242 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader holds a certificate key pair and a CA bundle loaded from disk and
+// swaps them in place when the files are rotated. Either part is optional:
+// a server without client authentication has no CA, a client without a
+// client certificate has no key pair.
+type Reloader struct {
+	log      *slog.Logger
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu    sync.RWMutex
+	cert  *tls.Certificate
+	pool  *x509.CertPool
+	stamp map[string]fileStamp
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewReloader loads the files once and fails if any of them is unusable.
+func NewReloader(log *slog.Logger, certFile, keyFile, caFile string) (*Reloader, error) {
+	const op = "lib.certs.NewReloader"
+
+	r := &Reloader{
+		log:      log,
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+	}
+
+	if err := r.reload(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return r, nil
+}
+
+// Watch polls the files every interval and reloads them when one changes.
+// A failed reload keeps the previous material in use.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	const op = "lib.certs.Watch"
+
+	log := r.log.With(slog.String("op", op))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !r.changed() {
+			continue
+		}
+
+		if err := r.reload(); err != nil {
+			log.Error("failed to reload certificates, keeping the previous ones", slog.Any("error", err))
+			continue
+		}
+
+		log.Info("certificates reloaded", slog.String("cert", r.certFile), slog.String("ca", r.caFile))
+	}
+}
+
+// Certificate returns the current key pair, or nil when none is configured.
+func (r *Reloader) Certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert
+}
+
+// CertPool returns the current CA bundle, or nil when none is configured.
+func (r *Reloader) CertPool() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.pool
+}
+
+// ServerConfig returns a TLS configuration for a listener that always serves
+// the current certificate and verifies clients against the current CA bundle.
+func (r *Reloader) ServerConfig(clientAuth tls.ClientAuthType) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert := r.Certificate()
+			if cert == nil {
+				return nil, errors.New("no server certificate loaded")
+			}
+
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientAuth:   clientAuth,
+				ClientCAs:    r.CertPool(),
+				NextProtos:   []string{"h2"},
+			}, nil
+		},
+	}
+}
+
+// ClientConfig returns a TLS configuration for an outbound connection that
+// only trusts servers chaining to the pinned CA bundle and presents the
+// current client certificate when one is configured.
+func (r *Reloader) ClientConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert := r.Certificate(); cert != nil {
+				return cert, nil
+			}
+
+			return &tls.Certificate{}, nil
+		},
+		// The chain is verified in VerifyConnection against the pinned CA as it
+		// is loaded right now; the built-in verification would keep using the
+		// pool that existed when the connection was dialed.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return r.verifyServer(state)
+		},
+	}
+}
+
+func (r *Reloader) verifyServer(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("server presented no certificate")
+	}
+
+	pool := r.CertPool()
+	if pool == nil {
+		return errors.New("no CA bundle loaded to verify the server")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       state.ServerName,
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+
+	return err
+}
+
+func (r *Reloader) reload() error {
+	var cert *tls.Certificate
+	var pool *x509.CertPool
+
+	if r.certFile != "" {
+		pair, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load key pair: %w", err)
+		}
+		cert = &pair
+	}
+
+	if r.caFile != "" {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in CA bundle %s", r.caFile)
+		}
+	}
+
+	stamp := r.stat()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cert = cert
+	r.pool = pool
+	r.stamp = stamp
+
+	return nil
+}
+
+func (r *Reloader) changed() bool {
+	current := r.stat()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for file, stamp := range current {
+		if r.stamp[file] != stamp {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stat follows symlinks, so a rotation that swaps a mounted secret's
+// symlink target is seen as a change as well.
+func (r *Reloader) stat() map[string]fileStamp {
+	stamps := make(map[string]fileStamp, 3)
+
+	for _, file := range []string{r.certFile, r.keyFile, r.caFile} {
+		if file == "" {
+			continue
+		}
+
+		info, err := os.Stat(file)
+		if err != nil {
+			stamps[file] = fileStamp{}
+			continue
+		}
+
+		stamps[file] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+	}
+
+	return stamps
+}
@@ -0,0 +1,168 @@
+package jwk
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// Key is a single JSON Web Key (RFC 7517). Only the members needed for
+// RSA, EC, OKP (RFC 8037) and symmetric keys are modelled.
+type Key struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// EC and OKP
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+
+	// Symmetric
+	K string `json:"k,omitempty"`
+}
+
+// Set is a JWK Set document.
+type Set struct {
+	Keys []Key `json:"keys"`
+}
+
+// ParseSet decodes a JWK Set document.
+func ParseSet(data []byte) (Set, error) {
+	var set Set
+
+	if err := json.Unmarshal(data, &set); err != nil {
+		return Set{}, fmt.Errorf("invalid JWK set: %w", err)
+	}
+
+	return set, nil
+}
+
+// FromPublicKey encodes an RSA, ECDSA or Ed25519 public key.
+func FromPublicKey(publicKey crypto.PublicKey) (Key, error) {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return Key{
+			KeyType: "RSA",
+			N:       encodeInt(key.N, 0),
+			E:       encodeInt(big.NewInt(int64(key.E)), 0),
+		}, nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return Key{
+			KeyType: "EC",
+			Curve:   key.Curve.Params().Name,
+			X:       encodeInt(key.X, size),
+			Y:       encodeInt(key.Y, size),
+		}, nil
+	case ed25519.PublicKey:
+		return Key{
+			KeyType: "OKP",
+			Curve:   "Ed25519",
+			X:       base64.RawURLEncoding.EncodeToString(key),
+		}, nil
+	default:
+		return Key{}, fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+}
+
+// Material returns the verification material of the key: *rsa.PublicKey,
+// *ecdsa.PublicKey, ed25519.PublicKey or a []byte secret.
+func (k Key) Material() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("kid %q: invalid modulus: %w", k.KeyID, err)
+		}
+		e, err := decodeInt(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("kid %q: invalid exponent", k.KeyID)
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve, err := curveByName(k.Curve)
+		if err != nil {
+			return nil, fmt.Errorf("kid %q: %w", k.KeyID, err)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("kid %q: invalid x: %w", k.KeyID, err)
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("kid %q: invalid y: %w", k.KeyID, err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("kid %q: point is not on curve %s", k.KeyID, k.Curve)
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Curve != "Ed25519" {
+			return nil, fmt.Errorf("kid %q: unsupported curve %q", k.KeyID, k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("kid %q: invalid x", k.KeyID)
+		}
+
+		return ed25519.PublicKey(x), nil
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil {
+			return nil, fmt.Errorf("kid %q: invalid secret: %w", k.KeyID, err)
+		}
+
+		return secret, nil
+	default:
+		return nil, fmt.Errorf("kid %q: unsupported key type %q", k.KeyID, k.KeyType)
+	}
+}
+
+// encodeInt encodes value big-endian, left-padded to size bytes.
+func encodeInt(value *big.Int, size int) string {
+	raw := value.Bytes()
+	if len(raw) < size {
+		raw = append(make([]byte, size-len(raw)), raw...)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeInt(value string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("empty value")
+	}
+
+	return new(big.Int).SetBytes(raw), nil
+}
+
+func curveByName(name string) (elliptic.Curve, error) {
+	switch name {
+	case "P-256":
+		return elliptic.P256(), nil
+	case "P-384":
+		return elliptic.P384(), nil
+	case "P-521":
+		return elliptic.P521(), nil
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", name)
+	}
+}
@@ -0,0 +1,139 @@
+// Package keywrap implements AES Key Wrap with Padding (RFC 5649), the
+// format of the PKCS#11 CKM_AES_KEY_WRAP_PAD mechanism.
+package keywrap
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// ErrUnwrap is returned for ciphertext that fails the integrity check, which
+// includes ciphertext wrapped under another key.
+var ErrUnwrap = errors.New("keywrap: integrity check failed")
+
+// alternativeIV is the constant half of the RFC 5649 initial value.
+var alternativeIV = []byte{0xa6, 0x59, 0x59, 0xa6}
+
+// Wrap wraps plaintext under kek, an AES-128, AES-192 or AES-256 key.
+func Wrap(kek []byte, plaintext []byte) ([]byte, error) {
+	if len(plaintext) == 0 {
+		return nil, errors.New("keywrap: empty plaintext")
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	padded := make([]byte, (len(plaintext)+7)/8*8)
+	copy(padded, plaintext)
+
+	var iv [8]byte
+	copy(iv[:], alternativeIV)
+	binary.BigEndian.PutUint32(iv[4:], uint32(len(plaintext)))
+
+	if len(padded) == 8 {
+		out := make([]byte, 16)
+		copy(out, iv[:])
+		copy(out[8:], padded)
+		block.Encrypt(out, out)
+		return out, nil
+	}
+
+	return wrap(block, iv, padded), nil
+}
+
+// Unwrap recovers the plaintext wrapped under kek.
+func Unwrap(kek []byte, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < 16 || len(ciphertext)%8 != 0 {
+		return nil, errors.New("keywrap: ciphertext length must be a multiple of 8 and at least 16")
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		iv     [8]byte
+		padded []byte
+	)
+	if len(ciphertext) == 16 {
+		out := make([]byte, 16)
+		block.Decrypt(out, ciphertext)
+		copy(iv[:], out)
+		padded = out[8:]
+	} else {
+		iv, padded = unwrap(block, ciphertext)
+	}
+
+	if subtle.ConstantTimeCompare(iv[:4], alternativeIV) != 1 {
+		return nil, ErrUnwrap
+	}
+
+	length := int(binary.BigEndian.Uint32(iv[4:]))
+	if length <= len(padded)-8 || length > len(padded) {
+		return nil, ErrUnwrap
+	}
+	for _, b := range padded[length:] {
+		if b != 0 {
+			return nil, ErrUnwrap
+		}
+	}
+
+	return padded[:length], nil
+}
+
+// wrap is the RFC 3394 wrapping process W.
+func wrap(block cipher.Block, iv [8]byte, plaintext []byte) []byte {
+	n := len(plaintext) / 8
+	out := make([]byte, 8+len(plaintext))
+	copy(out[8:], plaintext)
+
+	a := iv
+	var b [16]byte
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			r := out[8*i : 8*i+8]
+			copy(b[:8], a[:])
+			copy(b[8:], r)
+			block.Encrypt(b[:], b[:])
+
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(a[:], binary.BigEndian.Uint64(b[:8])^t)
+			copy(r, b[8:])
+		}
+	}
+	copy(out, a[:])
+
+	return out
+}
+
+// unwrap is the RFC 3394 unwrapping process W⁻¹. The caller checks the
+// returned initial value.
+func unwrap(block cipher.Block, ciphertext []byte) ([8]byte, []byte) {
+	n := len(ciphertext)/8 - 1
+	out := make([]byte, 8*n)
+	copy(out, ciphertext[8:])
+
+	var a [8]byte
+	copy(a[:], ciphertext[:8])
+	var b [16]byte
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			r := out[8*(i-1) : 8*i]
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(b[:8], binary.BigEndian.Uint64(a[:])^t)
+			copy(b[8:], r)
+			block.Decrypt(b[:], b[:])
+
+			copy(a[:], b[:8])
+			copy(r, b[8:])
+		}
+	}
+
+	return a, out
+}
@@ -0,0 +1,106 @@
+package keywrap
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func decode(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// The test vectors of RFC 5649, section 6.
+func TestRFC5649(t *testing.T) {
+	kek := decode(t, "5840df6e29b02af1ab493b705bf16ea1ae8338f4dcc176a8")
+
+	tests := []struct {
+		name       string
+		key        string
+		ciphertext string
+	}{
+		{"20 bytes", "c37b7e6492584340bed12207808941155068f738", "138bdeaa9b8fa7fc61f97742e72248ee5ae6ae5360d1ae6a5f54f373fa543b6a"},
+		{"7 bytes", "466f7250617369", "afbeb0f07dfbf5419200f2ccb50bb24f"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := decode(t, tt.key)
+			want := decode(t, tt.ciphertext)
+
+			got, err := Wrap(kek, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("Wrap = %x, want %x", got, want)
+			}
+
+			unwrapped, err := Unwrap(kek, want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(unwrapped, key) {
+				t.Fatalf("Unwrap = %x, want %x", unwrapped, key)
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	kek := bytes.Repeat([]byte{0x42}, 32)
+
+	for _, size := range []int{1, 8, 9, 16, 32, 1217} {
+		key := bytes.Repeat([]byte{0x17}, size)
+
+		wrapped, err := Wrap(kek, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		unwrapped, err := Unwrap(kek, wrapped)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(unwrapped, key) {
+			t.Fatalf("%d bytes: Unwrap = %x, want %x", size, unwrapped, key)
+		}
+	}
+}
+
+func TestUnwrapRejects(t *testing.T) {
+	kek := decode(t, "5840df6e29b02af1ab493b705bf16ea1ae8338f4dcc176a8")
+	otherKEK := bytes.Repeat([]byte{0x01}, 24)
+
+	for _, ciphertext := range []string{
+		"138bdeaa9b8fa7fc61f97742e72248ee5ae6ae5360d1ae6a5f54f373fa543b6a",
+		"afbeb0f07dfbf5419200f2ccb50bb24f",
+	} {
+		wrapped := decode(t, ciphertext)
+
+		if _, err := Unwrap(otherKEK, wrapped); !errors.Is(err, ErrUnwrap) {
+			t.Fatalf("Unwrap under another KEK = %v, want ErrUnwrap", err)
+		}
+
+		for i := range wrapped {
+			tampered := bytes.Clone(wrapped)
+			tampered[i] ^= 0x01
+
+			if _, err := Unwrap(kek, tampered); !errors.Is(err, ErrUnwrap) {
+				t.Fatalf("Unwrap with byte %d flipped = %v, want ErrUnwrap", i, err)
+			}
+		}
+	}
+
+	if _, err := Unwrap(kek, make([]byte, 12)); err == nil {
+		t.Fatal("Unwrap accepted a ciphertext that is not a whole number of blocks")
+	}
+}
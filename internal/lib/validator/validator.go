@@ -0,0 +1,143 @@
+// Package validator collects field violations with a small fluent API:
+//
+//	v := validator.New()
+//	v.Field("title", title).Required().MaxLength(256)
+//	v.Field("email", email).Required().Email()
+//	return v.Err()
+//
+// Only the first failed rule of each field is reported.
+package validator
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/mail"
+	"regexp"
+	"tms/internal/domain/errs"
+	"unicode"
+	"unicode/utf8"
+)
+
+type Validator struct {
+	violations []errs.Violation
+}
+
+func New() *Validator {
+	return &Validator{}
+}
+
+// Field starts the rules for a single field.
+func (v *Validator) Field(name string, value string) *Field {
+	return &Field{validator: v, name: name, value: value}
+}
+
+// Check records a violation for name unless ok holds.
+func (v *Validator) Check(ok bool, name string, description string) {
+	if !ok {
+		v.violations = append(v.violations, errs.Violation{Field: name, Description: description})
+	}
+}
+
+// Error records the violations of an errs.InvalidArgument error produced
+// elsewhere, e.g. by a parser that validates as it goes.
+func (v *Validator) Error(err error) {
+	var e *errs.Error
+	if errors.As(err, &e) && e.Kind == errs.KindInvalidArgument && len(e.Violations) > 0 {
+		v.violations = append(v.violations, e.Violations...)
+		return
+	}
+
+	v.violations = append(v.violations, errs.Violation{Description: err.Error()})
+}
+
+// Err returns an InvalidArgument error listing every violation, or nil.
+func (v *Validator) Err() error {
+	if len(v.violations) == 0 {
+		return nil
+	}
+
+	return errs.InvalidArgument(v.violations...)
+}
+
+type Field struct {
+	validator *Validator
+	name      string
+	value     string
+	done      bool
+}
+
+// Required fails on an empty value.
+func (f *Field) Required() *Field {
+	return f.check(f.value != "", "is required")
+}
+
+// Optional skips the remaining rules when the value is empty.
+func (f *Field) Optional() *Field {
+	if f.value == "" {
+		f.done = true
+	}
+
+	return f
+}
+
+// MaxLength limits the value to n characters.
+func (f *Field) MaxLength(n int) *Field {
+	return f.check(utf8.RuneCountInString(f.value) <= n, fmt.Sprintf("must be at most %d characters", n))
+}
+
+// MaxBytes limits the encoded size of the value to n bytes.
+func (f *Field) MaxBytes(n int) *Field {
+	return f.check(len(f.value) <= n, fmt.Sprintf("must be at most %d bytes", n))
+}
+
+// Printable rejects control characters and invalid UTF-8.
+func (f *Field) Printable() *Field {
+	ok := utf8.ValidString(f.value)
+	for _, r := range f.value {
+		if !ok {
+			break
+		}
+		ok = !unicode.IsControl(r)
+	}
+
+	return f.check(ok, "must be printable text")
+}
+
+// Matches requires the value to match pattern; description explains it.
+func (f *Field) Matches(pattern *regexp.Regexp, description string) *Field {
+	return f.check(pattern.MatchString(f.value), description)
+}
+
+// ObjectID requires a MongoDB object id in hex.
+func (f *Field) ObjectID() *Field {
+	return f.check(primitive.IsValidObjectID(f.value), "must be a 24 character hex object id")
+}
+
+// Email requires a bare address such as user@example.com.
+func (f *Field) Email() *Field {
+	address, err := mail.ParseAddress(f.value)
+
+	return f.check(err == nil && address.Address == f.value, "must be a valid email address")
+}
+
+// Base64 requires standard base64 encoding.
+func (f *Field) Base64() *Field {
+	_, err := base64.StdEncoding.DecodeString(f.value)
+
+	return f.check(err == nil, "must be base64 encoded")
+}
+
+func (f *Field) check(ok bool, description string) *Field {
+	if f.done {
+		return f
+	}
+
+	if !ok {
+		f.validator.violations = append(f.validator.violations, errs.Violation{Field: f.name, Description: description})
+		f.done = true
+	}
+
+	return f
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/exp/slog"
+	"tms/internal/domain/errs"
+	"tms/internal/domain/models"
+	"tms/internal/storage"
+)
+
+var ErrUnauthenticated = errs.New(errs.KindUnauthenticated, "unauthenticated")
+
+type Authenticator struct {
+	log           *slog.Logger
+	jwtKeys       []VerificationKey
+	parser        *jwt.Parser
+	apiKeys       APIKeyProvider
+	certificates  bool
+	adminSubjects map[string]bool
+}
+
+type APIKeyProvider interface {
+	APIKey(ctx context.Context, hash string) (models.APIKey, error)
+}
+
+type Options struct {
+	// JWTKeys enables bearer token authentication when not empty.
+	JWTKeys []VerificationKey
+	// Algorithms restricts the accepted JWT "alg" values.
+	Algorithms []string
+	Issuer     string
+	Audience   string
+	// APIKeys enables API key authentication when not nil.
+	APIKeys APIKeyProvider
+	// Certificates enables authentication by verified client certificate.
+	Certificates bool
+	// AdminSubjects are certificate subjects granted the admin role.
+	AdminSubjects []string
+}
+
+type claims struct {
+	jwt.RegisteredClaims
+	Roles []string `json:"roles"`
+}
+
+func New(log *slog.Logger, opts Options) *Authenticator {
+	parserOpts := []jwt.ParserOption{
+		jwt.WithValidMethods(opts.Algorithms),
+		jwt.WithExpirationRequired(),
+	}
+	if opts.Issuer != "" {
+		parserOpts = append(parserOpts, jwt.WithIssuer(opts.Issuer))
+	}
+	if opts.Audience != "" {
+		parserOpts = append(parserOpts, jwt.WithAudience(opts.Audience))
+	}
+
+	adminSubjects := make(map[string]bool, len(opts.AdminSubjects))
+	for _, subject := range opts.AdminSubjects {
+		adminSubjects[subject] = true
+	}
+
+	return &Authenticator{
+		log:           log,
+		jwtKeys:       opts.JWTKeys,
+		parser:        jwt.NewParser(parserOpts...),
+		apiKeys:       opts.APIKeys,
+		certificates:  opts.Certificates,
+		adminSubjects: adminSubjects,
+	}
+}
+
+// AuthenticateToken verifies a bearer JWT and returns its subject.
+func (a *Authenticator) AuthenticateToken(_ context.Context, token string) (models.Principal, error) {
+	const op = "services.auth.AuthenticateToken"
+
+	if len(a.jwtKeys) == 0 {
+		return models.Principal{}, fmt.Errorf("%s: bearer tokens are not accepted: %w", op, ErrUnauthenticated)
+	}
+
+	var c claims
+
+	if _, err := a.parser.ParseWithClaims(token, &c, a.keyFunc); err != nil {
+		return models.Principal{}, fmt.Errorf("%s: %w: %w", op, ErrUnauthenticated, err)
+	}
+
+	if c.Subject == "" {
+		return models.Principal{}, fmt.Errorf("%s: token has no subject: %w", op, ErrUnauthenticated)
+	}
+
+	return models.Principal{
+		Subject: c.Subject,
+		Method:  models.AuthMethodJWT,
+		Roles:   c.Roles,
+	}, nil
+}
+
+// AuthenticateAPIKey looks the key up by its hash.
+func (a *Authenticator) AuthenticateAPIKey(ctx context.Context, key string) (models.Principal, error) {
+	const op = "services.auth.AuthenticateAPIKey"
+
+	if a.apiKeys == nil {
+		return models.Principal{}, fmt.Errorf("%s: API keys are not accepted: %w", op, ErrUnauthenticated)
+	}
+
+	hash := sha256.Sum256([]byte(key))
+
+	apiKey, err := a.apiKeys.APIKey(ctx, hex.EncodeToString(hash[:]))
+	if err != nil {
+		if errors.Is(err, storage.ErrorAPIKeyNotFound) {
+			return models.Principal{}, fmt.Errorf("%s: unknown API key: %w", op, ErrUnauthenticated)
+		}
+		return models.Principal{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if apiKey.Revoked {
+		return models.Principal{}, fmt.Errorf("%s: API key %q is revoked: %w", op, apiKey.Name, ErrUnauthenticated)
+	}
+
+	return models.Principal{
+		Subject: apiKey.UserId,
+		Method:  models.AuthMethodAPIKey,
+		Roles:   apiKey.Roles,
+	}, nil
+}
+
+// AuthenticateCertificate maps a client certificate that the TLS layer has
+// already verified onto its subject common name.
+func (a *Authenticator) AuthenticateCertificate(_ context.Context, cert *x509.Certificate) (models.Principal, error) {
+	const op = "services.auth.AuthenticateCertificate"
+
+	if !a.certificates {
+		return models.Principal{}, fmt.Errorf("%s: client certificates are not accepted: %w", op, ErrUnauthenticated)
+	}
+
+	subject := cert.Subject.CommonName
+	if subject == "" {
+		return models.Principal{}, fmt.Errorf("%s: certificate has no common name: %w", op, ErrUnauthenticated)
+	}
+
+	var roles []string
+	if a.adminSubjects[subject] {
+		roles = append(roles, models.RoleAdmin)
+	}
+
+	return models.Principal{
+		Subject: subject,
+		Method:  models.AuthMethodCertificate,
+		Roles:   roles,
+	}, nil
+}
+
+// keyFunc offers every configured key that matches the token's algorithm
+// family and, when present, its key id. Filtering by family keeps an
+// RSA public key from ever being used as an HMAC secret.
+func (a *Authenticator) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	var set jwt.VerificationKeySet
+
+	for _, key := range a.jwtKeys {
+		if kid != "" && key.ID != "" && key.ID != kid {
+			continue
+		}
+
+		switch token.Method.(type) {
+		case *jwt.SigningMethodHMAC:
+			if secret, ok := key.Material.([]byte); ok {
+				set.Keys = append(set.Keys, secret)
+			}
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			if pub, ok := key.Material.(*rsa.PublicKey); ok {
+				set.Keys = append(set.Keys, pub)
+			}
+		case *jwt.SigningMethodECDSA:
+			if pub, ok := key.Material.(*ecdsa.PublicKey); ok {
+				set.Keys = append(set.Keys, pub)
+			}
+		}
+	}
+
+	if len(set.Keys) == 0 {
+		return nil, fmt.Errorf("no key for kid %q and alg %q", kid, token.Method.Alg())
+	}
+
+	return set, nil
+}
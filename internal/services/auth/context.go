@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"tms/internal/domain/errs"
+	"tms/internal/domain/models"
+	"tms/internal/storage"
+)
+
+type principalKey struct{}
+
+// WithPrincipal stores the authenticated caller in ctx.
+func WithPrincipal(ctx context.Context, principal models.Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the authenticated caller, if any.
+func PrincipalFromContext(ctx context.Context) (models.Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(models.Principal)
+
+	return principal, ok
+}
+
+// ResolveUser returns the user id a call acts on. Callers act as themselves:
+// a requested user id is only honoured when it is empty, matches the
+// caller, or the caller is an admin. Without an authenticated caller
+// (authentication disabled) the requested id is used as is.
+func ResolveUser(ctx context.Context, requested string) (string, error) {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return requested, nil
+	}
+
+	switch {
+	case requested == "" || requested == principal.Subject:
+		return principal.Subject, nil
+	case principal.HasRole(models.RoleAdmin):
+		return requested, nil
+	default:
+		return "", errs.PermissionDenied(storage.ResourceUser, requested, fmt.Sprintf("%q may only act as itself", principal.Subject))
+	}
+}
@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"tms/internal/lib/jwk"
+)
+
+// VerificationKey is a JWT verification key: *rsa.PublicKey,
+// *ecdsa.PublicKey or an HMAC secret as []byte.
+type VerificationKey struct {
+	ID       string
+	Material any
+}
+
+// LoadVerificationKeys collects the JWT verification keys from an HMAC
+// secret, PEM public key or certificate files (the key id is the file name
+// without extension) and a local JWKS file. Empty sources are skipped.
+func LoadVerificationKeys(hmacSecret string, publicKeyFiles []string, jwksFile string) ([]VerificationKey, error) {
+	var keys []VerificationKey
+
+	if hmacSecret != "" {
+		keys = append(keys, VerificationKey{Material: []byte(hmacSecret)})
+	}
+
+	for _, file := range publicKeyFiles {
+		material, err := readPublicKey(file)
+		if err != nil {
+			return nil, err
+		}
+
+		id := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		keys = append(keys, VerificationKey{ID: id, Material: material})
+	}
+
+	if jwksFile != "" {
+		data, err := os.ReadFile(jwksFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JWKS file: %w", err)
+		}
+
+		set, err := jwk.ParseSet(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", jwksFile, err)
+		}
+
+		for _, key := range set.Keys {
+			if key.Use != "" && key.Use != "sig" {
+				continue
+			}
+
+			material, err := key.Material()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", jwksFile, err)
+			}
+
+			keys = append(keys, VerificationKey{ID: key.KeyID, Material: material})
+		}
+	}
+
+	return keys, nil
+}
+
+func readPublicKey(file string) (any, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block found", file)
+	}
+
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		return cert.PublicKey, nil
+	case "PUBLIC KEY":
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		return pub, nil
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", file, block.Type)
+	}
+}
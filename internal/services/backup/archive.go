@@ -0,0 +1,167 @@
+package backup
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"strings"
+	"time"
+	"tms/internal/domain/models"
+)
+
+const (
+	archiveFormat  = "tms-key-backup"
+	archiveVersion = 1
+)
+
+// KEKSize is the size of a backup key-encryption key, an AES-256 key.
+const KEKSize = 32
+
+// Archive is the content of a backup: the key pairs with their metadata,
+// each version wrapped under the backup KEK.
+type Archive struct {
+	CreatedAt time.Time `json:"created_at"`
+	// KEKID identifies the KEK the keys are wrapped under without
+	// revealing it.
+	KEKID string        `json:"kek_id"`
+	Keys  []ArchivedKey `json:"keys"`
+}
+
+type ArchivedKey struct {
+	Key      models.Key        `json:"key"`
+	Versions []ArchivedVersion `json:"versions"`
+}
+
+// ArchivedVersion is one version of a key as the backend held it.
+type ArchivedVersion struct {
+	Version      int    `json:"version"`
+	BackendLabel string `json:"backend_label"`
+	Algorithm    string `json:"algorithm"`
+	// PublicKey is the SubjectPublicKeyInfo DER.
+	PublicKey []byte `json:"public_key"`
+	// WrappedPrivateKey is the PKCS#8 private key wrapped under the KEK with
+	// AES Key Wrap with Padding.
+	WrappedPrivateKey []byte `json:"wrapped_private_key"`
+	// Probe is a signature made at backup time that the restored key has
+	// to reproduce.
+	Probe Probe `json:"probe"`
+}
+
+type Probe struct {
+	Scheme    string `json:"scheme"`
+	Data      []byte `json:"data"`
+	Signature []byte `json:"signature"`
+}
+
+// sealed is the file form of an archive. The MAC covers the format, the
+// version and the payload, so none of them can be swapped or edited.
+type sealed struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	Payload []byte `json:"payload"`
+	MAC     []byte `json:"mac"`
+}
+
+// Seal encodes the archive and protects it with an HMAC-SHA256 under a key
+// derived from kek. The private keys in it are already wrapped under kek.
+func (a *Archive) Seal(kek []byte) ([]byte, error) {
+	payload, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+
+	mac, err := archiveMAC(kek, archiveFormat, archiveVersion, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(sealed{
+		Format:  archiveFormat,
+		Version: archiveVersion,
+		Payload: payload,
+		MAC:     mac,
+	}, "", "  ")
+}
+
+// Open checks the integrity of a sealed archive under kek and decodes it.
+// An archive sealed under another KEK fails the check like a tampered one.
+func Open(kek []byte, raw []byte) (*Archive, error) {
+	var s sealed
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse archive: %w", err)
+	}
+	if s.Format != archiveFormat {
+		return nil, fmt.Errorf("not a key backup archive (format %q)", s.Format)
+	}
+	if s.Version != archiveVersion {
+		return nil, fmt.Errorf("unsupported archive version %d", s.Version)
+	}
+
+	mac, err := archiveMAC(kek, s.Format, s.Version, s.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, s.MAC) {
+		return nil, errors.New("archive integrity check failed: wrong KEK or modified archive")
+	}
+
+	var archive Archive
+	if err := json.Unmarshal(s.Payload, &archive); err != nil {
+		return nil, fmt.Errorf("failed to parse archive payload: %w", err)
+	}
+
+	return &archive, nil
+}
+
+// ParseKEK reads a KEK file holding the key raw or hex encoded.
+func ParseKEK(data []byte) ([]byte, error) {
+	if len(data) == KEKSize {
+		return data, nil
+	}
+
+	kek, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(kek) != KEKSize {
+		return nil, fmt.Errorf("a KEK must be %d bytes, raw or hex encoded", KEKSize)
+	}
+
+	return kek, nil
+}
+
+// KEKID derives the identifier recorded in archives from kek.
+func KEKID(kek []byte) (string, error) {
+	id, err := deriveKey(kek, "kek id")
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id[:8]), nil
+}
+
+func archiveMAC(kek []byte, format string, version int, payload []byte) ([]byte, error) {
+	key, err := deriveKey(kek, "archive mac")
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	_, _ = fmt.Fprintf(mac, "%s\n%d\n", format, version)
+	mac.Write(payload)
+
+	return mac.Sum(nil), nil
+}
+
+// deriveKey derives a key for purpose from kek with HKDF-SHA256, so the KEK
+// itself only ever wraps keys.
+func deriveKey(kek []byte, purpose string) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, kek, nil, []byte(archiveFormat+" "+purpose)), key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
@@ -0,0 +1,147 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+	"tms/internal/domain/models"
+)
+
+func testKEK() []byte {
+	kek := make([]byte, KEKSize)
+	for i := range kek {
+		kek[i] = byte(i)
+	}
+
+	return kek
+}
+
+// The golden values were computed independently of this package, with
+// HKDF-SHA256 and HMAC-SHA256 as RFC 5869 and RFC 2104 describe them.
+func TestGolden(t *testing.T) {
+	kek := testKEK()
+
+	id, err := KEKID(kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "0cf3a16fa26ec407" {
+		t.Fatalf("KEKID = %s, want 0cf3a16fa26ec407", id)
+	}
+
+	archive := &Archive{CreatedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), KEKID: "x"}
+
+	raw, err := archive.Seal(kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s sealed
+	if err := json.Unmarshal(raw, &s); err != nil {
+		t.Fatal(err)
+	}
+
+	wantPayload := `{"created_at":"2024-01-02T03:04:05Z","kek_id":"x","keys":null}`
+	if string(s.Payload) != wantPayload {
+		t.Fatalf("payload = %s, want %s", s.Payload, wantPayload)
+	}
+	if mac := hex.EncodeToString(s.MAC); mac != "a247970baf3f725767472f998e090c2226372f01406aba6f7a965e58be4128e2" {
+		t.Fatalf("MAC = %s", mac)
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	kek := testKEK()
+
+	archive := &Archive{
+		CreatedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		KEKID:     "0cf3a16fa26ec407",
+		Keys: []ArchivedKey{{
+			Key: models.Key{Label: "signing"},
+			Versions: []ArchivedVersion{{
+				Version:           1,
+				BackendLabel:      "signing",
+				Algorithm:         "EC_P256",
+				PublicKey:         []byte{0x30, 0x59},
+				WrappedPrivateKey: bytes.Repeat([]byte{0xaa}, 40),
+				Probe:             Probe{Scheme: "ECDSA_SHA256", Data: []byte("probe"), Signature: []byte{0x01}},
+			}},
+		}},
+	}
+
+	raw, err := archive.Seal(kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, err := Open(kek, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened.KEKID != archive.KEKID || len(opened.Keys) != 1 || opened.Keys[0].Key.Label != "signing" {
+		t.Fatalf("Open = %+v, want %+v", opened, archive)
+	}
+	if !bytes.Equal(opened.Keys[0].Versions[0].WrappedPrivateKey, archive.Keys[0].Versions[0].WrappedPrivateKey) {
+		t.Fatal("wrapped private key changed across Seal and Open")
+	}
+
+	otherKEK := bytes.Repeat([]byte{0xff}, KEKSize)
+	if _, err := Open(otherKEK, raw); err == nil {
+		t.Fatal("Open accepted another KEK")
+	}
+
+	tamper := func(edit func(s *sealed)) []byte {
+		var s sealed
+		if err := json.Unmarshal(raw, &s); err != nil {
+			t.Fatal(err)
+		}
+		edit(&s)
+		tampered, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tampered
+	}
+
+	tests := map[string]func(s *sealed){
+		"payload": func(s *sealed) { s.Payload = bytes.Replace(s.Payload, []byte("signing"), []byte("signinG"), 1) },
+		"mac":     func(s *sealed) { s.MAC[0] ^= 0x01 },
+		"format":  func(s *sealed) { s.Format = "tms-other" },
+		"version": func(s *sealed) { s.Version = archiveVersion + 1 },
+	}
+	for name, edit := range tests {
+		if _, err := Open(kek, tamper(edit)); err == nil {
+			t.Fatalf("Open accepted an archive with a modified %s", name)
+		}
+	}
+}
+
+func TestParseKEK(t *testing.T) {
+	kek := testKEK()
+
+	for name, data := range map[string][]byte{
+		"raw":      kek,
+		"hex":      []byte(hex.EncodeToString(kek)),
+		"hex line": []byte(hex.EncodeToString(kek) + "\n"),
+	} {
+		got, err := ParseKEK(data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(got, kek) {
+			t.Fatalf("%s: ParseKEK = %x, want %x", name, got, kek)
+		}
+	}
+
+	for name, data := range map[string][]byte{
+		"short":    kek[:16],
+		"bad hex":  []byte("not a key"),
+		"long hex": []byte(hex.EncodeToString(append(kek, 0))),
+	} {
+		if _, err := ParseKEK(data); err == nil {
+			t.Fatalf("%s: ParseKEK accepted it", name)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+// Package backup exports key pairs wrapped under a backup key-encryption key
+// together with their metadata, and restores them into another backend.
+package backup
+
+import (
+	"bytes"
+	"context"
+	gocrypto "crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"slices"
+	"time"
+	"tms/internal/domain/errs"
+	"tms/internal/domain/models"
+	"tms/internal/services/crypto"
+)
+
+// Outcomes reported per key.
+const (
+	StatusExported = "exported"
+	StatusRestored = "restored"
+	StatusSkipped  = "skipped"
+	StatusFailed   = "failed"
+)
+
+type Service struct {
+	log         *slog.Logger
+	keyManager  crypto.KeyManager
+	keyProvider Provider
+}
+
+type Provider interface {
+	KeyPairs(ctx context.Context) ([]models.Key, error)
+	RestoreKeyPair(ctx context.Context, key models.Key) error
+}
+
+// Selector picks the keys to back up or restore. Empty fields match every
+// key.
+type Selector struct {
+	Labels []string
+	UserId string
+}
+
+// Result is the outcome for one key.
+type Result struct {
+	Label  string
+	Status string
+	Reason string
+}
+
+func New(log *slog.Logger, keyManager crypto.KeyManager, keyProvider Provider) *Service {
+	return &Service{
+		log:         log,
+		keyManager:  keyManager,
+		keyProvider: keyProvider,
+	}
+}
+
+// Backup exports every selected key under kek. Destroyed keys and keys the
+// backend will not export, such as imported or non-extractable ones, are
+// skipped and reported; the archive holds the rest.
+func (s *Service) Backup(ctx context.Context, kek []byte, selector Selector) (*Archive, []Result, error) {
+	const op = "services.backup.Backup"
+
+	log := s.log.With(slog.String("op", op))
+
+	kekID, err := KEKID(kek)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	keys, err := s.keyProvider.KeyPairs(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	archive := &Archive{CreatedAt: time.Now().UTC(), KEKID: kekID, Keys: []ArchivedKey{}}
+	var results []Result
+
+	for _, key := range keys {
+		if !selector.matches(key) {
+			continue
+		}
+		if key.CurrentState() == models.KeyStateDestroyed {
+			results = append(results, Result{Label: key.Label, Status: StatusSkipped, Reason: "key is destroyed"})
+			continue
+		}
+
+		archived, err := s.exportKey(ctx, kek, key)
+		if errors.Is(err, errs.KindFailedPrecondition) {
+			results = append(results, Result{Label: key.Label, Status: StatusSkipped, Reason: err.Error()})
+			continue
+		}
+		if err != nil {
+			log.Error("failed to back up key", slog.String("label", key.Label), slog.Any("error", err))
+			results = append(results, Result{Label: key.Label, Status: StatusFailed, Reason: err.Error()})
+			continue
+		}
+
+		archive.Keys = append(archive.Keys, archived)
+		results = append(results, Result{Label: key.Label, Status: StatusExported})
+	}
+
+	log.Info("keys backed up", slog.Int("keys", len(archive.Keys)), slog.String("kek_id", kekID))
+
+	return archive, results, nil
+}
+
+// Restore puts the selected keys of archive into the backend and checks
+// that each restored version reproduces the signature made at backup time.
+// Versions the backend still holds are checked the same way and left alone.
+// Metadata is inserted unless storage already has it. A key that fails the
+// check is removed again and reported.
+func (s *Service) Restore(ctx context.Context, kek []byte, archive *Archive, selector Selector) ([]Result, error) {
+	const op = "services.backup.Restore"
+
+	log := s.log.With(slog.String("op", op))
+
+	kekID, err := KEKID(kek)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if kekID != archive.KEKID {
+		return nil, fmt.Errorf("%s: archive was made with KEK %s, not %s", op, archive.KEKID, kekID)
+	}
+
+	var results []Result
+
+	for _, archived := range archive.Keys {
+		if !selector.matches(archived.Key) {
+			continue
+		}
+
+		label := archived.Key.Label
+		if err := s.restoreKey(ctx, kek, archived); err != nil {
+			log.Error("failed to restore key", slog.String("label", label), slog.Any("error", err))
+			results = append(results, Result{Label: label, Status: StatusFailed, Reason: err.Error()})
+			continue
+		}
+
+		err := s.keyProvider.RestoreKeyPair(ctx, archived.Key)
+		switch {
+		case errors.Is(err, errs.KindAlreadyExists):
+			results = append(results, Result{Label: label, Status: StatusRestored, Reason: "metadata already present"})
+		case err != nil:
+			results = append(results, Result{Label: label, Status: StatusFailed, Reason: fmt.Sprintf("key restored but metadata not: %v", err)})
+		default:
+			results = append(results, Result{Label: label, Status: StatusRestored})
+		}
+	}
+
+	log.Info("keys restored", slog.String("kek_id", kekID))
+
+	return results, nil
+}
+
+func (s *Service) exportKey(ctx context.Context, kek []byte, key models.Key) (ArchivedKey, error) {
+	scheme := crypto.StoredScheme(key.Algorithm, key.Scheme)
+	archived := ArchivedKey{Key: key}
+
+	for _, version := range keyVersions(key) {
+		wrapped, publicKey, err := s.keyManager.ExportKeyPair(ctx, version.BackendLabel, kek)
+		if err != nil {
+			return ArchivedKey{}, err
+		}
+
+		der, err := x509.MarshalPKIXPublicKey(publicKey)
+		if err != nil {
+			return ArchivedKey{}, err
+		}
+		algorithm, err := crypto.AlgorithmOf(publicKey)
+		if err != nil {
+			return ArchivedKey{}, err
+		}
+
+		data := make([]byte, 32)
+		if _, err := rand.Read(data); err != nil {
+			return ArchivedKey{}, err
+		}
+		signature, err := s.keyManager.Sign(ctx, version.BackendLabel, scheme, data)
+		if err != nil {
+			return ArchivedKey{}, err
+		}
+
+		archived.Versions = append(archived.Versions, ArchivedVersion{
+			Version:           version.Version,
+			BackendLabel:      version.BackendLabel,
+			Algorithm:         string(algorithm),
+			PublicKey:         der,
+			WrappedPrivateKey: wrapped,
+			Probe:             Probe{Scheme: string(scheme), Data: data, Signature: signature},
+		})
+	}
+
+	return archived, nil
+}
+
+// restoreKey restores every version of a key, all or nothing.
+func (s *Service) restoreKey(ctx context.Context, kek []byte, archived ArchivedKey) error {
+	var restored []string
+
+	rollback := func() {
+		for _, backendLabel := range restored {
+			if err := s.keyManager.DeleteKeyPair(context.WithoutCancel(ctx), backendLabel); err != nil {
+				s.log.Error("failed to remove restored key version", slog.String("label", backendLabel), slog.Any("error", err))
+			}
+		}
+	}
+
+	for _, version := range archived.Versions {
+		publicKey, err := x509.ParsePKIXPublicKey(version.PublicKey)
+		if err != nil {
+			rollback()
+			return fmt.Errorf("version %d: %w", version.Version, err)
+		}
+
+		_, err = s.keyManager.FindKey(ctx, version.BackendLabel)
+		switch {
+		case errors.Is(err, errs.KindNotFound):
+			if _, err := s.keyManager.RestoreKeyPair(ctx, version.BackendLabel, kek, version.WrappedPrivateKey, publicKey); err != nil {
+				rollback()
+				return fmt.Errorf("version %d: %w", version.Version, err)
+			}
+			restored = append(restored, version.BackendLabel)
+		case err != nil:
+			rollback()
+			return fmt.Errorf("version %d: %w", version.Version, err)
+		}
+
+		if err := s.checkProbe(ctx, version, publicKey); err != nil {
+			rollback()
+			return fmt.Errorf("version %d: %w", version.Version, err)
+		}
+	}
+
+	return nil
+}
+
+// checkProbe verifies the backup-time signature with the key now in the
+// backend and signs the probe again. Deterministic schemes must reproduce
+// the signature byte for byte; randomized ones must verify.
+func (s *Service) checkProbe(ctx context.Context, version ArchivedVersion, publicKey gocrypto.PublicKey) error {
+	scheme := crypto.Scheme(version.Probe.Scheme)
+
+	valid, err := s.keyManager.Verify(ctx, version.BackendLabel, scheme, version.Probe.Data, version.Probe.Signature)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return errors.New("the backed up signature does not verify")
+	}
+
+	signature, err := s.keyManager.Sign(ctx, version.BackendLabel, scheme, version.Probe.Data)
+	if err != nil {
+		return err
+	}
+
+	if scheme.PSS() || scheme.ECDSA() {
+		valid, err = crypto.Verify(publicKey, scheme, version.Probe.Data, signature)
+		if err != nil {
+			return err
+		}
+	} else {
+		valid = bytes.Equal(signature, version.Probe.Signature)
+	}
+	if !valid {
+		return errors.New("the key does not reproduce the backed up signature")
+	}
+
+	return nil
+}
+
+func (sel Selector) matches(key models.Key) bool {
+	if sel.UserId != "" && key.User.ID != sel.UserId {
+		return false
+	}
+
+	return len(sel.Labels) == 0 || slices.Contains(sel.Labels, key.Label)
+}
+
+// keyVersions lists the versions of a key with their backend labels.
+func keyVersions(key models.Key) []models.KeyVersion {
+	if len(key.Versions) == 0 {
+		return []models.KeyVersion{{Version: 1, BackendLabel: key.Label}}
+	}
+
+	return key.Versions
+}
@@ -0,0 +1,128 @@
+// Package cipher encrypts data to the public keys of key pairs and decrypts
+// it with their private halves, which stay in the key backend.
+package cipher
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"tms/internal/domain/errs"
+	"tms/internal/domain/models"
+	"tms/internal/services/crypto"
+)
+
+type CipherService struct {
+	log         *slog.Logger
+	keyManager  crypto.KeyManager
+	keyProvider Provider
+	authorizer  Authorizer
+}
+
+type Provider interface {
+	KeyPair(ctx context.Context, label string) (models.Key, error)
+}
+
+type Authorizer interface {
+	AuthorizeKey(ctx context.Context, userId string, label string) (models.Key, error)
+}
+
+func New(log *slog.Logger, keyManager crypto.KeyManager, keyProvider Provider, authorizer Authorizer) *CipherService {
+	return &CipherService{
+		log:         log,
+		keyManager:  keyManager,
+		keyProvider: keyProvider,
+		authorizer:  authorizer,
+	}
+}
+
+// Encrypt encrypts plaintext to the current version of the key labelled
+// label. Encrypting only takes the public key, so any caller may encrypt to
+// any user's key; only the owner can decrypt. The key must be active and not
+// scheduled for deletion, so that nothing new is encrypted to a key on its
+// way out.
+func (s *CipherService) Encrypt(ctx context.Context, label string, plaintext []byte, associatedData []byte) (models.Ciphertext, error) {
+	const op = "services.cipher.Encrypt"
+
+	key, err := s.keyProvider.KeyPair(ctx, label)
+	if err != nil {
+		return models.Ciphertext{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if key.Deletion != nil {
+		return models.Ciphertext{}, fmt.Errorf("%s: %w", op, errs.FailedPrecondition(fmt.Sprintf("key pair %q is scheduled for deletion", label)))
+	}
+	if state := key.CurrentState(); state != models.KeyStateActive {
+		return models.Ciphertext{}, fmt.Errorf("%s: %w", op, errs.FailedPrecondition(fmt.Sprintf("key pair %q is %s and cannot be encrypted to", label, state)))
+	}
+	if _, err := crypto.CipherScheme(crypto.StoredAlgorithm(key.Algorithm)); err != nil {
+		return models.Ciphertext{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	version := key.CurrentVersion()
+	backendLabel, ok := key.BackendLabel(version)
+	if !ok {
+		return models.Ciphertext{}, fmt.Errorf("%s: %w", op, errs.FailedPrecondition(fmt.Sprintf("key pair %q has no version %d", label, version)))
+	}
+
+	publicKey, err := s.keyManager.PublicKey(ctx, backendLabel)
+	if err != nil {
+		return models.Ciphertext{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	ciphertext, scheme, err := crypto.Encrypt(publicKey, plaintext, associatedData)
+	if err != nil {
+		return models.Ciphertext{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return models.Ciphertext{
+		Label:      label,
+		Version:    version,
+		Scheme:     scheme,
+		Ciphertext: ciphertext,
+	}, nil
+}
+
+// Decrypt decrypts ciphertext with version of a key owned by userId; version
+// 0 is the current version. Revoked keys still decrypt, since what was
+// encrypted to them before revocation must stay readable; pre-active and
+// suspended keys do not.
+func (s *CipherService) Decrypt(
+	ctx context.Context,
+	userId string,
+	label string,
+	version int,
+	ciphertext []byte,
+	associatedData []byte,
+) ([]byte, error) {
+	const op = "services.cipher.Decrypt"
+
+	log := s.log.With(slog.String("op", op))
+
+	key, err := s.authorizer.AuthorizeKey(ctx, userId, label)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	switch state := key.CurrentState(); state {
+	case models.KeyStateActive, models.KeyStateRevoked:
+	default:
+		return nil, fmt.Errorf("%s: %w", op, errs.FailedPrecondition(fmt.Sprintf("key pair %q is %s and cannot decrypt", label, state)))
+	}
+
+	if version == 0 {
+		version = key.CurrentVersion()
+	}
+	backendLabel, ok := key.BackendLabel(version)
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", op, errs.InvalidField("key_version", fmt.Sprintf("key pair %q has no version %d", label, version)))
+	}
+
+	plaintext, err := crypto.Decrypt(ctx, s.keyManager, backendLabel, ciphertext, associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("ciphertext decrypted", slog.String("label", label), slog.Int("version", version))
+
+	return plaintext, nil
+}
@@ -0,0 +1,219 @@
+package crypto
+
+import (
+	"context"
+	gocrypto "crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"tms/internal/domain/errs"
+)
+
+// Cipher schemes. Both are hybrid: the content is sealed with AES-256-GCM
+// under a fresh key that only the recipient's private key recovers.
+//
+// CipherRSAOAEP: the AES key encrypted with RSA-OAEP (SHA-256, MGF1-SHA-256),
+// then the 12-byte nonce, then the sealed content.
+//
+// CipherECDHES: the ephemeral public key as an uncompressed point, then the
+// nonce, then the sealed content. The AES key is HKDF-SHA256 over the ECDH
+// shared secret, bound to the scheme and both public keys.
+const (
+	CipherRSAOAEP = "RSA_OAEP_SHA256_A256GCM"
+	CipherECDHES  = "ECDH_ES_HKDF_SHA256_A256GCM"
+)
+
+// ContentKeySize is the size of the AES-256 keys Seal takes.
+const ContentKeySize = 32
+
+// ErrOpen is returned by Open for data that was not sealed under the key
+// and associated data given, or was modified since.
+var ErrOpen = errors.New("sealed data cannot be opened")
+
+// CipherScheme returns the scheme keys of algorithm encrypt with. Ed25519
+// keys only sign.
+func CipherScheme(algorithm Algorithm) (string, error) {
+	switch {
+	case algorithm.RSABits() > 0:
+		return CipherRSAOAEP, nil
+	case algorithm.Curve() != nil:
+		return CipherECDHES, nil
+	default:
+		return "", errs.FailedPrecondition(fmt.Sprintf("%s keys cannot encrypt", algorithm))
+	}
+}
+
+// Encrypt seals plaintext to publicKey. associatedData is authenticated but
+// not encrypted; decryption needs the same value.
+func Encrypt(publicKey gocrypto.PublicKey, plaintext []byte, associatedData []byte) ([]byte, string, error) {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		contentKey := make([]byte, ContentKeySize)
+		if _, err := rand.Read(contentKey); err != nil {
+			return nil, "", err
+		}
+
+		encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, contentKey, nil)
+		if err != nil {
+			return nil, "", err
+		}
+
+		sealed, err := Seal(contentKey, plaintext, associatedData)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return append(encryptedKey, sealed...), CipherRSAOAEP, nil
+	case *ecdsa.PublicKey:
+		recipient, err := key.ECDH()
+		if err != nil {
+			return nil, "", err
+		}
+
+		ephemeral, err := recipient.Curve().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, "", err
+		}
+		secret, err := ephemeral.ECDH(recipient)
+		if err != nil {
+			return nil, "", err
+		}
+
+		contentKey, err := ecdhContentKey(secret, ephemeral.PublicKey(), recipient)
+		if err != nil {
+			return nil, "", err
+		}
+
+		sealed, err := Seal(contentKey, plaintext, associatedData)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return append(ephemeral.PublicKey().Bytes(), sealed...), CipherECDHES, nil
+	default:
+		return nil, "", errs.FailedPrecondition(fmt.Sprintf("%T keys cannot encrypt", publicKey))
+	}
+}
+
+// Decrypt opens a ciphertext made by Encrypt with the private key labelled
+// label. Ciphertexts that do not open, including ones made for another key
+// or with other associated data, are rejected with errs.KindInvalidArgument.
+func Decrypt(ctx context.Context, keyManager KeyManager, label string, ciphertext []byte, associatedData []byte) ([]byte, error) {
+	publicKey, err := keyManager.PublicKey(ctx, label)
+	if err != nil {
+		return nil, err
+	}
+
+	var contentKey, sealed []byte
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		if len(ciphertext) < key.Size() {
+			return nil, errs.InvalidField("ciphertext", "is too short")
+		}
+
+		contentKey, err = keyManager.Decrypt(ctx, label, ciphertext[:key.Size()])
+		if err != nil {
+			return nil, err
+		}
+		sealed = ciphertext[key.Size():]
+	case *ecdsa.PublicKey:
+		recipient, err := key.ECDH()
+		if err != nil {
+			return nil, err
+		}
+
+		pointSize := len(recipient.Bytes())
+		if len(ciphertext) < pointSize {
+			return nil, errs.InvalidField("ciphertext", "is too short")
+		}
+		ephemeral, err := recipient.Curve().NewPublicKey(ciphertext[:pointSize])
+		if err != nil {
+			return nil, errs.InvalidField("ciphertext", "does not start with a valid ephemeral key")
+		}
+
+		secret, err := keyManager.DeriveSharedSecret(ctx, label, ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		contentKey, err = ecdhContentKey(secret, ephemeral, recipient)
+		if err != nil {
+			return nil, err
+		}
+		sealed = ciphertext[pointSize:]
+	default:
+		return nil, errs.FailedPrecondition(fmt.Sprintf("%T keys cannot decrypt", publicKey))
+	}
+
+	plaintext, err := Open(contentKey, sealed, associatedData)
+	if err != nil {
+		return nil, errs.InvalidField("ciphertext", "cannot be decrypted with this key and associated data")
+	}
+
+	return plaintext, nil
+}
+
+// ecdhContentKey derives the AES key from an ECDH shared secret.
+func ecdhContentKey(secret []byte, ephemeral *ecdh.PublicKey, recipient *ecdh.PublicKey) ([]byte, error) {
+	info := append([]byte(CipherECDHES), ephemeral.Bytes()...)
+	info = append(info, recipient.Bytes()...)
+
+	key := make([]byte, ContentKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, info), key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Seal encrypts plaintext with AES-256-GCM under key and returns the random
+// nonce followed by the sealed data.
+func Seal(key []byte, plaintext []byte, associatedData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, associatedData), nil
+}
+
+// Open decrypts data made by Seal.
+func Open(key []byte, sealed []byte, associatedData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrOpen
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], associatedData)
+	if err != nil {
+		return nil, ErrOpen
+	}
+
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
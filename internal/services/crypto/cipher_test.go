@@ -0,0 +1,85 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// Test case 16 of the GCM specification (McGrew and Viega), AES-256 with
+// associated data, in the nonce-first layout of Seal.
+func TestOpenGolden(t *testing.T) {
+	decode := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	key := decode("feffe9928665731c6d6a8f9467308308feffe9928665731c6d6a8f9467308308")
+	associatedData := decode("feedfacedeadbeeffeedfacedeadbeefabaddad2")
+	plaintext := decode("d9313225f88406e5a55909c5aff5269a86a7a9531534f7da2e4c303d8a318a72" +
+		"1c3c0c95956809532fcf0e2449a6b525b16aedf5aa0de657ba637b39")
+	sealed := decode("cafebabefacedbaddecaf888" +
+		"522dc1f099567d07f47f37a32a84427d643a8cdcbfe5c0c97598a2bd2555d1aa" +
+		"8cb08e48590dbb3da7b08b1056828838c5f61e6393ba7a0abcc9f662" +
+		"76fc6ece0f4e1768cddf8853bb2d551b")
+
+	got, err := Open(key, sealed, associatedData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatalf("Open = %x, want %x", got, plaintext)
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	key := bytes.Repeat([]byte{0x11}, ContentKeySize)
+	otherKey := bytes.Repeat([]byte{0x22}, ContentKeySize)
+	plaintext := []byte("document content")
+	associatedData := []byte("document 1")
+
+	sealed, err := Seal(key, plaintext, associatedData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := Seal(key, plaintext, associatedData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(sealed, again) {
+		t.Fatal("Seal reused a nonce")
+	}
+
+	got, err := Open(key, sealed, associatedData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatalf("Open = %q, want %q", got, plaintext)
+	}
+
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 0x01
+
+	tests := map[string]struct {
+		key            []byte
+		sealed         []byte
+		associatedData []byte
+	}{
+		"other key":             {otherKey, sealed, associatedData},
+		"other associated data": {key, sealed, []byte("document 2")},
+		"no associated data":    {key, sealed, nil},
+		"tampered":              {key, tampered, associatedData},
+		"truncated":             {key, sealed[:20], associatedData},
+	}
+	for name, tt := range tests {
+		if _, err := Open(tt.key, tt.sealed, tt.associatedData); !errors.Is(err, ErrOpen) {
+			t.Fatalf("%s: Open = %v, want ErrOpen", name, err)
+		}
+	}
+}
@@ -1,193 +1,199 @@
+// Package crypto defines the contract every key backend implements. Backends
+// only know keys by label; who owns a key and its metadata live elsewhere.
 package crypto
 
 import (
 	"context"
+	gocrypto "crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
 	"fmt"
-	"github.com/miekg/pkcs11"
-	"tms/internal/storage/mongodb"
+	"strings"
+	"tms/internal/domain/errs"
 )
 
-type Operator struct {
-	Pkcs11Lib   string
-	TokenLabel  string
-	Pin         string
-	MongoClient *mongodb.Storage
-	pkcs11Ctx   *pkcs11.Ctx
-	session     pkcs11.SessionHandle
-	slot        uint
-}
-
-func (op *Operator) Init() error {
-	// Initialize PKCS#11
-	op.pkcs11Ctx = pkcs11.New(op.Pkcs11Lib)
-	if err := op.pkcs11Ctx.Initialize(); err != nil {
-		return fmt.Errorf("PKCS#11 initialization error: %w", err)
-	}
+// Algorithm names the type and size of a key pair.
+type Algorithm string
 
-	// Find slot by token label
-	slots, err := op.pkcs11Ctx.GetSlotList(true)
-	if err != nil {
-		return fmt.Errorf("GetSlotList failed: %w", err)
-	}
-	for _, slot := range slots {
-		tokenInfo, err := op.pkcs11Ctx.GetTokenInfo(slot)
-		if err == nil && tokenInfo.Label == op.TokenLabel {
-			op.slot = slot
-			break
-		}
-	}
+const (
+	AlgorithmRSA2048 Algorithm = "RSA_2048"
+	AlgorithmRSA3072 Algorithm = "RSA_3072"
+	AlgorithmRSA4096 Algorithm = "RSA_4096"
+	AlgorithmECP256  Algorithm = "EC_P256"
+	AlgorithmECP384  Algorithm = "EC_P384"
+	AlgorithmEd25519 Algorithm = "ED25519"
+)
 
-	// Open a session
-	op.session, err = op.pkcs11Ctx.OpenSession(op.slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
-	if err != nil {
-		return fmt.Errorf("OpenSession failed: %w", err)
-	}
+// Key types accepted by ParseAlgorithm.
+const (
+	KeyTypeRSA     = "RSA"
+	KeyTypeEC      = "EC"
+	KeyTypeEd25519 = "ED25519"
+)
 
-	// Login
-	if err := op.pkcs11Ctx.Login(op.session, pkcs11.CKU_USER, op.Pin); err != nil {
-		return fmt.Errorf("Login failed: %w", err)
+// ParseAlgorithm combines the key type, RSA modulus size and EC curve of a
+// request into an Algorithm. Empty values default to RSA 2048 and P-256.
+func ParseAlgorithm(keyType string, keySize int, curve string) (Algorithm, error) {
+	switch strings.ToUpper(keyType) {
+	case "", KeyTypeRSA:
+		switch keySize {
+		case 0, 2048:
+			return AlgorithmRSA2048, nil
+		case 3072:
+			return AlgorithmRSA3072, nil
+		case 4096:
+			return AlgorithmRSA4096, nil
+		default:
+			return "", errs.InvalidField("key_size", "must be 2048, 3072 or 4096 for RSA keys")
+		}
+	case KeyTypeEC:
+		switch strings.ToUpper(curve) {
+		case "", "P-256", "P256":
+			return AlgorithmECP256, nil
+		case "P-384", "P384":
+			return AlgorithmECP384, nil
+		default:
+			return "", errs.InvalidField("curve", "must be P-256 or P-384 for EC keys")
+		}
+	case KeyTypeEd25519, "EDDSA":
+		return AlgorithmEd25519, nil
+	default:
+		return "", errs.InvalidField("algorithm", "must be RSA, EC or ED25519")
 	}
-
-	return nil
 }
 
-func (op *Operator) GenerateKeyPair(ctx context.Context, userId string, label string) error {
-	publicKeyTemplate := []*pkcs11.Attribute{
-		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
-		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
-		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
-		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
-		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
-		pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, 2048),
-		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
-	}
-	privateKeyTemplate := []*pkcs11.Attribute{
-		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
-		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
-		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
-		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
-		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
-	}
-
-	_, _, err := op.pkcs11Ctx.GenerateKeyPair(op.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)}, publicKeyTemplate, privateKeyTemplate)
-	if err != nil {
-		return fmt.Errorf("GenerateKeyPair failed: %w", err)
+// RSABits returns the modulus size of an RSA algorithm, or 0.
+func (a Algorithm) RSABits() int {
+	switch a {
+	case AlgorithmRSA2048:
+		return 2048
+	case AlgorithmRSA3072:
+		return 3072
+	case AlgorithmRSA4096:
+		return 4096
+	default:
+		return 0
 	}
-
-	// Store key information in MongoDB
-	err = op.MongoClient.SaveKeyPair(
-		ctx,
-		label,
-		userId,
-	)
-
-	if err != nil {
-		return fmt.Errorf("Failed to store key info in MongoDB: %w", err)
-	}
-
-	return nil
 }
 
-func (op *Operator) SignData(label string, data []byte) ([]byte, error) {
-	privateKeyHandle, err := op.FindKeyByLabel(label, "private")
-	if err != nil {
-		return nil, err
-	}
-
-	// Initialize signing operation
-	err = op.pkcs11Ctx.SignInit(op.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_SHA256_RSA_PKCS, nil)}, privateKeyHandle)
-	if err != nil {
-		return nil, fmt.Errorf("SignInit failed: %w", err)
-	}
-
-	// Perform the signing operation
-	signature, err := op.pkcs11Ctx.Sign(op.session, data)
-	if err != nil {
-		return nil, fmt.Errorf("Sign failed: %w", err)
+// Curve returns the curve of an ECDSA algorithm, or nil.
+func (a Algorithm) Curve() elliptic.Curve {
+	switch a {
+	case AlgorithmECP256:
+		return elliptic.P256()
+	case AlgorithmECP384:
+		return elliptic.P384()
+	default:
+		return nil
 	}
-	return signature, nil
 }
 
-func (op *Operator) VerifySignature(label string, data []byte, signature []byte) (bool, error) {
-	publicKeyHandle, err := op.FindKeyByLabel(label, "public")
-	if err != nil {
-		return false, err
-	}
-
-	// Initialize verification operation
-	err = op.pkcs11Ctx.VerifyInit(op.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_SHA256_RSA_PKCS, nil)}, publicKeyHandle)
-	if err != nil {
-		return false, fmt.Errorf("VerifyInit failed: %w", err)
+// StoredAlgorithm reads an algorithm kept in key metadata. Keys created
+// before the algorithm was recorded are RSA 2048.
+func StoredAlgorithm(name string) Algorithm {
+	if name == "" {
+		return AlgorithmRSA2048
 	}
 
-	// Perform the verification
-	err = op.pkcs11Ctx.Verify(op.session, data, signature)
-	if err != nil {
-		return false, fmt.Errorf("verify failed: %w", err)
-	}
-	return true, nil
+	return Algorithm(name)
 }
 
-func (op *Operator) DeleteKeyPair(ctx context.Context, userId string, label string) error {
-	// Find and delete the public key
-	pubKeyHandle, err := op.FindKeyByLabel(label, "public")
-	if err != nil {
-		return err
-	}
-	err = op.pkcs11Ctx.DestroyObject(op.session, pubKeyHandle)
-	if err != nil {
-		return fmt.Errorf("Failed to delete public key: %w", err)
-	}
-
-	// Find and delete the private key
-	privKeyHandle, err := op.FindKeyByLabel(label, "private")
-	if err != nil {
-		return err
-	}
-	err = op.pkcs11Ctx.DestroyObject(op.session, privKeyHandle)
-	if err != nil {
-		return fmt.Errorf("Failed to delete private key: %w", err)
-	}
-
-	// Remove key info from MongoDB
-	success, err := op.MongoClient.DeleteKeyPair(ctx, userId, label)
-
-	if err != nil || success == false {
-		return fmt.Errorf("Failed to remove key info from MongoDB: %w", err)
+// AlgorithmOf names the algorithm of a public key.
+func AlgorithmOf(publicKey gocrypto.PublicKey) (Algorithm, error) {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		algorithm := Algorithm(fmt.Sprintf("RSA_%d", key.N.BitLen()))
+		if algorithm.RSABits() == 0 {
+			return "", fmt.Errorf("unsupported RSA modulus size %d", key.N.BitLen())
+		}
+		return algorithm, nil
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return AlgorithmECP256, nil
+		case elliptic.P384():
+			return AlgorithmECP384, nil
+		}
+		return "", fmt.Errorf("unsupported curve %s", key.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return AlgorithmEd25519, nil
+	default:
+		return "", fmt.Errorf("unsupported public key type %T", publicKey)
 	}
-	return nil
 }
 
-func (op *Operator) FindKeyByLabel(label string, keyType string) (pkcs11.ObjectHandle, error) {
-	keyTypeClass := pkcs11.CKO_PUBLIC_KEY
-
-	if keyType == "private" {
-		keyTypeClass = pkcs11.CKO_PRIVATE_KEY
-	}
-
-	template := []*pkcs11.Attribute{
-		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
-		pkcs11.NewAttribute(pkcs11.CKA_CLASS, keyTypeClass),
-	}
-	if err := op.pkcs11Ctx.FindObjectsInit(op.session, template); err != nil {
-		return 0, fmt.Errorf("FindObjectsInit failed: %w", err)
-	}
-	defer op.pkcs11Ctx.FindObjectsFinal(op.session)
-
-	objects, _, err := op.pkcs11Ctx.FindObjects(op.session, 1)
-	if err != nil {
-		return 0, fmt.Errorf("FindObjects failed: %w", err)
-	}
-	if len(objects) == 0 {
-		return 0, fmt.Errorf("No objects found")
-	}
-	return objects[0], nil
+// KeyInfo describes a key pair held by a backend.
+type KeyInfo struct {
+	Label     string
+	Algorithm Algorithm
 }
 
-func (op *Operator) Close() {
-	if op.pkcs11Ctx != nil {
-		op.pkcs11Ctx.Logout(op.session)
-		op.pkcs11Ctx.CloseSession(op.session)
-		op.pkcs11Ctx.Finalize()
-	}
+// KeyManager generates key pairs and uses their private halves, which never
+// leave the backend. Methods referring to a missing label return an
+// errs.KindNotFound error; a backend that cannot be reached returns
+// errs.KindUnavailable.
+type KeyManager interface {
+	// GenerateKeyPair creates a key pair under label. Labels are unique:
+	// an existing label is rejected with errs.KindAlreadyExists, and an
+	// algorithm the backend cannot generate with errs.KindInvalidArgument.
+	GenerateKeyPair(ctx context.Context, label string, algorithm Algorithm) (KeyInfo, error)
+	// Sign signs data with scheme, which must suit the key (see
+	// CheckScheme). RSA signatures are byte-compatible with the PKCS#11
+	// CKM_SHA*_RSA_PKCS(_PSS) mechanisms and ECDSA signatures are the raw
+	// r||s pair CKM_ECDSA produces.
+	Sign(ctx context.Context, label string, scheme Scheme, data []byte) ([]byte, error)
+	// SignDigest signs a digest the caller computed with scheme.Hash(), so
+	// that content of any size can be signed without passing it to the
+	// backend. The signature is the one Sign makes over the content. Digests
+	// CheckDigest rejects are refused.
+	SignDigest(ctx context.Context, label string, scheme Scheme, digest []byte) ([]byte, error)
+	// Verify reports whether signature is valid for data under scheme. An
+	// invalid signature is not an error.
+	Verify(ctx context.Context, label string, scheme Scheme, data []byte, signature []byte) (bool, error)
+	DeleteKeyPair(ctx context.Context, label string) error
+	FindKey(ctx context.Context, label string) (KeyInfo, error)
+	// PublicKey exports the public half as an *rsa.PublicKey,
+	// *ecdsa.PublicKey or ed25519.PublicKey.
+	PublicKey(ctx context.Context, label string) (gocrypto.PublicKey, error)
+	// WrappingKey returns the public half of the WrappingAlgorithm key pair
+	// labelled label, generating it on first use. Its private half may only
+	// unwrap keys being imported.
+	WrappingKey(ctx context.Context, label string) (*rsa.PublicKey, error)
+	// ImportKeyPair unwraps wrapped, a private key in WrappingScheme format
+	// wrapped for the key labelled wrappingLabel, and stores it with
+	// publicKey under label as if it had been generated there. A key that
+	// cannot be unwrapped is rejected with errs.KindInvalidArgument.
+	ImportKeyPair(ctx context.Context, label string, wrappingLabel string, wrapped []byte, publicKey gocrypto.PublicKey) (KeyInfo, error)
+	// ExportKeyPair wraps the private key labelled label under kek, an AES
+	// key, with AES Key Wrap with Padding (RFC 5649) and returns it with the
+	// public key, for backups. Keys that are not extractable are refused
+	// with errs.KindFailedPrecondition.
+	ExportKeyPair(ctx context.Context, label string, kek []byte) ([]byte, gocrypto.PublicKey, error)
+	// RestoreKeyPair stores a key pair exported with ExportKeyPair under
+	// label.
+	RestoreKeyPair(ctx context.Context, label string, kek []byte, wrapped []byte, publicKey gocrypto.PublicKey) (KeyInfo, error)
+	// Decrypt decrypts ciphertext with the RSA private key labelled label
+	// using RSA-OAEP with SHA-256 and MGF1-SHA-256. Ciphertext that does not
+	// decrypt is rejected with errs.KindInvalidArgument, and keys that may
+	// not decrypt with errs.KindFailedPrecondition.
+	Decrypt(ctx context.Context, label string, ciphertext []byte) ([]byte, error)
+	// DeriveSharedSecret returns the raw ECDH shared secret of the EC private
+	// key labelled label and peer, which must be on the same curve.
+	DeriveSharedSecret(ctx context.Context, label string, peer *ecdh.PublicKey) ([]byte, error)
+	// GenerateMasterKey creates an AES-256 master key under label. Master
+	// keys only wrap and unwrap data keys and never leave the backend. An
+	// existing label is rejected with errs.KindAlreadyExists.
+	GenerateMasterKey(ctx context.Context, label string) error
+	// WrapDataKey wraps dataKey under the master key labelled label with AES
+	// Key Wrap with Padding (RFC 5649).
+	WrapDataKey(ctx context.Context, label string, dataKey []byte) ([]byte, error)
+	// UnwrapDataKey returns the data key WrapDataKey wrapped under label.
+	UnwrapDataKey(ctx context.Context, label string, wrapped []byte) ([]byte, error)
+	DeleteMasterKey(ctx context.Context, label string) error
+	// Ping reports whether the backend is usable.
+	Ping(ctx context.Context) error
+	Close() error
 }
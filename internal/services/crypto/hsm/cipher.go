@@ -0,0 +1,87 @@
+package hsm
+
+import (
+	"context"
+	"crypto/ecdh"
+	"fmt"
+	"github.com/miekg/pkcs11"
+	"tms/internal/domain/errs"
+)
+
+// Decrypt decrypts with CKM_RSA_PKCS_OAEP on the token.
+func (t *Token) Decrypt(ctx context.Context, label string, ciphertext []byte) ([]byte, error) {
+	var plaintext []byte
+
+	err := t.withRetry(ctx, func(session pkcs11.SessionHandle) error {
+		algorithm, err := t.algorithm(session, label)
+		if err != nil {
+			return err
+		}
+		if algorithm.RSABits() == 0 {
+			return errs.FailedPrecondition(fmt.Sprintf("%s keys cannot decrypt", algorithm))
+		}
+
+		privateKeyHandle, err := t.findKey(session, label, pkcs11.CKO_PRIVATE_KEY)
+		if err != nil {
+			return err
+		}
+
+		oaep := pkcs11.NewOAEPParams(pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256, pkcs11.CKZ_DATA_SPECIFIED, nil)
+		err = t.pkcs11Ctx.DecryptInit(session,
+			[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, oaep)}, privateKeyHandle)
+		if err != nil {
+			return cipherError("DecryptInit", err)
+		}
+
+		plaintext, err = t.pkcs11Ctx.Decrypt(session, ciphertext)
+		if err != nil {
+			return cipherError("Decrypt", err)
+		}
+		return nil
+	})
+
+	return plaintext, err
+}
+
+// DeriveSharedSecret derives with CKM_ECDH1_DERIVE and no KDF into a session
+// object and reads its value. The KDF runs outside the token so that the
+// result matches crypto.Encrypt whatever KDFs the token supports.
+func (t *Token) DeriveSharedSecret(ctx context.Context, label string, peer *ecdh.PublicKey) ([]byte, error) {
+	var secret []byte
+
+	err := t.withRetry(ctx, func(session pkcs11.SessionHandle) error {
+		algorithm, err := t.algorithm(session, label)
+		if err != nil {
+			return err
+		}
+		curve := algorithm.Curve()
+		if curve == nil {
+			return errs.FailedPrecondition(fmt.Sprintf("%s keys cannot decrypt", algorithm))
+		}
+
+		privateKeyHandle, err := t.findKey(session, label, pkcs11.CKO_PRIVATE_KEY)
+		if err != nil {
+			return err
+		}
+
+		params := pkcs11.NewECDH1DeriveParams(pkcs11.CKD_NULL, nil, peer.Bytes())
+		secretHandle, err := t.pkcs11Ctx.DeriveKey(session,
+			[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDH1_DERIVE, params)},
+			privateKeyHandle, sharedSecretTemplate((curve.Params().BitSize+7)/8))
+		if err != nil {
+			return cipherError("DeriveKey", err)
+		}
+		defer t.pkcs11Ctx.DestroyObject(session, secretHandle)
+
+		attributes, err := t.pkcs11Ctx.GetAttributeValue(session, secretHandle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+		})
+		if err != nil {
+			return pkcs11Error("GetAttributeValue", err)
+		}
+		secret = attributes[0].Value
+		return nil
+	})
+
+	return secret, err
+}
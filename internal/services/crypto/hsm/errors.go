@@ -0,0 +1,99 @@
+package hsm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miekg/pkcs11"
+	"tms/internal/domain/errs"
+)
+
+// sessionFailure reports whether err means the session, the login or the
+// library itself is gone, so that only a reinitialization can help.
+func sessionFailure(err error) bool {
+	var rv pkcs11.Error
+	if !errors.As(err, &rv) {
+		return false
+	}
+
+	switch rv {
+	case pkcs11.CKR_SESSION_HANDLE_INVALID,
+		pkcs11.CKR_SESSION_CLOSED,
+		pkcs11.CKR_USER_NOT_LOGGED_IN,
+		pkcs11.CKR_DEVICE_REMOVED,
+		pkcs11.CKR_DEVICE_ERROR,
+		pkcs11.CKR_TOKEN_NOT_PRESENT,
+		pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED,
+		pkcs11.CKR_GENERAL_ERROR:
+		return true
+	default:
+		return false
+	}
+}
+
+// pkcs11Error classifies a failed PKCS#11 call: token, device and session
+// failures mean the HSM is unavailable, malformed input is the caller's
+// fault, and anything else is internal.
+func pkcs11Error(call string, err error) error {
+	err = fmt.Errorf("%s failed: %w", call, err)
+
+	var rv pkcs11.Error
+	if !errors.As(err, &rv) {
+		return err
+	}
+
+	switch rv {
+	case pkcs11.CKR_DEVICE_ERROR,
+		pkcs11.CKR_DEVICE_MEMORY,
+		pkcs11.CKR_DEVICE_REMOVED,
+		pkcs11.CKR_TOKEN_NOT_PRESENT,
+		pkcs11.CKR_TOKEN_NOT_RECOGNIZED,
+		pkcs11.CKR_SESSION_CLOSED,
+		pkcs11.CKR_SESSION_HANDLE_INVALID,
+		pkcs11.CKR_USER_NOT_LOGGED_IN,
+		pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED,
+		pkcs11.CKR_PIN_INCORRECT,
+		pkcs11.CKR_PIN_LOCKED:
+		return errs.Unavailable(err, "HSM unavailable")
+	case pkcs11.CKR_DATA_INVALID,
+		pkcs11.CKR_DATA_LEN_RANGE,
+		pkcs11.CKR_ARGUMENTS_BAD:
+		return errs.Wrap(errs.KindInvalidArgument, err, "data rejected by the HSM")
+	case pkcs11.CKR_KEY_HANDLE_INVALID,
+		pkcs11.CKR_OBJECT_HANDLE_INVALID:
+		return errs.Wrap(errs.KindNotFound, err, "key not found in the HSM")
+	default:
+		return err
+	}
+}
+
+// unwrapError reports malformed or foreign wrapped keys as invalid input and
+// anything else as a token failure.
+func unwrapError(message string, err error) error {
+	var code pkcs11.Error
+	if errors.As(err, &code) {
+		switch code {
+		case pkcs11.CKR_WRAPPED_KEY_INVALID, pkcs11.CKR_WRAPPED_KEY_LEN_RANGE,
+			pkcs11.CKR_ENCRYPTED_DATA_INVALID, pkcs11.CKR_ENCRYPTED_DATA_LEN_RANGE,
+			pkcs11.CKR_TEMPLATE_INCONSISTENT, pkcs11.CKR_DOMAIN_PARAMS_INVALID:
+			return errs.InvalidField("wrapped_key", message)
+		}
+	}
+
+	return pkcs11Error("UnwrapKey", err)
+}
+
+// cipherError reports ciphertext the key cannot decrypt as invalid input and
+// keys created without CKA_DECRYPT or CKA_DERIVE as unusable.
+func cipherError(call string, err error) error {
+	var code pkcs11.Error
+	if errors.As(err, &code) {
+		switch code {
+		case pkcs11.CKR_ENCRYPTED_DATA_INVALID, pkcs11.CKR_ENCRYPTED_DATA_LEN_RANGE:
+			return errs.InvalidField("ciphertext", "cannot be decrypted with this key")
+		case pkcs11.CKR_KEY_FUNCTION_NOT_PERMITTED, pkcs11.CKR_KEY_TYPE_INCONSISTENT:
+			return errs.FailedPrecondition("the key may not decrypt; keys created before decryption was supported only sign")
+		}
+	}
+
+	return pkcs11Error(call, err)
+}
@@ -0,0 +1,393 @@
+// Package hsm keeps keys on a PKCS#11 token such as SoftHSM or a network HSM.
+package hsm
+
+import (
+	"context"
+	gocrypto "crypto"
+	"errors"
+	"fmt"
+	"github.com/miekg/pkcs11"
+	"golang.org/x/exp/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+	"tms/internal/domain/errs"
+	"tms/internal/services/crypto"
+	"tms/internal/storage"
+)
+
+type Options struct {
+	LibPath    string
+	TokenLabel string
+	Pin        string
+	// PoolSize is the number of sessions opened on the token.
+	PoolSize int
+	// OperationTimeout bounds waiting for a session plus the operation itself.
+	OperationTimeout time.Duration
+	// RetryAttempts is how often an idempotent operation is tried in total
+	// when the session fails; RetryBackoff is the first delay and doubles.
+	RetryAttempts int
+	RetryBackoff  time.Duration
+	// Extractable lets generated private keys leave the token wrapped under
+	// a backup key. They never leave it in the clear either way.
+	Extractable bool
+}
+
+// Token performs key operations on a PKCS#11 token. PKCS#11 operations such
+// as SignInit/Sign are stateful per session, so every call checks out its
+// own logged-in session from a bounded pool.
+//
+// When the token goes away (device removed, library restarted, session or
+// login invalidated) the token is reinitialized: the library is loaded
+// again, the slot is found again by label, the pool is rebuilt and
+// idempotent operations are retried.
+type Token struct {
+	log  *slog.Logger
+	opts Options
+
+	// mu guards the PKCS#11 context: operations hold it for reading,
+	// recovery and Close hold it for writing once in-flight operations are done.
+	mu         sync.RWMutex
+	pkcs11Ctx  *pkcs11.Ctx
+	sessions   chan pkcs11.SessionHandle
+	slot       uint
+	generation uint64
+	closed     bool
+
+	// wrappingMu serializes WrappingKey.
+	wrappingMu sync.Mutex
+
+	recoveries       atomic.Uint64
+	failedRecoveries atomic.Uint64
+	retries          atomic.Uint64
+	lastRecovery     atomic.Int64
+}
+
+var _ crypto.KeyManager = (*Token)(nil)
+
+const defaultPoolSize = 4
+
+// New loads the PKCS#11 library, finds the token labelled opts.TokenLabel
+// and logs in a pool of sessions.
+func New(log *slog.Logger, opts Options) (*Token, error) {
+	const op = "services.crypto.hsm.New"
+
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = defaultPoolSize
+	}
+	if opts.RetryAttempts <= 0 {
+		opts.RetryAttempts = 1
+	}
+
+	t := &Token{
+		log:  log.With(slog.String("component", "hsm")),
+		opts: opts,
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.open(); err != nil {
+		t.teardown()
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return t, nil
+}
+
+// GenerateKeyPair creates a key pair under label. The private key is
+// sensitive and, unless Options.Extractable is set, not extractable; it may
+// only sign.
+func (t *Token) GenerateKeyPair(ctx context.Context, label string, algorithm crypto.Algorithm) (crypto.KeyInfo, error) {
+	mechanism, publicKeyTemplate, privateKeyTemplate, err := keyPairTemplates(label, algorithm, t.opts.Extractable)
+	if err != nil {
+		return crypto.KeyInfo{}, err
+	}
+
+	err = t.withSession(ctx, func(session pkcs11.SessionHandle) error {
+		if err := t.checkLabelFree(session, label); err != nil {
+			return err
+		}
+
+		_, _, err := t.pkcs11Ctx.GenerateKeyPair(session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}, publicKeyTemplate, privateKeyTemplate)
+		if err != nil {
+			return pkcs11Error("GenerateKeyPair", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return crypto.KeyInfo{}, err
+	}
+
+	return crypto.KeyInfo{Label: label, Algorithm: algorithm}, nil
+}
+
+func (t *Token) Sign(ctx context.Context, label string, scheme crypto.Scheme, data []byte) ([]byte, error) {
+	mechanism, input := signatureInput(scheme, data)
+
+	return t.sign(ctx, label, scheme, mechanism, input)
+}
+
+// SignDigest signs with the raw mechanism of scheme, see digestInput.
+func (t *Token) SignDigest(ctx context.Context, label string, scheme crypto.Scheme, digest []byte) ([]byte, error) {
+	if err := crypto.CheckDigest(scheme, digest); err != nil {
+		return nil, err
+	}
+	mechanism, input := digestInput(scheme, digest)
+
+	return t.sign(ctx, label, scheme, mechanism, input)
+}
+
+func (t *Token) sign(ctx context.Context, label string, scheme crypto.Scheme, mechanism *pkcs11.Mechanism, input []byte) ([]byte, error) {
+	var signature []byte
+
+	err := t.withRetry(ctx, func(session pkcs11.SessionHandle) error {
+		algorithm, err := t.algorithm(session, label)
+		if err != nil {
+			return err
+		}
+
+		privateKeyHandle, err := t.findKey(session, label, pkcs11.CKO_PRIVATE_KEY)
+		if err != nil {
+			return err
+		}
+
+		if err := crypto.CheckScheme(algorithm, scheme); err != nil {
+			return err
+		}
+
+		// Initialize signing operation
+		err = t.pkcs11Ctx.SignInit(session, []*pkcs11.Mechanism{mechanism}, privateKeyHandle)
+		if err != nil {
+			return pkcs11Error("SignInit", err)
+		}
+
+		// Perform the signing operation
+		signature, err = t.pkcs11Ctx.Sign(session, input)
+		if err != nil {
+			return pkcs11Error("Sign", err)
+		}
+		return nil
+	})
+
+	return signature, err
+}
+
+func (t *Token) Verify(ctx context.Context, label string, scheme crypto.Scheme, data []byte, signature []byte) (bool, error) {
+	var valid bool
+
+	err := t.withRetry(ctx, func(session pkcs11.SessionHandle) error {
+		algorithm, err := t.algorithm(session, label)
+		if err != nil {
+			return err
+		}
+
+		publicKeyHandle, err := t.findKey(session, label, pkcs11.CKO_PUBLIC_KEY)
+		if err != nil {
+			return err
+		}
+
+		if err := crypto.CheckScheme(algorithm, scheme); err != nil {
+			return err
+		}
+		mechanism, input := signatureInput(scheme, data)
+
+		// Initialize verification operation
+		err = t.pkcs11Ctx.VerifyInit(session, []*pkcs11.Mechanism{mechanism}, publicKeyHandle)
+		if err != nil {
+			return pkcs11Error("VerifyInit", err)
+		}
+
+		// Perform the verification
+		err = t.pkcs11Ctx.Verify(session, input, signature)
+		if errors.Is(err, pkcs11.Error(pkcs11.CKR_SIGNATURE_INVALID)) ||
+			errors.Is(err, pkcs11.Error(pkcs11.CKR_SIGNATURE_LEN_RANGE)) {
+			return nil
+		}
+		if err != nil {
+			return pkcs11Error("Verify", err)
+		}
+		valid = true
+		return nil
+	})
+
+	return valid, err
+}
+
+// DeleteKeyPair destroys both halves of the key pair. A half that is already
+// gone is skipped, so an interrupted delete can be repeated.
+func (t *Token) DeleteKeyPair(ctx context.Context, label string) error {
+	return t.withSession(ctx, func(session pkcs11.SessionHandle) error {
+		found := false
+
+		for _, class := range []uint{pkcs11.CKO_PUBLIC_KEY, pkcs11.CKO_PRIVATE_KEY} {
+			handle, err := t.findKey(session, label, class)
+			if errors.Is(err, errs.KindNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := t.pkcs11Ctx.DestroyObject(session, handle); err != nil {
+				return pkcs11Error("DestroyObject", err)
+			}
+			found = true
+		}
+
+		if !found {
+			return errs.NotFound(storage.ResourceKeyPair, label)
+		}
+
+		return nil
+	})
+}
+
+// FindKey reports the algorithm of the key pair labelled label. Both halves
+// must be present.
+func (t *Token) FindKey(ctx context.Context, label string) (crypto.KeyInfo, error) {
+	var info crypto.KeyInfo
+
+	err := t.withRetry(ctx, func(session pkcs11.SessionHandle) error {
+		if _, err := t.findKey(session, label, pkcs11.CKO_PRIVATE_KEY); err != nil {
+			return err
+		}
+
+		algorithm, err := t.algorithm(session, label)
+		if err != nil {
+			return err
+		}
+
+		info = crypto.KeyInfo{Label: label, Algorithm: algorithm}
+		return nil
+	})
+
+	return info, err
+}
+
+func (t *Token) PublicKey(ctx context.Context, label string) (gocrypto.PublicKey, error) {
+	var publicKey gocrypto.PublicKey
+
+	err := t.withRetry(ctx, func(session pkcs11.SessionHandle) error {
+		var err error
+		publicKey, err = t.publicKey(session, label)
+		return err
+	})
+
+	return publicKey, err
+}
+
+// Ping reports whether a pooled session is still open and logged in to the
+// token. A broken session triggers recovery, so the health checker's periodic
+// probe also heals an idle token.
+func (t *Token) Ping(ctx context.Context) error {
+	return t.withSession(ctx, func(session pkcs11.SessionHandle) error {
+		info, err := t.pkcs11Ctx.GetSessionInfo(session)
+		if err != nil {
+			return pkcs11Error("GetSessionInfo", err)
+		}
+
+		if info.State != pkcs11.CKS_RW_USER_FUNCTIONS && info.State != pkcs11.CKS_RO_USER_FUNCTIONS {
+			return errs.Unavailable(pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN), fmt.Sprintf("session is not logged in (state %d)", info.State))
+		}
+
+		return nil
+	})
+}
+
+// Close waits for in-flight operations, logs out of the token, closes every
+// session and finalizes the PKCS#11 library.
+func (t *Token) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := t.Stats()
+	t.log.Info("HSM session statistics",
+		slog.Uint64("recoveries", stats.Recoveries),
+		slog.Uint64("failed_recoveries", stats.FailedRecoveries),
+		slog.Uint64("retries", stats.Retries),
+	)
+
+	t.closed = true
+	if t.pkcs11Ctx == nil {
+		return nil
+	}
+
+	var failures []error
+
+	select {
+	case session := <-t.sessions:
+		if err := t.pkcs11Ctx.Logout(session); err != nil {
+			failures = append(failures, pkcs11Error("Logout", err))
+		}
+	default:
+	}
+	if err := t.pkcs11Ctx.CloseAllSessions(t.slot); err != nil {
+		failures = append(failures, pkcs11Error("CloseAllSessions", err))
+	}
+	if err := t.pkcs11Ctx.Finalize(); err != nil {
+		failures = append(failures, pkcs11Error("Finalize", err))
+	}
+	t.pkcs11Ctx.Destroy()
+	t.pkcs11Ctx = nil
+	t.sessions = nil
+
+	return errors.Join(failures...)
+}
+
+// checkLabelFree rejects a label either half of a key pair already uses.
+func (t *Token) checkLabelFree(session pkcs11.SessionHandle, label string) error {
+	for _, class := range []uint{pkcs11.CKO_PRIVATE_KEY, pkcs11.CKO_PUBLIC_KEY} {
+		_, err := t.findKey(session, label, class)
+		switch {
+		case err == nil:
+			return errs.AlreadyExists(storage.ResourceKeyPair, label)
+		case !errors.Is(err, errs.KindNotFound):
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *Token) findKey(session pkcs11.SessionHandle, label string, class uint) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+	}
+	if err := t.pkcs11Ctx.FindObjectsInit(session, template); err != nil {
+		return 0, pkcs11Error("FindObjectsInit", err)
+	}
+	defer t.pkcs11Ctx.FindObjectsFinal(session)
+
+	objects, _, err := t.pkcs11Ctx.FindObjects(session, 1)
+	if err != nil {
+		return 0, pkcs11Error("FindObjects", err)
+	}
+	if len(objects) == 0 {
+		keyType := "public key"
+		switch class {
+		case pkcs11.CKO_PRIVATE_KEY:
+			keyType = "private key"
+		case pkcs11.CKO_SECRET_KEY:
+			keyType = storage.ResourceMasterKey
+		}
+		return 0, errs.NotFound(keyType, label)
+	}
+	return objects[0], nil
+}
+
+func (t *Token) algorithm(session pkcs11.SessionHandle, label string) (crypto.Algorithm, error) {
+	publicKey, err := t.publicKey(session, label)
+	if err != nil {
+		return "", err
+	}
+
+	algorithm, err := crypto.AlgorithmOf(publicKey)
+	if err != nil {
+		return "", errs.FailedPrecondition(fmt.Sprintf("key %q: %v", label, err))
+	}
+
+	return algorithm, nil
+}
@@ -0,0 +1,397 @@
+package hsm
+
+import (
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"fmt"
+	"github.com/miekg/pkcs11"
+	"math/big"
+	"tms/internal/domain/errs"
+	"tms/internal/services/crypto"
+)
+
+// PKCS#11 v3.0 Edwards-curve values, missing from miekg/pkcs11 v1.1.1.
+const (
+	ckkECEdwards           = 0x00000040
+	ckmECEdwardsKeyPairGen = 0x00001055
+	ckmEdDSA               = 0x00001057
+)
+
+var (
+	oidP256    = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidP384    = asn1.ObjectIdentifier{1, 3, 132, 0, 34}
+	oidEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+)
+
+// keyPairTemplates returns the generation mechanism and the public and
+// private key templates for algorithm.
+func keyPairTemplates(label string, algorithm crypto.Algorithm, extractable bool) (uint, []*pkcs11.Attribute, []*pkcs11.Attribute, error) {
+	var (
+		mechanism uint
+		keyType   uint
+		public    []*pkcs11.Attribute
+	)
+
+	switch {
+	case algorithm.RSABits() > 0:
+		mechanism, keyType = pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, pkcs11.CKK_RSA
+		public = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, algorithm.RSABits()),
+		}
+	case algorithm == crypto.AlgorithmECP256 || algorithm == crypto.AlgorithmECP384:
+		oid := oidP256
+		if algorithm == crypto.AlgorithmECP384 {
+			oid = oidP384
+		}
+		params, _ := asn1.Marshal(oid)
+		mechanism, keyType = pkcs11.CKM_EC_KEY_PAIR_GEN, pkcs11.CKK_EC
+		public = []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params)}
+	case algorithm == crypto.AlgorithmEd25519:
+		params, _ := asn1.Marshal(oidEd25519)
+		mechanism, keyType = ckmECEdwardsKeyPairGen, ckkECEdwards
+		public = []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params)}
+	default:
+		return 0, nil, nil, errs.InvalidField("algorithm", fmt.Sprintf("%s is not supported by the PKCS#11 backend", algorithm))
+	}
+
+	publicKeyTemplate := append([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, keyType),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}, public...)
+
+	return mechanism, publicKeyTemplate, privateKeyTemplate(label, keyType, extractable), nil
+}
+
+// privateKeyTemplate describes a signing key that never leaves the token in
+// the clear. An extractable key may still leave it wrapped, for backups. RSA
+// keys may also decrypt and EC keys derive, for crypto.Decrypt.
+func privateKeyTemplate(label string, keyType uint, extractable bool) []*pkcs11.Attribute {
+	return []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, keyType),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, extractable),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, keyType == pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_DERIVE, keyType == pkcs11.CKK_EC),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+}
+
+// sharedSecretTemplate describes the session object CKM_ECDH1_DERIVE writes
+// the shared secret to. It is read back once and destroyed.
+func sharedSecretTemplate(size int) []*pkcs11.Attribute {
+	return []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_GENERIC_SECRET),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, size),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+	}
+}
+
+// importTemplates returns the template of the public key object created
+// from publicKey and of the private key unwrapped next to it.
+func importTemplates(label string, publicKey gocrypto.PublicKey, extractable bool) ([]*pkcs11.Attribute, []*pkcs11.Attribute, error) {
+	var (
+		keyType uint
+		public  []*pkcs11.Attribute
+	)
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		keyType = pkcs11.CKK_RSA
+		public = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, key.N.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, big.NewInt(int64(key.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		oid := oidP256
+		if key.Curve == elliptic.P384() {
+			oid = oidP384
+		}
+		ecdhKey, err := key.ECDH()
+		if err != nil {
+			return nil, nil, errs.InvalidField("pem", err.Error())
+		}
+		params, _ := asn1.Marshal(oid)
+		point, _ := asn1.Marshal(ecdhKey.Bytes())
+		keyType = pkcs11.CKK_EC
+		public = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, point),
+		}
+	case ed25519.PublicKey:
+		params, _ := asn1.Marshal(oidEd25519)
+		point, _ := asn1.Marshal([]byte(key))
+		keyType = ckkECEdwards
+		public = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, point),
+		}
+	default:
+		return nil, nil, errs.InvalidField("pem", fmt.Sprintf("unsupported public key type %T", publicKey))
+	}
+
+	publicKeyTemplate := append([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, keyType),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}, public...)
+
+	return publicKeyTemplate, privateKeyTemplate(label, keyType, extractable), nil
+}
+
+// wrappingKeyTemplates describes the RSA key pair imported keys are wrapped
+// for. Its private half may unwrap but neither sign nor decrypt, so it
+// cannot be used to recover a wrapped AES key in the clear.
+func wrappingKeyTemplates(label string) ([]*pkcs11.Attribute, []*pkcs11.Attribute) {
+	public := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, false),
+		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, crypto.WrappingAlgorithm.RSABits()),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	private := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, false),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+
+	return public, private
+}
+
+// transportKeyTemplate describes the ephemeral AES key unwrapped with the
+// wrapping key. It lives in the session only and may only unwrap.
+func transportKeyTemplate() []*pkcs11.Attribute {
+	return []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, false),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, false),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, true),
+	}
+}
+
+// kekTemplate creates a backup key-encryption key as a session object. It
+// lives only as long as the session and may only wrap and unwrap.
+func kekTemplate(kek []byte) []*pkcs11.Attribute {
+	return []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, kek),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, false),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, false),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, true),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, true),
+	}
+}
+
+// masterKeyTemplate describes an AES-256 master key. It stays on the token
+// and may only wrap and unwrap data keys.
+func masterKeyTemplate(label string) []*pkcs11.Attribute {
+	return []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, 32),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, false),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, false),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, true),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+}
+
+// dataKeyTemplate describes a data key passing through the session on its
+// way to or from its wrapped form. Data keys are used outside the token, so
+// they are readable.
+func dataKeyTemplate() []*pkcs11.Attribute {
+	return []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, false),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, false),
+	}
+}
+
+// signatureInput returns the mechanism for scheme and what it is fed.
+// CKM_ECDSA is not a hashing mechanism, so EC keys get the digest.
+func signatureInput(scheme crypto.Scheme, data []byte) (*pkcs11.Mechanism, []byte) {
+	hash := hashMechanisms[scheme.Hash()]
+
+	switch {
+	case scheme == crypto.SchemeEd25519:
+		return pkcs11.NewMechanism(ckmEdDSA, nil), data
+	case scheme.ECDSA():
+		return pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil), scheme.Digest(data)
+	case scheme.PSS():
+		params := pkcs11.NewPSSParams(hash.digest, hash.mgf, uint(scheme.Hash().Size()))
+		return pkcs11.NewMechanism(hash.pss, params), data
+	default:
+		return pkcs11.NewMechanism(hash.pkcs1, nil), data
+	}
+}
+
+// digestInput returns the raw mechanism for scheme and what it is fed when
+// the digest was computed outside the token. CKM_RSA_PKCS gets the DER
+// DigestInfo the hashing CKM_SHA*_RSA_PKCS mechanisms build themselves, so
+// the signatures are the same.
+func digestInput(scheme crypto.Scheme, digest []byte) (*pkcs11.Mechanism, []byte) {
+	hash := hashMechanisms[scheme.Hash()]
+
+	switch {
+	case scheme.ECDSA():
+		return pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil), digest
+	case scheme.PSS():
+		params := pkcs11.NewPSSParams(hash.digest, hash.mgf, uint(scheme.Hash().Size()))
+		return pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, params), digest
+	default:
+		return pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil), append(append([]byte(nil), hash.digestInfo...), digest...)
+	}
+}
+
+// hashMechanisms maps a hash onto the PKCS#11 mechanisms built on it, and
+// onto the DigestInfo prefix of its digests.
+var hashMechanisms = map[gocrypto.Hash]struct {
+	digest, mgf, pkcs1, pss uint
+	digestInfo              []byte
+}{
+	gocrypto.SHA256: {
+		pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256, pkcs11.CKM_SHA256_RSA_PKCS, pkcs11.CKM_SHA256_RSA_PKCS_PSS,
+		[]byte{0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	},
+	gocrypto.SHA384: {
+		pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384, pkcs11.CKM_SHA384_RSA_PKCS, pkcs11.CKM_SHA384_RSA_PKCS_PSS,
+		[]byte{0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	},
+	gocrypto.SHA512: {
+		pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512, pkcs11.CKM_SHA512_RSA_PKCS, pkcs11.CKM_SHA512_RSA_PKCS_PSS,
+		[]byte{0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+	},
+}
+
+func (t *Token) publicKey(session pkcs11.SessionHandle, label string) (gocrypto.PublicKey, error) {
+	handle, err := t.findKey(session, label, pkcs11.CKO_PUBLIC_KEY)
+	if err != nil {
+		return nil, err
+	}
+
+	attributes, err := t.pkcs11Ctx.GetAttributeValue(session, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+	})
+	if err != nil {
+		return nil, pkcs11Error("GetAttributeValue", err)
+	}
+
+	switch keyType := bytesToUint(attributes[0].Value); keyType {
+	case pkcs11.CKK_RSA:
+		attributes, err := t.pkcs11Ctx.GetAttributeValue(session, handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return nil, pkcs11Error("GetAttributeValue", err)
+		}
+
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attributes[0].Value),
+			E: int(new(big.Int).SetBytes(attributes[1].Value).Int64()),
+		}, nil
+	case pkcs11.CKK_EC, ckkECEdwards:
+		attributes, err := t.pkcs11Ctx.GetAttributeValue(session, handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		if err != nil {
+			return nil, pkcs11Error("GetAttributeValue", err)
+		}
+
+		return ecPublicKey(attributes[0].Value, attributes[1].Value)
+	default:
+		return nil, errs.FailedPrecondition(fmt.Sprintf("key %q has unsupported key type %#x", label, keyType))
+	}
+}
+
+// ecPublicKey decodes CKA_EC_PARAMS and CKA_EC_POINT. The point is a DER
+// OCTET STRING, though some tokens return it bare.
+func ecPublicKey(params []byte, point []byte) (gocrypto.PublicKey, error) {
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(params, &oid); err != nil {
+		return nil, fmt.Errorf("failed to parse CKA_EC_PARAMS: %w", err)
+	}
+
+	var raw []byte
+	if rest, err := asn1.Unmarshal(point, &raw); err != nil || len(rest) > 0 {
+		raw = point
+	}
+
+	var curve elliptic.Curve
+	switch {
+	case oid.Equal(oidP256):
+		curve = elliptic.P256()
+	case oid.Equal(oidP384):
+		curve = elliptic.P384()
+	case oid.Equal(oidEd25519):
+		if len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 point length %d", len(raw))
+		}
+		return ed25519.PublicKey(raw), nil
+	default:
+		return nil, fmt.Errorf("unsupported curve %s", oid)
+	}
+
+	x, y := elliptic.Unmarshal(curve, raw)
+	if x == nil {
+		return nil, fmt.Errorf("invalid %s point", curve.Params().Name)
+	}
+
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// bytesToUint decodes a CK_ULONG attribute in native (little-endian) order.
+func bytesToUint(value []byte) uint {
+	var n uint
+	for i := len(value) - 1; i >= 0; i-- {
+		n = n<<8 | uint(value[i])
+	}
+
+	return n
+}
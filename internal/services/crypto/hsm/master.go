@@ -0,0 +1,105 @@
+package hsm
+
+import (
+	"context"
+	"errors"
+	"github.com/miekg/pkcs11"
+	"tms/internal/domain/errs"
+	"tms/internal/storage"
+)
+
+func (t *Token) GenerateMasterKey(ctx context.Context, label string) error {
+	return t.withSession(ctx, func(session pkcs11.SessionHandle) error {
+		_, err := t.findKey(session, label, pkcs11.CKO_SECRET_KEY)
+		switch {
+		case err == nil:
+			return errs.AlreadyExists(storage.ResourceMasterKey, label)
+		case !errors.Is(err, errs.KindNotFound):
+			return err
+		}
+
+		mechanism := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_GEN, nil)}
+		if _, err := t.pkcs11Ctx.GenerateKey(session, mechanism, masterKeyTemplate(label)); err != nil {
+			return pkcs11Error("GenerateKey", err)
+		}
+
+		return nil
+	})
+}
+
+// WrapDataKey loads dataKey into the session and wraps it with
+// CKM_AES_KEY_WRAP_PAD.
+func (t *Token) WrapDataKey(ctx context.Context, label string, dataKey []byte) ([]byte, error) {
+	var wrapped []byte
+
+	err := t.withRetry(ctx, func(session pkcs11.SessionHandle) error {
+		masterKeyHandle, err := t.findKey(session, label, pkcs11.CKO_SECRET_KEY)
+		if err != nil {
+			return err
+		}
+
+		template := append(dataKeyTemplate(), pkcs11.NewAttribute(pkcs11.CKA_VALUE, dataKey))
+		dataKeyHandle, err := t.pkcs11Ctx.CreateObject(session, template)
+		if err != nil {
+			return pkcs11Error("CreateObject", err)
+		}
+		defer t.pkcs11Ctx.DestroyObject(session, dataKeyHandle)
+
+		wrapped, err = t.pkcs11Ctx.WrapKey(session,
+			[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_WRAP_PAD, nil)},
+			masterKeyHandle, dataKeyHandle)
+		if err != nil {
+			return pkcs11Error("WrapKey", err)
+		}
+
+		return nil
+	})
+
+	return wrapped, err
+}
+
+// UnwrapDataKey unwraps into a session object and reads its value.
+func (t *Token) UnwrapDataKey(ctx context.Context, label string, wrapped []byte) ([]byte, error) {
+	var dataKey []byte
+
+	err := t.withRetry(ctx, func(session pkcs11.SessionHandle) error {
+		masterKeyHandle, err := t.findKey(session, label, pkcs11.CKO_SECRET_KEY)
+		if err != nil {
+			return err
+		}
+
+		dataKeyHandle, err := t.pkcs11Ctx.UnwrapKey(session,
+			[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_WRAP_PAD, nil)},
+			masterKeyHandle, wrapped, dataKeyTemplate())
+		if err != nil {
+			return unwrapError("the data key cannot be unwrapped with this master key", err)
+		}
+		defer t.pkcs11Ctx.DestroyObject(session, dataKeyHandle)
+
+		attributes, err := t.pkcs11Ctx.GetAttributeValue(session, dataKeyHandle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+		})
+		if err != nil {
+			return pkcs11Error("GetAttributeValue", err)
+		}
+		dataKey = attributes[0].Value
+		return nil
+	})
+
+	return dataKey, err
+}
+
+func (t *Token) DeleteMasterKey(ctx context.Context, label string) error {
+	return t.withSession(ctx, func(session pkcs11.SessionHandle) error {
+		handle, err := t.findKey(session, label, pkcs11.CKO_SECRET_KEY)
+		if err != nil {
+			return err
+		}
+
+		if err := t.pkcs11Ctx.DestroyObject(session, handle); err != nil {
+			return pkcs11Error("DestroyObject", err)
+		}
+
+		return nil
+	})
+}
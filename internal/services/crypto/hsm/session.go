@@ -0,0 +1,227 @@
+package hsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/pkcs11"
+	"golang.org/x/exp/slog"
+	"time"
+	"tms/internal/domain/errs"
+)
+
+// Stats counts recovery events since the token was opened.
+type Stats struct {
+	Recoveries       uint64
+	FailedRecoveries uint64
+	Retries          uint64
+	LastRecovery     time.Time
+}
+
+// Stats returns the recovery counters.
+func (t *Token) Stats() Stats {
+	stats := Stats{
+		Recoveries:       t.recoveries.Load(),
+		FailedRecoveries: t.failedRecoveries.Load(),
+		Retries:          t.retries.Load(),
+	}
+	if last := t.lastRecovery.Load(); last != 0 {
+		stats.LastRecovery = time.Unix(0, last)
+	}
+
+	return stats
+}
+
+// open initializes the library, finds the token and fills the session pool.
+// The caller holds mu for writing.
+func (t *Token) open() error {
+	t.pkcs11Ctx = pkcs11.New(t.opts.LibPath)
+	if t.pkcs11Ctx == nil {
+		return errs.Unavailable(nil, fmt.Sprintf("cannot load PKCS#11 library %s", t.opts.LibPath))
+	}
+	if err := t.pkcs11Ctx.Initialize(); err != nil {
+		return pkcs11Error("Initialize", err)
+	}
+
+	slot, err := t.findSlot()
+	if err != nil {
+		return err
+	}
+	t.slot = slot
+
+	// Open the session pool. Login state is shared by every session of the
+	// application, so only the first login is expected to succeed.
+	t.sessions = make(chan pkcs11.SessionHandle, t.opts.PoolSize)
+	for i := 0; i < t.opts.PoolSize; i++ {
+		session, err := t.pkcs11Ctx.OpenSession(t.slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if err != nil {
+			return pkcs11Error("OpenSession", err)
+		}
+
+		err = t.pkcs11Ctx.Login(session, pkcs11.CKU_USER, t.opts.Pin)
+		if err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+			return pkcs11Error("Login", err)
+		}
+
+		t.sessions <- session
+	}
+
+	t.generation++
+
+	return nil
+}
+
+// findSlot returns the slot holding the token labelled TokenLabel. A missing
+// token is an error: falling back to another slot would sign with other keys.
+func (t *Token) findSlot() (uint, error) {
+	slots, err := t.pkcs11Ctx.GetSlotList(true)
+	if err != nil {
+		return 0, pkcs11Error("GetSlotList", err)
+	}
+
+	for _, slot := range slots {
+		tokenInfo, err := t.pkcs11Ctx.GetTokenInfo(slot)
+		if err == nil && tokenInfo.Label == t.opts.TokenLabel {
+			return slot, nil
+		}
+	}
+
+	return 0, errs.Unavailable(nil, fmt.Sprintf("no token labelled %q in %d slots", t.opts.TokenLabel, len(slots)))
+}
+
+// teardown releases the current context without reporting errors: it runs
+// when the token is already broken. The caller holds mu for writing.
+func (t *Token) teardown() {
+	if t.pkcs11Ctx == nil {
+		return
+	}
+
+	_ = t.pkcs11Ctx.CloseAllSessions(t.slot)
+	_ = t.pkcs11Ctx.Finalize()
+	t.pkcs11Ctx.Destroy()
+	t.pkcs11Ctx = nil
+	t.sessions = nil
+}
+
+// withSession runs fn once with a session checked out of the pool. A session
+// failure triggers recovery so that the next call succeeds, but fn is not
+// retried: use it for operations that are not safe to repeat.
+func (t *Token) withSession(ctx context.Context, fn func(session pkcs11.SessionHandle) error) error {
+	return t.do(ctx, 1, fn)
+}
+
+// withRetry is withSession for idempotent operations: after a recovery fn is
+// tried again, up to RetryAttempts times in total, with exponential backoff.
+func (t *Token) withRetry(ctx context.Context, fn func(session pkcs11.SessionHandle) error) error {
+	return t.do(ctx, t.opts.RetryAttempts, fn)
+}
+
+// do bounds the whole operation, retries included, by ctx and OperationTimeout.
+func (t *Token) do(ctx context.Context, attempts int, fn func(session pkcs11.SessionHandle) error) error {
+	if t.opts.OperationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.opts.OperationTimeout)
+		defer cancel()
+	}
+
+	backoff := t.opts.RetryBackoff
+
+	for attempt := 1; ; attempt++ {
+		generation, err := t.attempt(ctx, fn)
+		if err == nil || !sessionFailure(err) {
+			return err
+		}
+
+		t.reinitialize(generation, err)
+
+		if attempt >= attempts {
+			return err
+		}
+
+		t.retries.Add(1)
+		t.log.Warn("retrying HSM operation", slog.Int("attempt", attempt+1), slog.Any("error", err))
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return errs.Unavailable(ctx.Err(), "HSM operation timed out")
+		}
+		backoff *= 2
+	}
+}
+
+// attempt runs fn once. A PKCS#11 call cannot be interrupted, so on timeout
+// the session is returned to the pool once the call finishes on its own.
+func (t *Token) attempt(ctx context.Context, fn func(session pkcs11.SessionHandle) error) (uint64, error) {
+	type result struct {
+		generation uint64
+		err        error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		generation, err := t.run(ctx, fn)
+		done <- result{generation: generation, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.generation, r.err
+	case <-ctx.Done():
+		return 0, errs.Unavailable(ctx.Err(), "HSM operation timed out")
+	}
+}
+
+func (t *Token) run(ctx context.Context, fn func(session pkcs11.SessionHandle) error) (uint64, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.closed {
+		return t.generation, errs.Unavailable(nil, "HSM token is closed")
+	}
+	if t.pkcs11Ctx == nil {
+		// A previous recovery failed; report it as a session failure so
+		// that the next call tries again.
+		return t.generation, errs.Unavailable(pkcs11.Error(pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED), "HSM unavailable")
+	}
+
+	select {
+	case session := <-t.sessions:
+		defer func() { t.sessions <- session }()
+
+		// The caller may have given up while we waited for the session.
+		if err := ctx.Err(); err != nil {
+			return t.generation, err
+		}
+
+		return t.generation, fn(session)
+	case <-ctx.Done():
+		return t.generation, ctx.Err()
+	}
+}
+
+// reinitialize reinitializes the library after a session failure seen in
+// generation. Concurrent callers that saw the same failure recover once:
+// whoever gets the lock first bumps the generation, the rest return.
+func (t *Token) reinitialize(generation uint64, cause error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed || t.generation != generation {
+		return
+	}
+
+	t.log.Warn("HSM session failed, reinitializing", slog.Any("error", cause))
+
+	t.teardown()
+	if err := t.open(); err != nil {
+		t.teardown()
+		t.failedRecoveries.Add(1)
+		t.log.Error("HSM recovery failed", slog.String("token", t.opts.TokenLabel), slog.Any("error", err))
+		return
+	}
+
+	t.recoveries.Add(1)
+	t.lastRecovery.Store(time.Now().UnixNano())
+	t.log.Info("HSM session recovered", slog.String("token", t.opts.TokenLabel), slog.Uint64("recoveries", t.recoveries.Load()))
+}
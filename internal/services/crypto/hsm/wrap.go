@@ -0,0 +1,229 @@
+package hsm
+
+import (
+	"context"
+	gocrypto "crypto"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"github.com/miekg/pkcs11"
+	"tms/internal/domain/errs"
+	"tms/internal/services/crypto"
+)
+
+// WrappingKey returns the wrapping key labelled label, generating it when
+// the token has none. Generation is serialized so concurrent first calls do
+// not create two key pairs under the same label.
+func (t *Token) WrappingKey(ctx context.Context, label string) (*rsa.PublicKey, error) {
+	t.wrappingMu.Lock()
+	defer t.wrappingMu.Unlock()
+
+	var publicKey *rsa.PublicKey
+
+	err := t.withSession(ctx, func(session pkcs11.SessionHandle) error {
+		key, err := t.publicKey(session, label)
+		if err == nil {
+			rsaKey, ok := key.(*rsa.PublicKey)
+			if !ok {
+				return errs.FailedPrecondition(fmt.Sprintf("key %q is not a wrapping key", label))
+			}
+			publicKey = rsaKey
+			return nil
+		}
+		if !errors.Is(err, errs.KindNotFound) {
+			return err
+		}
+
+		publicKeyTemplate, privateKeyTemplate := wrappingKeyTemplates(label)
+		mechanism := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)}
+		if _, _, err := t.pkcs11Ctx.GenerateKeyPair(session, mechanism, publicKeyTemplate, privateKeyTemplate); err != nil {
+			return pkcs11Error("GenerateKeyPair", err)
+		}
+
+		key, err = t.publicKey(session, label)
+		if err != nil {
+			return err
+		}
+		publicKey = key.(*rsa.PublicKey)
+		return nil
+	})
+
+	return publicKey, err
+}
+
+// ImportKeyPair unwraps the transport AES key with CKM_RSA_PKCS_OAEP into a
+// session object, then the private key with it. Imported keys are never
+// extractable: their owner keeps the original.
+func (t *Token) ImportKeyPair(
+	ctx context.Context,
+	label string,
+	wrappingLabel string,
+	wrapped []byte,
+	publicKey gocrypto.PublicKey,
+) (crypto.KeyInfo, error) {
+	algorithm, err := crypto.AlgorithmOf(publicKey)
+	if err != nil {
+		return crypto.KeyInfo{}, errs.InvalidField("pem", err.Error())
+	}
+
+	publicKeyTemplate, privateKeyTemplate, err := importTemplates(label, publicKey, false)
+	if err != nil {
+		return crypto.KeyInfo{}, err
+	}
+
+	err = t.withSession(ctx, func(session pkcs11.SessionHandle) error {
+		if err := t.checkLabelFree(session, label); err != nil {
+			return err
+		}
+
+		wrappingKey, err := t.publicKey(session, wrappingLabel)
+		if err != nil {
+			return err
+		}
+		wrappingRSAKey, ok := wrappingKey.(*rsa.PublicKey)
+		if !ok {
+			return errs.FailedPrecondition(fmt.Sprintf("key %q is not a wrapping key", wrappingLabel))
+		}
+		unwrappingKeyHandle, err := t.findKey(session, wrappingLabel, pkcs11.CKO_PRIVATE_KEY)
+		if err != nil {
+			return err
+		}
+
+		encryptedKey, wrappedKey, err := crypto.SplitWrappedKey(wrappingRSAKey, wrapped)
+		if err != nil {
+			return err
+		}
+
+		oaep := pkcs11.NewOAEPParams(pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256, pkcs11.CKZ_DATA_SPECIFIED, nil)
+		transportKeyHandle, err := t.pkcs11Ctx.UnwrapKey(session,
+			[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, oaep)},
+			unwrappingKeyHandle, encryptedKey, transportKeyTemplate())
+		if err != nil {
+			return unwrapError("the AES key cannot be decrypted with the wrapping key", err)
+		}
+		defer t.pkcs11Ctx.DestroyObject(session, transportKeyHandle)
+
+		return t.unwrapKeyPair(session, transportKeyHandle, wrappedKey, publicKeyTemplate, privateKeyTemplate)
+	})
+	if err != nil {
+		return crypto.KeyInfo{}, err
+	}
+
+	return crypto.KeyInfo{Label: label, Algorithm: algorithm}, nil
+}
+
+// ExportKeyPair wraps the private key with CKM_AES_KEY_WRAP_PAD under kek,
+// which is loaded into the session for the call only.
+func (t *Token) ExportKeyPair(ctx context.Context, label string, kek []byte) ([]byte, gocrypto.PublicKey, error) {
+	var (
+		wrapped   []byte
+		publicKey gocrypto.PublicKey
+	)
+
+	err := t.withRetry(ctx, func(session pkcs11.SessionHandle) error {
+		var err error
+		publicKey, err = t.publicKey(session, label)
+		if err != nil {
+			return err
+		}
+
+		privateKeyHandle, err := t.findKey(session, label, pkcs11.CKO_PRIVATE_KEY)
+		if err != nil {
+			return err
+		}
+
+		attributes, err := t.pkcs11Ctx.GetAttributeValue(session, privateKeyHandle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, nil),
+		})
+		if err != nil {
+			return pkcs11Error("GetAttributeValue", err)
+		}
+		if value := attributes[0].Value; len(value) != 1 || value[0] == 0 {
+			return errs.FailedPrecondition(fmt.Sprintf("key %q is not extractable", label))
+		}
+
+		kekHandle, err := t.pkcs11Ctx.CreateObject(session, kekTemplate(kek))
+		if err != nil {
+			return pkcs11Error("CreateObject", err)
+		}
+		defer t.pkcs11Ctx.DestroyObject(session, kekHandle)
+
+		wrapped, err = t.pkcs11Ctx.WrapKey(session,
+			[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_WRAP_PAD, nil)},
+			kekHandle, privateKeyHandle)
+		if err != nil {
+			return pkcs11Error("WrapKey", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return wrapped, publicKey, nil
+}
+
+// RestoreKeyPair unwraps a backed up key under kek. The restored key is
+// extractable again only if Options.Extractable is set.
+func (t *Token) RestoreKeyPair(
+	ctx context.Context,
+	label string,
+	kek []byte,
+	wrapped []byte,
+	publicKey gocrypto.PublicKey,
+) (crypto.KeyInfo, error) {
+	algorithm, err := crypto.AlgorithmOf(publicKey)
+	if err != nil {
+		return crypto.KeyInfo{}, errs.InvalidField("pem", err.Error())
+	}
+
+	publicKeyTemplate, privateKeyTemplate, err := importTemplates(label, publicKey, t.opts.Extractable)
+	if err != nil {
+		return crypto.KeyInfo{}, err
+	}
+
+	err = t.withSession(ctx, func(session pkcs11.SessionHandle) error {
+		if err := t.checkLabelFree(session, label); err != nil {
+			return err
+		}
+
+		kekHandle, err := t.pkcs11Ctx.CreateObject(session, kekTemplate(kek))
+		if err != nil {
+			return pkcs11Error("CreateObject", err)
+		}
+		defer t.pkcs11Ctx.DestroyObject(session, kekHandle)
+
+		return t.unwrapKeyPair(session, kekHandle, wrapped, publicKeyTemplate, privateKeyTemplate)
+	})
+	if err != nil {
+		return crypto.KeyInfo{}, err
+	}
+
+	return crypto.KeyInfo{Label: label, Algorithm: algorithm}, nil
+}
+
+// unwrapKeyPair unwraps wrappedKey with CKM_AES_KEY_WRAP_PAD straight into
+// a sensitive token object and creates the public key object next to it.
+// The private key is never in the clear outside the token.
+func (t *Token) unwrapKeyPair(
+	session pkcs11.SessionHandle,
+	unwrappingKeyHandle pkcs11.ObjectHandle,
+	wrappedKey []byte,
+	publicKeyTemplate []*pkcs11.Attribute,
+	privateKeyTemplate []*pkcs11.Attribute,
+) error {
+	privateKeyHandle, err := t.pkcs11Ctx.UnwrapKey(session,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_WRAP_PAD, nil)},
+		unwrappingKeyHandle, wrappedKey, privateKeyTemplate)
+	if err != nil {
+		return unwrapError("the private key cannot be unwrapped", err)
+	}
+
+	if _, err := t.pkcs11Ctx.CreateObject(session, publicKeyTemplate); err != nil {
+		_ = t.pkcs11Ctx.DestroyObject(session, privateKeyHandle)
+		return pkcs11Error("CreateObject", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package crypto
+
+import (
+	"bytes"
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"tms/internal/domain/errs"
+)
+
+// Verify checks a signature made with scheme against a public key held
+// outside any backend. Signatures use the encodings the backends produce:
+// ECDSA signatures are the fixed-size r||s pair.
+func Verify(publicKey gocrypto.PublicKey, scheme Scheme, data []byte, signature []byte) (bool, error) {
+	if key, ok := publicKey.(ed25519.PublicKey); ok {
+		algorithm, err := AlgorithmOf(publicKey)
+		if err != nil {
+			return false, err
+		}
+		if err := CheckScheme(algorithm, scheme); err != nil {
+			return false, err
+		}
+		return ed25519.Verify(key, data, signature), nil
+	}
+
+	return VerifyDigest(publicKey, scheme, scheme.Digest(data), signature)
+}
+
+// VerifyDigest is Verify for a digest computed with scheme.Hash(). Digests
+// CheckDigest rejects are refused.
+func VerifyDigest(publicKey gocrypto.PublicKey, scheme Scheme, digest []byte, signature []byte) (bool, error) {
+	algorithm, err := AlgorithmOf(publicKey)
+	if err != nil {
+		return false, err
+	}
+	if err := CheckScheme(algorithm, scheme); err != nil {
+		return false, err
+	}
+	if err := CheckDigest(scheme, digest); err != nil {
+		return false, err
+	}
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		if scheme.PSS() {
+			return rsa.VerifyPSS(key, scheme.Hash(), digest, signature, scheme.PSSOptions()) == nil, nil
+		}
+		return rsa.VerifyPKCS1v15(key, scheme.Hash(), digest, signature) == nil, nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false, nil
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s), nil
+	default:
+		return false, fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+}
+
+// ParsePublicKeyPEM reads a PEM encoded SubjectPublicKeyInfo ("PUBLIC
+// KEY"), PKCS#1 RSA public key ("RSA PUBLIC KEY") or X.509 certificate
+// ("CERTIFICATE"). The certificate is returned too when there was one.
+func ParsePublicKeyPEM(data []byte) (gocrypto.PublicKey, *x509.Certificate, error) {
+	block, rest := pem.Decode(data)
+	if block == nil {
+		return nil, nil, errs.InvalidField("pem", "no PEM block found")
+	}
+	if len(bytes.TrimSpace(rest)) != 0 {
+		return nil, nil, errs.InvalidField("pem", "must contain a single PEM block")
+	}
+
+	var (
+		publicKey   gocrypto.PublicKey
+		certificate *x509.Certificate
+		err         error
+	)
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		publicKey, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		publicKey, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		certificate, err = x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			publicKey = certificate.PublicKey
+		}
+	default:
+		return nil, nil, errs.InvalidField("pem", fmt.Sprintf("unsupported PEM block %q", block.Type))
+	}
+	if err != nil {
+		return nil, nil, errs.InvalidField("pem", err.Error())
+	}
+
+	if _, err := AlgorithmOf(publicKey); err != nil {
+		return nil, nil, errs.InvalidField("pem", err.Error())
+	}
+
+	return publicKey, certificate, nil
+}
+
+// Fingerprint is the hex SHA-256 of the SubjectPublicKeyInfo of a public key.
+func Fingerprint(publicKey gocrypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(der)
+
+	return hex.EncodeToString(sum[:]), nil
+}
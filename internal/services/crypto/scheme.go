@@ -0,0 +1,157 @@
+package crypto
+
+import (
+	gocrypto "crypto"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"fmt"
+	"strings"
+	"tms/internal/domain/errs"
+)
+
+// Scheme names a signature scheme: padding and hash for RSA, the hash for
+// ECDSA, or PureEdDSA.
+type Scheme string
+
+const (
+	SchemeRSAPKCS1SHA256 Scheme = "RSA_PKCS1_SHA256"
+	SchemeRSAPKCS1SHA384 Scheme = "RSA_PKCS1_SHA384"
+	SchemeRSAPKCS1SHA512 Scheme = "RSA_PKCS1_SHA512"
+	SchemeRSAPSSSHA256   Scheme = "RSA_PSS_SHA256"
+	SchemeRSAPSSSHA384   Scheme = "RSA_PSS_SHA384"
+	SchemeRSAPSSSHA512   Scheme = "RSA_PSS_SHA512"
+	SchemeECDSASHA256    Scheme = "ECDSA_SHA256"
+	SchemeECDSASHA384    Scheme = "ECDSA_SHA384"
+	SchemeECDSASHA512    Scheme = "ECDSA_SHA512"
+	SchemeEd25519        Scheme = "ED25519"
+)
+
+// LegacyScheme produced every signature made before schemes were recorded.
+const LegacyScheme = SchemeRSAPKCS1SHA256
+
+var schemes = []Scheme{
+	SchemeRSAPKCS1SHA256, SchemeRSAPKCS1SHA384, SchemeRSAPKCS1SHA512,
+	SchemeRSAPSSSHA256, SchemeRSAPSSSHA384, SchemeRSAPSSSHA512,
+	SchemeECDSASHA256, SchemeECDSASHA384, SchemeECDSASHA512,
+	SchemeEd25519,
+}
+
+// ParseScheme accepts a scheme name in any case. An empty name returns "",
+// meaning "the key's default".
+func ParseScheme(name string) (Scheme, error) {
+	if name == "" {
+		return "", nil
+	}
+
+	for _, scheme := range schemes {
+		if strings.EqualFold(name, string(scheme)) {
+			return scheme, nil
+		}
+	}
+
+	return "", errs.InvalidField("scheme", fmt.Sprintf("unknown signature scheme %q", name))
+}
+
+// DefaultScheme is the scheme a new key signs with unless told otherwise.
+func DefaultScheme(algorithm Algorithm) Scheme {
+	switch {
+	case algorithm == AlgorithmEd25519:
+		return SchemeEd25519
+	case algorithm == AlgorithmECP384:
+		return SchemeECDSASHA384
+	case algorithm.Curve() != nil:
+		return SchemeECDSASHA256
+	default:
+		return SchemeRSAPKCS1SHA256
+	}
+}
+
+// StoredScheme reads the scheme kept in key metadata. Keys created before
+// the scheme was recorded sign with the default of their algorithm.
+func StoredScheme(algorithm string, scheme string) Scheme {
+	if scheme == "" {
+		return DefaultScheme(StoredAlgorithm(algorithm))
+	}
+
+	return Scheme(scheme)
+}
+
+// Hash returns the digest the scheme signs, or 0 for Ed25519, which signs
+// the message itself.
+func (s Scheme) Hash() gocrypto.Hash {
+	switch {
+	case s == SchemeEd25519:
+		return 0
+	case strings.HasSuffix(string(s), "SHA384"):
+		return gocrypto.SHA384
+	case strings.HasSuffix(string(s), "SHA512"):
+		return gocrypto.SHA512
+	default:
+		return gocrypto.SHA256
+	}
+}
+
+// Digest hashes data with the hash of the scheme. Ed25519 signs the message
+// itself, so it gets data back.
+func (s Scheme) Digest(data []byte) []byte {
+	if s.Hash() == 0 {
+		return data
+	}
+
+	h := s.Hash().New()
+	h.Write(data)
+
+	return h.Sum(nil)
+}
+
+// PSS reports whether the scheme is RSASSA-PSS. PSS signatures use MGF1 with
+// the same hash and a salt as long as the digest.
+func (s Scheme) PSS() bool {
+	return strings.HasPrefix(string(s), "RSA_PSS_")
+}
+
+// PSSOptions matches CK_RSA_PKCS_PSS_PARAMS as the PKCS#11 backend sets
+// them: MGF1 with the signing hash and a salt as long as the digest.
+func (s Scheme) PSSOptions() *rsa.PSSOptions {
+	return &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: s.Hash()}
+}
+
+// ECDSA reports whether the scheme is ECDSA over a digest.
+func (s Scheme) ECDSA() bool {
+	return strings.HasPrefix(string(s), "ECDSA_")
+}
+
+// CheckScheme rejects a scheme that cannot be used with keys of algorithm.
+func CheckScheme(algorithm Algorithm, scheme Scheme) error {
+	var ok bool
+
+	switch {
+	case algorithm.RSABits() > 0:
+		ok = strings.HasPrefix(string(scheme), "RSA_")
+	case algorithm.Curve() != nil:
+		ok = scheme.ECDSA()
+	case algorithm == AlgorithmEd25519:
+		ok = scheme == SchemeEd25519
+	}
+
+	if !ok {
+		return errs.InvalidField("scheme", fmt.Sprintf("%s cannot be used with %s keys", scheme, algorithm))
+	}
+
+	return nil
+}
+
+// CheckDigest rejects a digest that cannot be signed with scheme: it must be
+// as long as the hash of the scheme, and Ed25519 signs the message itself,
+// so it has no digest form.
+func CheckDigest(scheme Scheme, digest []byte) error {
+	if scheme.Hash() == 0 {
+		return errs.FailedPrecondition(fmt.Sprintf("%s signs the message itself, not a digest", scheme))
+	}
+	if len(digest) != scheme.Hash().Size() {
+		return errs.InvalidField("digest", fmt.Sprintf("must be %d bytes for %s", scheme.Hash().Size(), scheme))
+	}
+
+	return nil
+}
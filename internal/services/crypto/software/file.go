@@ -0,0 +1,215 @@
+package software
+
+import (
+	gocrypto "crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"os"
+	"path/filepath"
+	"tms/internal/services/crypto"
+)
+
+const keystoreVersion = 1
+
+// scrypt parameters for new keystores; existing files keep their own.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// keystoreFile is the on-disk form: the PKCS#8 keys, sealed with AES-256-GCM
+// under a key derived from the passphrase with scrypt.
+type keystoreFile struct {
+	path   string
+	header header
+	aead   cipher.AEAD
+}
+
+type header struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	Salt    []byte `json:"salt"`
+	N       int    `json:"n"`
+	R       int    `json:"r"`
+	P       int    `json:"p"`
+}
+
+type sealed struct {
+	header
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+type plainKey struct {
+	Label      string           `json:"label"`
+	Algorithm  crypto.Algorithm `json:"algorithm,omitempty"`
+	PrivateKey []byte           `json:"private_key,omitempty"`
+	Usage      string           `json:"usage,omitempty"`
+	// MasterKey holds the value of a master key instead of a private key.
+	MasterKey []byte `json:"master_key,omitempty"`
+}
+
+func openKeystoreFile(path string, passphrase string) (*keystoreFile, map[string]entry, map[string][]byte, error) {
+	if passphrase == "" {
+		return nil, nil, nil, errors.New("a passphrase is required for a keystore file")
+	}
+
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, nil, nil, err
+		}
+
+		file, err := newKeystoreFile(path, passphrase, header{
+			Version: keystoreVersion,
+			KDF:     "scrypt",
+			Salt:    salt,
+			N:       scryptN,
+			R:       scryptR,
+			P:       scryptP,
+		})
+		return file, make(map[string]entry), make(map[string][]byte), err
+	}
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read keystore: %w", err)
+	}
+
+	var s sealed
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to parse keystore: %w", err)
+	}
+	if s.Version != keystoreVersion || s.KDF != "scrypt" {
+		return nil, nil, nil, fmt.Errorf("unsupported keystore version %d (%s)", s.Version, s.KDF)
+	}
+
+	file, err := newKeystoreFile(path, passphrase, s.header)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	plaintext, err := file.aead.Open(nil, s.Nonce, s.Ciphertext, file.additionalData())
+	if err != nil {
+		return nil, nil, nil, errors.New("failed to decrypt keystore: wrong passphrase or corrupted file")
+	}
+
+	var plain []plainKey
+	if err := json.Unmarshal(plaintext, &plain); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to parse keystore keys: %w", err)
+	}
+
+	keys := make(map[string]entry, len(plain))
+	masterKeys := make(map[string][]byte)
+	for _, k := range plain {
+		if k.MasterKey != nil {
+			masterKeys[k.Label] = k.MasterKey
+			continue
+		}
+
+		key, err := x509.ParsePKCS8PrivateKey(k.PrivateKey)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to parse key %q: %w", k.Label, err)
+		}
+
+		signer, ok := key.(gocrypto.Signer)
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("key %q has unsupported type %T", k.Label, key)
+		}
+
+		keys[k.Label] = entry{algorithm: k.Algorithm, key: signer, usage: k.Usage}
+	}
+
+	return file, keys, masterKeys, nil
+}
+
+func newKeystoreFile(path string, passphrase string, h header) (*keystoreFile, error) {
+	key, err := scrypt.Key([]byte(passphrase), h.Salt, h.N, h.R, h.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive keystore key: %w", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &keystoreFile{path: path, header: h, aead: aead}, nil
+}
+
+// additionalData binds the ciphertext to the header, so the KDF parameters
+// cannot be swapped without failing decryption.
+func (f *keystoreFile) additionalData() []byte {
+	ad, _ := json.Marshal(f.header)
+
+	return ad
+}
+
+// write seals keys and atomically replaces the keystore file.
+func (f *keystoreFile) write(keys map[string]entry, masterKeys map[string][]byte) error {
+	plain := make([]plainKey, 0, len(keys)+len(masterKeys))
+	for label, e := range keys {
+		der, err := x509.MarshalPKCS8PrivateKey(e.key)
+		if err != nil {
+			return fmt.Errorf("failed to encode key %q: %w", label, err)
+		}
+		plain = append(plain, plainKey{Label: label, Algorithm: e.algorithm, PrivateKey: der, Usage: e.usage})
+	}
+	for label, key := range masterKeys {
+		plain = append(plain, plainKey{Label: label, MasterKey: key})
+	}
+
+	plaintext, err := json.Marshal(plain)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, f.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	raw, err := json.MarshalIndent(sealed{
+		header:     f.header,
+		Nonce:      nonce,
+		Ciphertext: f.aead.Seal(nil, nonce, plaintext, f.additionalData()),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write keystore: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(raw); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write keystore: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write keystore: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write keystore: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("failed to write keystore: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,500 @@
+// Package software keeps keys in process memory, optionally persisted to a
+// passphrase-encrypted file. It needs no HSM and is meant for development and
+// tests; signatures are byte-compatible with the PKCS#11 backend.
+package software
+
+import (
+	"context"
+	gocrypto "crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"math/big"
+	"sync"
+	"tms/internal/domain/errs"
+	"tms/internal/lib/keywrap"
+	"tms/internal/services/crypto"
+	"tms/internal/storage"
+)
+
+type Options struct {
+	// Path is the encrypted keystore file. Empty keeps keys in memory only,
+	// so they are lost on restart.
+	Path       string
+	Passphrase string
+}
+
+// Store is an in-memory crypto.KeyManager.
+type Store struct {
+	log  *slog.Logger
+	file *keystoreFile
+
+	mu         sync.RWMutex
+	keys       map[string]entry
+	masterKeys map[string][]byte
+}
+
+type entry struct {
+	algorithm crypto.Algorithm
+	key       gocrypto.Signer
+	// usage is usageUnwrap for wrapping keys, which may not sign.
+	usage string
+}
+
+const usageUnwrap = "unwrap"
+
+var _ crypto.KeyManager = (*Store)(nil)
+
+// New opens the keystore at opts.Path, creating it on the first write, or
+// an empty in-memory store when no path is given.
+func New(log *slog.Logger, opts Options) (*Store, error) {
+	const op = "services.crypto.software.New"
+
+	s := &Store{
+		log:        log.With(slog.String("component", "software-keystore")),
+		keys:       make(map[string]entry),
+		masterKeys: make(map[string][]byte),
+	}
+
+	if opts.Path == "" {
+		s.log.Warn("software keystore is in memory only, keys are lost on restart")
+		return s, nil
+	}
+
+	file, keys, masterKeys, err := openKeystoreFile(opts.Path, opts.Passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.file = file
+	s.keys = keys
+	s.masterKeys = masterKeys
+	s.log.Info("software keystore loaded", slog.String("path", opts.Path), slog.Int("keys", len(keys)))
+
+	return s, nil
+}
+
+func (s *Store) GenerateKeyPair(_ context.Context, label string, algorithm crypto.Algorithm) (crypto.KeyInfo, error) {
+	var (
+		key gocrypto.Signer
+		err error
+	)
+
+	switch {
+	case algorithm.RSABits() > 0:
+		key, err = rsa.GenerateKey(rand.Reader, algorithm.RSABits())
+	case algorithm.Curve() != nil:
+		key, err = ecdsa.GenerateKey(algorithm.Curve(), rand.Reader)
+	case algorithm == crypto.AlgorithmEd25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return crypto.KeyInfo{}, errs.InvalidField("algorithm", fmt.Sprintf("%s is not supported by the software backend", algorithm))
+	}
+	if err != nil {
+		return crypto.KeyInfo{}, err
+	}
+
+	if err := s.add(label, entry{algorithm: algorithm, key: key}); err != nil {
+		return crypto.KeyInfo{}, err
+	}
+
+	return crypto.KeyInfo{Label: label, Algorithm: algorithm}, nil
+}
+
+func (s *Store) Sign(ctx context.Context, label string, scheme crypto.Scheme, data []byte) ([]byte, error) {
+	if scheme == crypto.SchemeEd25519 {
+		e, err := s.signingEntry(label, scheme)
+		if err != nil {
+			return nil, err
+		}
+		return ed25519.Sign(e.key.(ed25519.PrivateKey), data), nil
+	}
+
+	return s.SignDigest(ctx, label, scheme, scheme.Digest(data))
+}
+
+func (s *Store) SignDigest(_ context.Context, label string, scheme crypto.Scheme, digest []byte) ([]byte, error) {
+	if err := crypto.CheckDigest(scheme, digest); err != nil {
+		return nil, err
+	}
+
+	e, err := s.signingEntry(label, scheme)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := e.key.(type) {
+	case *rsa.PrivateKey:
+		if scheme.PSS() {
+			return rsa.SignPSS(rand.Reader, key, scheme.Hash(), digest, scheme.PSSOptions())
+		}
+		return rsa.SignPKCS1v15(rand.Reader, key, scheme.Hash(), digest)
+	case *ecdsa.PrivateKey:
+		r, sig, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			return nil, err
+		}
+		return rawECDSA(key.Curve, r, sig), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", e.key)
+	}
+}
+
+// signingEntry returns the key labelled label if it may sign with scheme.
+func (s *Store) signingEntry(label string, scheme crypto.Scheme) (entry, error) {
+	e, err := s.entry(label)
+	if err != nil {
+		return entry{}, err
+	}
+	if e.usage == usageUnwrap {
+		return entry{}, errs.FailedPrecondition(fmt.Sprintf("key %q may only unwrap", label))
+	}
+	if err := crypto.CheckScheme(e.algorithm, scheme); err != nil {
+		return entry{}, err
+	}
+
+	return e, nil
+}
+
+func (s *Store) Verify(_ context.Context, label string, scheme crypto.Scheme, data []byte, signature []byte) (bool, error) {
+	e, err := s.entry(label)
+	if err != nil {
+		return false, err
+	}
+	return crypto.Verify(e.key.Public(), scheme, data, signature)
+}
+
+func (s *Store) DeleteKeyPair(_ context.Context, label string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.keys[label]
+	if !ok {
+		return errs.NotFound(storage.ResourceKeyPair, label)
+	}
+
+	delete(s.keys, label)
+	if err := s.persist(); err != nil {
+		s.keys[label] = e
+		return err
+	}
+
+	return nil
+}
+
+func (s *Store) FindKey(_ context.Context, label string) (crypto.KeyInfo, error) {
+	e, err := s.entry(label)
+	if err != nil {
+		return crypto.KeyInfo{}, err
+	}
+
+	return crypto.KeyInfo{Label: label, Algorithm: e.algorithm}, nil
+}
+
+func (s *Store) PublicKey(_ context.Context, label string) (gocrypto.PublicKey, error) {
+	e, err := s.entry(label)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.key.Public(), nil
+}
+
+func (s *Store) WrappingKey(_ context.Context, label string) (*rsa.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.keys[label]; ok {
+		if e.usage != usageUnwrap {
+			return nil, errs.FailedPrecondition(fmt.Sprintf("key %q is not a wrapping key", label))
+		}
+		return e.key.Public().(*rsa.PublicKey), nil
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, crypto.WrappingAlgorithm.RSABits())
+	if err != nil {
+		return nil, err
+	}
+
+	s.keys[label] = entry{algorithm: crypto.WrappingAlgorithm, key: key, usage: usageUnwrap}
+	if err := s.persist(); err != nil {
+		delete(s.keys, label)
+		return nil, err
+	}
+
+	return &key.PublicKey, nil
+}
+
+func (s *Store) ImportKeyPair(
+	_ context.Context,
+	label string,
+	wrappingLabel string,
+	wrapped []byte,
+	publicKey gocrypto.PublicKey,
+) (crypto.KeyInfo, error) {
+	wrapping, err := s.entry(wrappingLabel)
+	if err != nil {
+		return crypto.KeyInfo{}, err
+	}
+	wrappingKey, ok := wrapping.key.(*rsa.PrivateKey)
+	if wrapping.usage != usageUnwrap || !ok {
+		return crypto.KeyInfo{}, errs.FailedPrecondition(fmt.Sprintf("key %q is not a wrapping key", wrappingLabel))
+	}
+
+	encryptedKey, wrappedKey, err := crypto.SplitWrappedKey(&wrappingKey.PublicKey, wrapped)
+	if err != nil {
+		return crypto.KeyInfo{}, err
+	}
+
+	aesKey, err := rsa.DecryptOAEP(sha256.New(), nil, wrappingKey, encryptedKey, nil)
+	if err != nil {
+		return crypto.KeyInfo{}, errs.InvalidField("wrapped_key", "the AES key cannot be decrypted with the wrapping key")
+	}
+
+	return s.unwrapKeyPair(label, aesKey, wrappedKey, publicKey)
+}
+
+// ExportKeyPair wraps any key but a wrapping key: software keys are never
+// more protected than the keystore they live in.
+func (s *Store) ExportKeyPair(_ context.Context, label string, kek []byte) ([]byte, gocrypto.PublicKey, error) {
+	e, err := s.entry(label)
+	if err != nil {
+		return nil, nil, err
+	}
+	if e.usage == usageUnwrap {
+		return nil, nil, errs.FailedPrecondition(fmt.Sprintf("key %q is a wrapping key", label))
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(e.key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wrapped, err := keywrap.Wrap(kek, der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return wrapped, e.key.Public(), nil
+}
+
+func (s *Store) RestoreKeyPair(
+	_ context.Context,
+	label string,
+	kek []byte,
+	wrapped []byte,
+	publicKey gocrypto.PublicKey,
+) (crypto.KeyInfo, error) {
+	return s.unwrapKeyPair(label, kek, wrapped, publicKey)
+}
+
+func (s *Store) Decrypt(_ context.Context, label string, ciphertext []byte) ([]byte, error) {
+	e, err := s.entry(label)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := e.key.(*rsa.PrivateKey)
+	if !ok || e.usage == usageUnwrap {
+		return nil, errs.FailedPrecondition(fmt.Sprintf("key %q cannot decrypt", label))
+	}
+
+	plaintext, err := rsa.DecryptOAEP(sha256.New(), nil, key, ciphertext, nil)
+	if err != nil {
+		return nil, errs.InvalidField("ciphertext", "cannot be decrypted with this key")
+	}
+
+	return plaintext, nil
+}
+
+func (s *Store) DeriveSharedSecret(_ context.Context, label string, peer *ecdh.PublicKey) ([]byte, error) {
+	e, err := s.entry(label)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := e.key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errs.FailedPrecondition(fmt.Sprintf("key %q cannot decrypt", label))
+	}
+
+	private, err := key.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	if private.Curve() != peer.Curve() {
+		return nil, errs.InvalidField("ciphertext", "the ephemeral key is on another curve")
+	}
+
+	return private.ECDH(peer)
+}
+
+// unwrapKeyPair unwraps a PKCS#8 private key wrapped under kek and stores it
+// under label, provided it matches publicKey.
+func (s *Store) unwrapKeyPair(label string, kek []byte, wrapped []byte, publicKey gocrypto.PublicKey) (crypto.KeyInfo, error) {
+	der, err := keywrap.Unwrap(kek, wrapped)
+	if err != nil {
+		return crypto.KeyInfo{}, errs.InvalidField("wrapped_key", "the private key cannot be unwrapped")
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return crypto.KeyInfo{}, errs.InvalidField("wrapped_key", "the private key is not PKCS#8")
+	}
+	key, ok := parsed.(gocrypto.Signer)
+	if !ok {
+		return crypto.KeyInfo{}, errs.InvalidField("wrapped_key", fmt.Sprintf("unsupported private key type %T", parsed))
+	}
+	if !key.Public().(interface{ Equal(gocrypto.PublicKey) bool }).Equal(publicKey) {
+		return crypto.KeyInfo{}, errs.InvalidField("pem", "does not match the private key")
+	}
+
+	algorithm, err := crypto.AlgorithmOf(publicKey)
+	if err != nil {
+		return crypto.KeyInfo{}, errs.InvalidField("pem", err.Error())
+	}
+
+	if err := s.add(label, entry{algorithm: algorithm, key: key}); err != nil {
+		return crypto.KeyInfo{}, err
+	}
+
+	return crypto.KeyInfo{Label: label, Algorithm: algorithm}, nil
+}
+
+func (s *Store) GenerateMasterKey(_ context.Context, label string) error {
+	key := make([]byte, crypto.ContentKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.masterKeys[label]; ok {
+		return errs.AlreadyExists(storage.ResourceMasterKey, label)
+	}
+
+	s.masterKeys[label] = key
+	if err := s.persist(); err != nil {
+		delete(s.masterKeys, label)
+		return err
+	}
+
+	return nil
+}
+
+func (s *Store) WrapDataKey(_ context.Context, label string, dataKey []byte) ([]byte, error) {
+	key, err := s.masterKey(label)
+	if err != nil {
+		return nil, err
+	}
+
+	return keywrap.Wrap(key, dataKey)
+}
+
+func (s *Store) UnwrapDataKey(_ context.Context, label string, wrapped []byte) ([]byte, error) {
+	key, err := s.masterKey(label)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := keywrap.Unwrap(key, wrapped)
+	if err != nil {
+		return nil, errs.InvalidField("wrapped_key", "the data key cannot be unwrapped with this master key")
+	}
+
+	return dataKey, nil
+}
+
+func (s *Store) DeleteMasterKey(_ context.Context, label string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.masterKeys[label]
+	if !ok {
+		return errs.NotFound(storage.ResourceMasterKey, label)
+	}
+
+	delete(s.masterKeys, label)
+	if err := s.persist(); err != nil {
+		s.masterKeys[label] = key
+		return err
+	}
+
+	return nil
+}
+
+// Ping always succeeds: the keys are in memory.
+func (s *Store) Ping(_ context.Context) error {
+	return nil
+}
+
+func (s *Store) Close() error {
+	return nil
+}
+
+func (s *Store) entry(label string) (entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.keys[label]
+	if !ok {
+		return entry{}, errs.NotFound(storage.ResourceKeyPair, label)
+	}
+
+	return e, nil
+}
+
+func (s *Store) masterKey(label string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key, ok := s.masterKeys[label]
+	if !ok {
+		return nil, errs.NotFound(storage.ResourceMasterKey, label)
+	}
+
+	return key, nil
+}
+
+// add stores a new key under label and persists it.
+func (s *Store) add(label string, e entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.keys[label]; ok {
+		return errs.AlreadyExists(storage.ResourceKeyPair, label)
+	}
+
+	s.keys[label] = e
+	if err := s.persist(); err != nil {
+		delete(s.keys, label)
+		return err
+	}
+
+	return nil
+}
+
+// persist writes every key to the keystore file. The caller holds mu.
+func (s *Store) persist() error {
+	if s.file == nil {
+		return nil
+	}
+
+	return s.file.write(s.keys, s.masterKeys)
+}
+
+// rawECDSA encodes a signature as the fixed-size r||s pair CKM_ECDSA returns.
+func rawECDSA(curve elliptic.Curve, r *big.Int, sig *big.Int) []byte {
+	size := (curve.Params().BitSize + 7) / 8
+	out := make([]byte, 2*size)
+	r.FillBytes(out[:size])
+	sig.FillBytes(out[size:])
+
+	return out
+}
@@ -0,0 +1,203 @@
+package software
+
+import (
+	"context"
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"golang.org/x/exp/slog"
+	"io"
+	"path/filepath"
+	"testing"
+	"tms/internal/domain/errs"
+	"tms/internal/lib/keywrap"
+	"tms/internal/services/crypto"
+)
+
+func newStore(t *testing.T, path string, passphrase string) *Store {
+	t.Helper()
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	store, err := New(log, Options{Path: path, Passphrase: passphrase})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store
+}
+
+func TestSignatures(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t, "", "")
+
+	tests := []struct {
+		algorithm crypto.Algorithm
+		scheme    crypto.Scheme
+	}{
+		{crypto.AlgorithmRSA2048, crypto.SchemeRSAPKCS1SHA256},
+		{crypto.AlgorithmRSA2048, crypto.SchemeRSAPKCS1SHA512},
+		{crypto.AlgorithmRSA2048, crypto.SchemeRSAPSSSHA256},
+		{crypto.AlgorithmRSA2048, crypto.SchemeRSAPSSSHA384},
+		{crypto.AlgorithmECP256, crypto.SchemeECDSASHA256},
+		{crypto.AlgorithmECP384, crypto.SchemeECDSASHA384},
+		{crypto.AlgorithmEd25519, crypto.SchemeEd25519},
+	}
+
+	keys := make(map[crypto.Algorithm]string)
+	for _, tt := range tests {
+		if _, ok := keys[tt.algorithm]; ok {
+			continue
+		}
+		label := string(tt.algorithm)
+		if _, err := store.GenerateKeyPair(ctx, label, tt.algorithm); err != nil {
+			t.Fatal(err)
+		}
+		keys[tt.algorithm] = label
+	}
+
+	data := []byte("the quick brown fox")
+
+	for _, tt := range tests {
+		t.Run(string(tt.scheme), func(t *testing.T) {
+			label := keys[tt.algorithm]
+
+			signature, err := store.Sign(ctx, label, tt.scheme, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			valid, err := store.Verify(ctx, label, tt.scheme, data, signature)
+			if err != nil || !valid {
+				t.Fatalf("Verify = %v, %v, want true", valid, err)
+			}
+
+			valid, err = store.Verify(ctx, label, tt.scheme, []byte("another message"), signature)
+			if err != nil || valid {
+				t.Fatalf("Verify of other data = %v, %v, want false", valid, err)
+			}
+		})
+	}
+}
+
+func TestKeystoreFile(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "keystore.json")
+
+	store := newStore(t, path, "correct horse")
+	for _, algorithm := range []crypto.Algorithm{crypto.AlgorithmRSA2048, crypto.AlgorithmECP256, crypto.AlgorithmEd25519} {
+		if _, err := store.GenerateKeyPair(ctx, string(algorithm), algorithm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reopened := newStore(t, path, "correct horse")
+	for _, algorithm := range []crypto.Algorithm{crypto.AlgorithmRSA2048, crypto.AlgorithmECP256, crypto.AlgorithmEd25519} {
+		label := string(algorithm)
+
+		info, err := reopened.FindKey(ctx, label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Algorithm != algorithm {
+			t.Fatalf("key %q has algorithm %s, want %s", label, info.Algorithm, algorithm)
+		}
+
+		want, _ := store.PublicKey(ctx, label)
+		got, err := reopened.PublicKey(ctx, label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.(interface{ Equal(gocrypto.PublicKey) bool }).Equal(want) {
+			t.Fatalf("key %q changed across a reopen", label)
+		}
+	}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if _, err := New(log, Options{Path: path, Passphrase: "wrong"}); err == nil {
+		t.Fatal("keystore opened with a wrong passphrase")
+	}
+}
+
+// wrapForImport wraps key in crypto.WrappingScheme format for wrappingKey,
+// as a customer would.
+func wrapForImport(t *testing.T, wrappingKey *rsa.PublicKey, key gocrypto.Signer) []byte {
+	t.Helper()
+
+	aesKey := make([]byte, 32)
+	if _, err := rand.Read(aesKey); err != nil {
+		t.Fatal(err)
+	}
+
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, wrappingKey, aesKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrappedKey, err := keywrap.Wrap(aesKey, der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return append(encryptedKey, wrappedKey...)
+}
+
+func TestImportKeyPair(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t, "", "")
+
+	wrappingKey, err := store.WrappingKey(ctx, "wrapping")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped := wrapForImport(t, wrappingKey, key)
+
+	tampered := append([]byte(nil), wrapped...)
+	tampered[len(tampered)-1] ^= 0x01
+	_, err = store.ImportKeyPair(ctx, "tampered", "wrapping", tampered, key.Public())
+	if !errors.Is(err, errs.KindInvalidArgument) {
+		t.Fatalf("ImportKeyPair of a tampered key = %v, want InvalidArgument", err)
+	}
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.ImportKeyPair(ctx, "mismatched", "wrapping", wrapped, other.Public())
+	if !errors.Is(err, errs.KindInvalidArgument) {
+		t.Fatalf("ImportKeyPair with another public key = %v, want InvalidArgument", err)
+	}
+
+	info, err := store.ImportKeyPair(ctx, "imported", "wrapping", wrapped, key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Algorithm != crypto.AlgorithmECP256 {
+		t.Fatalf("imported key has algorithm %s, want %s", info.Algorithm, crypto.AlgorithmECP256)
+	}
+
+	data := []byte("imported")
+	signature, err := store.Sign(ctx, "imported", crypto.SchemeECDSASHA256, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err := crypto.Verify(key.Public(), crypto.SchemeECDSASHA256, data, signature)
+	if err != nil || !valid {
+		t.Fatalf("signature of the imported key does not verify with the original: %v, %v", valid, err)
+	}
+}
@@ -0,0 +1,28 @@
+package crypto
+
+import (
+	"crypto/rsa"
+	"tms/internal/domain/errs"
+)
+
+// WrappingScheme is the format keys are imported in, the one of the PKCS#11
+// CKM_RSA_AES_KEY_WRAP mechanism: an ephemeral AES key encrypted to the
+// wrapping key with RSA-OAEP (SHA-256, MGF1-SHA-256, empty label), followed
+// by the PKCS#8 private key wrapped under that AES key with AES Key Wrap
+// with Padding (RFC 5649, CKM_AES_KEY_WRAP_PAD).
+const WrappingScheme = "RSA_AES_KEY_WRAP_SHA_256"
+
+// WrappingAlgorithm is the algorithm of the key imported keys are wrapped for.
+const WrappingAlgorithm = AlgorithmRSA3072
+
+// SplitWrappedKey splits a key in WrappingScheme format into the encrypted
+// AES key and the wrapped private key.
+func SplitWrappedKey(wrappingKey *rsa.PublicKey, wrapped []byte) ([]byte, []byte, error) {
+	size := wrappingKey.Size()
+	// An RFC 5649 ciphertext is at least two blocks.
+	if len(wrapped) < size+16 {
+		return nil, nil, errs.InvalidField("wrapped_key", "is too short for "+WrappingScheme)
+	}
+
+	return wrapped[:size], wrapped[size:], nil
+}
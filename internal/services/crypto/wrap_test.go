@@ -0,0 +1,33 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+	"tms/internal/domain/errs"
+)
+
+func TestSplitWrappedKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encryptedKey := bytes.Repeat([]byte{0x01}, key.Size())
+	wrappedKey := bytes.Repeat([]byte{0x02}, 40)
+
+	gotEncrypted, gotWrapped, err := SplitWrappedKey(&key.PublicKey, append(bytes.Clone(encryptedKey), wrappedKey...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotEncrypted, encryptedKey) || !bytes.Equal(gotWrapped, wrappedKey) {
+		t.Fatal("SplitWrappedKey split at the wrong offset")
+	}
+
+	_, _, err = SplitWrappedKey(&key.PublicKey, make([]byte, key.Size()+15))
+	if !errors.Is(err, errs.KindInvalidArgument) {
+		t.Fatalf("SplitWrappedKey of a short key = %v, want InvalidArgument", err)
+	}
+}
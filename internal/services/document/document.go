@@ -3,33 +3,66 @@ package document
 import (
 	"context"
 	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"golang.org/x/exp/slog"
+	"time"
 	"tms/internal/domain/models"
+	"tms/internal/services/crypto"
 )
 
+// DocumentService stores document content under envelope encryption and is
+// the only place it is decrypted.
 type DocumentService struct {
-	log              *slog.Logger
-	documentProvider Provider
+	log               *slog.Logger
+	keyManager        crypto.KeyManager
+	documentProvider  Provider
+	masterKeyProvider MasterKeyProvider
+	authorizer        Authorizer
 }
 
 type Provider interface {
 	SaveDocument(ctx context.Context,
+		id string,
 		title string,
 		ownerId string,
-		content string,
-	) (string, error)
+		content models.SealedContent,
+	) error
 	GetDocument(ctx context.Context, id string) (models.Document, error)
-	UpdateDocument(ctx context.Context, id string, title string, content string, ownerId string) (models.Document, error)
+	UpdateDocument(ctx context.Context, id string, title string, content models.SealedContent, ownerId string) (models.Document, error)
 	DeleteDocument(ctx context.Context, id string) (bool, error)
+	DocumentsToRewrap(ctx context.Context, masterKey string, after string, limit int) ([]models.Document, error)
+	RewrapDocumentKey(ctx context.Context, id string, from []byte, masterKey string, dataKey []byte) error
+	SealDocument(ctx context.Context, id string, content string, sealed models.SealedContent) error
+	CountDocumentsWrappedWith(ctx context.Context, masterKey string) (int64, error)
+}
+
+type MasterKeyProvider interface {
+	MasterKey(ctx context.Context, name string) (models.MasterKey, error)
+	SaveMasterKey(ctx context.Context, key models.MasterKey) error
+	ClaimMasterKeyRotation(ctx context.Context, name string, from int, at time.Time, lease time.Duration) error
+	ReleaseMasterKeyRotation(ctx context.Context, name string, at time.Time) error
+	RotateMasterKey(ctx context.Context, name string, from int, at time.Time, versions []models.KeyVersion) error
+	RemoveMasterKeyVersion(ctx context.Context, name string, version int) error
+}
+
+type Authorizer interface {
+	AuthorizeDocument(ctx context.Context, id string) (models.Document, error)
+	AuthorizeUserDocument(ctx context.Context, userId string, id string) (models.Document, error)
 }
 
 func New(
 	log *slog.Logger,
+	keyManager crypto.KeyManager,
 	documentProvider Provider,
+	masterKeyProvider MasterKeyProvider,
+	authorizer Authorizer,
 ) *DocumentService {
 	return &DocumentService{
-		log:              log,
-		documentProvider: documentProvider,
+		log:               log,
+		keyManager:        keyManager,
+		documentProvider:  documentProvider,
+		masterKeyProvider: masterKeyProvider,
+		authorizer:        authorizer,
 	}
 }
 
@@ -41,11 +74,20 @@ func (d *DocumentService) CreateDocument(
 ) (string, error) {
 	const op = "services.document.CreateDocument"
 
-	id, err := d.documentProvider.SaveDocument(
+	// The id is assigned up front because the sealed content is bound to it.
+	id := primitive.NewObjectID().Hex()
+
+	sealed, err := d.seal(ctx, id, content)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = d.documentProvider.SaveDocument(
 		ctx,
+		id,
 		title,
 		ownerId,
-		content,
+		sealed,
 	)
 
 	if err != nil {
@@ -61,14 +103,58 @@ func (d *DocumentService) Document(
 ) (models.Document, error) {
 	const op = "services.document.Document"
 
+	document, err := d.authorizer.AuthorizeDocument(ctx, id)
+
+	if err != nil {
+		return models.Document{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	document, err = d.open(ctx, document)
+	if err != nil {
+		return models.Document{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return document, nil
+}
+
+// UserDocument returns a document owned by userId with its content
+// decrypted. It serves other services, such as the signature issuer, that
+// act on behalf of a user.
+func (d *DocumentService) UserDocument(ctx context.Context, userId string, id string) (models.Document, error) {
+	const op = "services.document.UserDocument"
+
+	document, err := d.authorizer.AuthorizeUserDocument(ctx, userId, id)
+	if err != nil {
+		return models.Document{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	document, err = d.open(ctx, document)
+	if err != nil {
+		return models.Document{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return document, nil
+}
+
+// GetDocument returns a document with its content decrypted, without
+// checking the caller. It serves other services, such as the signature
+// issuer, that apply their own rules to the documents they read.
+func (d *DocumentService) GetDocument(ctx context.Context, id string) (models.Document, error) {
+	const op = "services.document.GetDocument"
+
 	document, err := d.documentProvider.GetDocument(ctx, id)
+	if err != nil {
+		return models.Document{}, fmt.Errorf("%s: %w", op, err)
+	}
 
+	document, err = d.open(ctx, document)
 	if err != nil {
 		return models.Document{}, fmt.Errorf("%s: %w", op, err)
 	}
 
 	return document, nil
 }
+
 func (d *DocumentService) UpdateDocument(
 	ctx context.Context,
 	id string,
@@ -78,17 +164,34 @@ func (d *DocumentService) UpdateDocument(
 ) (models.Document, error) {
 	const op = "services.document.UpdateDocument"
 
-	document, err := d.documentProvider.UpdateDocument(ctx, id, title, content, ownerId)
+	if _, err := d.authorizer.AuthorizeDocument(ctx, id); err != nil {
+		return models.Document{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	sealed, err := d.seal(ctx, id, content)
+	if err != nil {
+		return models.Document{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	document, err := d.documentProvider.UpdateDocument(ctx, id, title, sealed, ownerId)
 
 	if err != nil {
 		return models.Document{}, fmt.Errorf("%s: %w", op, err)
 	}
 
+	document.Content = content
+	document.Sealed = nil
+
 	return document, nil
 }
+
 func (d *DocumentService) DeleteDocument(ctx context.Context, id string) (bool, error) {
 	const op = "services.document.DeleteDocument"
 
+	if _, err := d.authorizer.AuthorizeDocument(ctx, id); err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
 	success, err := d.documentProvider.DeleteDocument(ctx, id)
 
 	if err != nil {
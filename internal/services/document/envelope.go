@@ -0,0 +1,126 @@
+package document
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"time"
+	"tms/internal/domain/errs"
+	"tms/internal/domain/models"
+	"tms/internal/services/crypto"
+)
+
+// masterKeyName names the master key document data keys are wrapped under.
+// Its versions live in the backend under models.VersionLabel labels; the '#'
+// cannot appear in labels users choose.
+const masterKeyName = "#documents"
+
+// sealFormat is the format of the sealed content written by seal.
+const sealFormat = 1
+
+// associatedData binds sealed content to its format and to the document it
+// belongs to.
+func associatedData(format int, id string) []byte {
+	return []byte(fmt.Sprintf("tms-document/v%d\x00%s", format, id))
+}
+
+// seal encrypts the content of document id under a fresh data key and wraps
+// the data key with the current master key.
+func (d *DocumentService) seal(ctx context.Context, id string, content string) (models.SealedContent, error) {
+	masterKey, err := d.masterKey(ctx)
+	if err != nil {
+		return models.SealedContent{}, err
+	}
+
+	dataKey := make([]byte, crypto.ContentKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return models.SealedContent{}, err
+	}
+
+	ciphertext, err := crypto.Seal(dataKey, []byte(content), associatedData(sealFormat, id))
+	if err != nil {
+		return models.SealedContent{}, err
+	}
+
+	backendLabel := masterKey.Current().BackendLabel
+	wrapped, err := d.keyManager.WrapDataKey(ctx, backendLabel, dataKey)
+	if err != nil {
+		return models.SealedContent{}, err
+	}
+
+	return models.SealedContent{
+		MasterKey:  backendLabel,
+		DataKey:    wrapped,
+		Ciphertext: ciphertext,
+		Format:     sealFormat,
+	}, nil
+}
+
+// open returns document with its content decrypted. Documents written
+// before encryption are returned as they are.
+func (d *DocumentService) open(ctx context.Context, document models.Document) (models.Document, error) {
+	if document.Sealed == nil {
+		return document, nil
+	}
+	if document.Sealed.Format != sealFormat {
+		return models.Document{}, errs.FailedPrecondition(fmt.Sprintf("document %q is sealed in unknown format %d", document.Id, document.Sealed.Format))
+	}
+
+	dataKey, err := d.keyManager.UnwrapDataKey(ctx, document.Sealed.MasterKey, document.Sealed.DataKey)
+	if err != nil {
+		return models.Document{}, fmt.Errorf("failed to unwrap data key of document %q: %w", document.Id, err)
+	}
+
+	content, err := crypto.Open(dataKey, document.Sealed.Ciphertext, associatedData(document.Sealed.Format, document.Id))
+	if err != nil {
+		return models.Document{}, fmt.Errorf("failed to decrypt document %q: %w", document.Id, err)
+	}
+
+	document.Content = string(content)
+	document.Sealed = nil
+
+	return document, nil
+}
+
+// masterKey returns the document master key, creating its first version on
+// first use.
+func (d *DocumentService) masterKey(ctx context.Context) (models.MasterKey, error) {
+	masterKey, err := d.masterKeyProvider.MasterKey(ctx, masterKeyName)
+	if !errors.Is(err, errs.KindNotFound) {
+		return masterKey, err
+	}
+
+	backendLabel := models.VersionLabel(masterKeyName, 1)
+
+	// A key left behind by a first use that failed before it was recorded,
+	// or generated by a concurrent first use, has wrapped nothing that could
+	// be lost, so it is used as it is.
+	err = d.keyManager.GenerateMasterKey(ctx, backendLabel)
+	if err != nil && !errors.Is(err, errs.KindAlreadyExists) {
+		return models.MasterKey{}, err
+	}
+
+	masterKey = models.MasterKey{
+		Name:    masterKeyName,
+		Version: 1,
+		Versions: []models.KeyVersion{{
+			Version:      1,
+			BackendLabel: backendLabel,
+			CreatedAt:    time.Now().UTC(),
+		}},
+	}
+
+	err = d.masterKeyProvider.SaveMasterKey(ctx, masterKey)
+	if errors.Is(err, errs.KindAlreadyExists) {
+		return d.masterKeyProvider.MasterKey(ctx, masterKeyName)
+	}
+	if err != nil {
+		return models.MasterKey{}, err
+	}
+
+	d.log.Info("document master key created", slog.String("label", backendLabel))
+
+	return masterKey, nil
+}
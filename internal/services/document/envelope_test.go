@@ -0,0 +1,82 @@
+package document
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"tms/internal/domain/errs"
+	"tms/internal/domain/models"
+)
+
+func TestSealOpen(t *testing.T) {
+	ctx := context.Background()
+	service, _, _ := newService(t)
+
+	const id = "65a1b2c3d4e5f60718293a4b"
+
+	sealed, err := service.seal(ctx, id, "the content")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed.Format != sealFormat {
+		t.Fatalf("sealed in format %d, want %d", sealed.Format, sealFormat)
+	}
+
+	document, err := service.open(ctx, models.Document{Id: id, Sealed: &sealed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if document.Content != "the content" || document.Sealed != nil {
+		t.Fatalf("open = %+v, want the content", document)
+	}
+
+	// Data keys stay readable after a rotation.
+	if _, err := service.RotateMasterKey(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.open(ctx, models.Document{Id: id, Sealed: &sealed}); err != nil {
+		t.Fatalf("open after rotation: %v", err)
+	}
+}
+
+// Sealed content is bound to its document and cannot be moved to another.
+func TestOpenRejectsMovedContent(t *testing.T) {
+	ctx := context.Background()
+	service, _, _ := newService(t)
+
+	const first, second = "65a1b2c3d4e5f60718293a4b", "65a1b2c3d4e5f60718293a4c"
+
+	sealed, err := service.seal(ctx, first, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := service.seal(ctx, second, "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := service.open(ctx, models.Document{Id: second, Sealed: &sealed}); err == nil {
+		t.Fatal("content sealed for one document opened as another")
+	}
+
+	// Moving only the ciphertext leaves it with the wrong data key.
+	swapped := sealed
+	swapped.Ciphertext = other.Ciphertext
+	if _, err := service.open(ctx, models.Document{Id: first, Sealed: &swapped}); err == nil {
+		t.Fatal("ciphertext of another document opened")
+	}
+
+	tampered := sealed
+	tampered.Ciphertext = append([]byte(nil), sealed.Ciphertext...)
+	tampered.Ciphertext[len(tampered.Ciphertext)-1] ^= 0x01
+	if _, err := service.open(ctx, models.Document{Id: first, Sealed: &tampered}); err == nil {
+		t.Fatal("tampered ciphertext opened")
+	}
+
+	unversioned := sealed
+	unversioned.Format = 0
+	_, err = service.open(ctx, models.Document{Id: first, Sealed: &unversioned})
+	if !errors.Is(err, errs.KindFailedPrecondition) {
+		t.Fatalf("open of content without a format = %v, want FailedPrecondition", err)
+	}
+}
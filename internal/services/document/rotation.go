@@ -0,0 +1,240 @@
+package document
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"time"
+	"tms/internal/domain/errs"
+	"tms/internal/domain/models"
+)
+
+// rewrapBatchSize is how many documents a rewrap pass reads at once.
+const rewrapBatchSize = 100
+
+// retiredMasterKeyGrace is how long a retired master key version is kept
+// after rotation even when nothing is wrapped under it, so that writes which
+// read the master key just before the rotation land before it is destroyed.
+const retiredMasterKeyGrace = time.Hour
+
+// masterKeyRotationLease is how long a claimed rotation keeps others out.
+// A rotation that crashed is taken over once it has run out.
+const masterKeyRotationLease = 10 * time.Minute
+
+// RewrapResult counts what a RewrapDataKeys pass did.
+type RewrapResult struct {
+	// Rewrapped counts data keys moved to the current master key version.
+	Rewrapped int
+	// Sealed counts documents that were still stored in plaintext.
+	Sealed int
+	// Failed counts documents left as they were because of an error.
+	Failed int
+	// Destroyed lists the retired master key versions that were destroyed.
+	Destroyed []string
+}
+
+// RotateMasterKey makes a new version of the document master key current.
+// Data keys wrapped under older versions stay readable until
+// RewrapDataKeys moves them. Rotations are claimed for
+// masterKeyRotationLease, so only one runs at a time.
+func (d *DocumentService) RotateMasterKey(ctx context.Context) (models.MasterKey, error) {
+	const op = "services.document.RotateMasterKey"
+
+	masterKey, err := d.masterKey(ctx)
+	if err != nil {
+		return models.MasterKey{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	from := masterKey.Version
+	next := from + 1
+	backendLabel := models.VersionLabel(masterKeyName, next)
+
+	claimedAt := time.Now().UTC()
+	err = d.masterKeyProvider.ClaimMasterKeyRotation(ctx, masterKeyName, from, claimedAt, masterKeyRotationLease)
+	if err != nil {
+		return models.MasterKey{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	masterKey, err = d.rotate(ctx, masterKey, claimedAt, backendLabel)
+	if err != nil {
+		if releaseErr := d.masterKeyProvider.ReleaseMasterKeyRotation(context.WithoutCancel(ctx), masterKeyName, claimedAt); releaseErr != nil {
+			d.log.Error("failed to release master key rotation", slog.Any("error", releaseErr))
+		}
+		return models.MasterKey{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	d.log.Info("document master key rotated", slog.Int("version", masterKey.Version))
+
+	return masterKey, nil
+}
+
+// rotate generates backendLabel and records it as the version after the
+// current one of masterKey. A key is never deleted here: one that is
+// already in the backend but not recorded was left by a rotation that
+// failed before recording it, so nothing is wrapped under it and it is
+// recorded as it is. When recording fails, the master key is read again and
+// the version is adopted if another rotation recorded it.
+func (d *DocumentService) rotate(
+	ctx context.Context,
+	masterKey models.MasterKey,
+	claimedAt time.Time,
+	backendLabel string,
+) (models.MasterKey, error) {
+	err := d.keyManager.GenerateMasterKey(ctx, backendLabel)
+	if errors.Is(err, errs.KindAlreadyExists) {
+		d.log.Warn("recording master key left by an interrupted rotation", slog.String("label", backendLabel))
+	} else if err != nil {
+		return models.MasterKey{}, err
+	}
+
+	from := masterKey.Version
+	now := time.Now().UTC()
+
+	versions := append([]models.KeyVersion(nil), masterKey.Versions...)
+	versions[len(versions)-1].RetiredAt = now
+	versions = append(versions, models.KeyVersion{
+		Version:      from + 1,
+		BackendLabel: backendLabel,
+		CreatedAt:    now,
+	})
+
+	err = d.masterKeyProvider.RotateMasterKey(ctx, masterKeyName, from, claimedAt, versions)
+	if err == nil {
+		masterKey.Version = from + 1
+		masterKey.Versions = versions
+		return masterKey, nil
+	}
+
+	recorded, readErr := d.masterKeyProvider.MasterKey(context.WithoutCancel(ctx), masterKeyName)
+	if readErr != nil {
+		return models.MasterKey{}, errors.Join(err, readErr)
+	}
+	if recorded.Current().BackendLabel == backendLabel {
+		return recorded, nil
+	}
+
+	return models.MasterKey{}, err
+}
+
+// RewrapDataKeys rewraps every data key wrapped under an older master key
+// version with the current one, and seals documents still stored in
+// plaintext. Only the wrapped data keys are rewritten, not the encrypted
+// content. Retired versions that no longer wrap anything are destroyed once
+// retiredMasterKeyGrace has passed. A pass can be interrupted and run
+// again.
+func (d *DocumentService) RewrapDataKeys(ctx context.Context) (RewrapResult, error) {
+	const op = "services.document.RewrapDataKeys"
+
+	log := d.log.With(slog.String("op", op))
+
+	masterKey, err := d.masterKey(ctx)
+	if err != nil {
+		return RewrapResult{}, fmt.Errorf("%s: %w", op, err)
+	}
+	current := masterKey.Current().BackendLabel
+
+	var result RewrapResult
+
+	after := ""
+	for {
+		documents, err := d.documentProvider.DocumentsToRewrap(ctx, current, after, rewrapBatchSize)
+		if err != nil {
+			return result, fmt.Errorf("%s: %w", op, err)
+		}
+
+		for _, document := range documents {
+			after = document.Id
+
+			sealed, err := d.rewrap(ctx, document, current)
+			switch {
+			case errors.Is(err, errs.KindFailedPrecondition):
+				// Updated meanwhile, and so sealed under the current key.
+			case err != nil:
+				log.Error("failed to rewrap document", slog.String("id", document.Id), slog.Any("error", err))
+				result.Failed++
+			case sealed:
+				result.Sealed++
+			default:
+				result.Rewrapped++
+			}
+		}
+
+		if len(documents) < rewrapBatchSize {
+			break
+		}
+	}
+
+	for _, version := range masterKey.Versions {
+		if version.Version == masterKey.Version || time.Since(version.RetiredAt) < retiredMasterKeyGrace {
+			continue
+		}
+
+		destroyed, err := d.destroyRetired(ctx, version)
+		if err != nil {
+			return result, fmt.Errorf("%s: %w", op, err)
+		}
+		if destroyed {
+			result.Destroyed = append(result.Destroyed, version.BackendLabel)
+		}
+	}
+
+	log.Info("document data keys rewrapped",
+		slog.Int("rewrapped", result.Rewrapped),
+		slog.Int("sealed", result.Sealed),
+		slog.Int("failed", result.Failed),
+		slog.Int("destroyed", len(result.Destroyed)),
+	)
+
+	return result, nil
+}
+
+// rewrap moves the data key of document to masterKey, or seals its content
+// if it has none. It reports whether the document was sealed.
+func (d *DocumentService) rewrap(ctx context.Context, document models.Document, masterKey string) (bool, error) {
+	if document.Sealed == nil {
+		sealed, err := d.seal(ctx, document.Id, document.Content)
+		if err != nil {
+			return false, err
+		}
+		return true, d.documentProvider.SealDocument(ctx, document.Id, document.Content, sealed)
+	}
+
+	dataKey, err := d.keyManager.UnwrapDataKey(ctx, document.Sealed.MasterKey, document.Sealed.DataKey)
+	if err != nil {
+		return false, err
+	}
+
+	wrapped, err := d.keyManager.WrapDataKey(ctx, masterKey, dataKey)
+	if err != nil {
+		return false, err
+	}
+
+	return false, d.documentProvider.RewrapDocumentKey(ctx, document.Id, document.Sealed.DataKey, masterKey, wrapped)
+}
+
+// destroyRetired destroys a retired master key version unless a data key
+// is still wrapped under it.
+func (d *DocumentService) destroyRetired(ctx context.Context, version models.KeyVersion) (bool, error) {
+	count, err := d.documentProvider.CountDocumentsWrappedWith(ctx, version.BackendLabel)
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		d.log.Warn("retired master key still in use", slog.String("label", version.BackendLabel), slog.Int64("documents", count))
+		return false, nil
+	}
+
+	err = d.keyManager.DeleteMasterKey(ctx, version.BackendLabel)
+	if err != nil && !errors.Is(err, errs.KindNotFound) {
+		return false, err
+	}
+
+	if err := d.masterKeyProvider.RemoveMasterKeyVersion(ctx, masterKeyName, version.Version); err != nil {
+		return false, err
+	}
+
+	d.log.Info("retired master key destroyed", slog.String("label", version.BackendLabel))
+
+	return true, nil
+}
@@ -0,0 +1,273 @@
+package document
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"golang.org/x/exp/slog"
+	"io"
+	"sync"
+	"testing"
+	"time"
+	"tms/internal/domain/errs"
+	"tms/internal/domain/models"
+	"tms/internal/services/crypto/software"
+	"tms/internal/storage"
+)
+
+// masterKeys is an in-memory MasterKeyProvider with the semantics of the
+// MongoDB one.
+type masterKeys struct {
+	mu   sync.Mutex
+	keys map[string]models.MasterKey
+	// lostAck makes RotateMasterKey record the rotation and still fail, as
+	// when the reply is lost.
+	lostAck bool
+	// failRecord makes RotateMasterKey fail without recording anything.
+	failRecord bool
+}
+
+func (m *masterKeys) MasterKey(_ context.Context, name string) (models.MasterKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, ok := m.keys[name]
+	if !ok {
+		return models.MasterKey{}, errs.NotFound(storage.ResourceMasterKey, name)
+	}
+
+	return key, nil
+}
+
+func (m *masterKeys) SaveMasterKey(_ context.Context, key models.MasterKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.keys[key.Name]; ok {
+		return errs.AlreadyExists(storage.ResourceMasterKey, key.Name)
+	}
+	m.keys[key.Name] = key
+
+	return nil
+}
+
+func (m *masterKeys) ClaimMasterKeyRotation(_ context.Context, name string, from int, at time.Time, lease time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, ok := m.keys[name]
+	if !ok || key.Version != from || (!key.RotationClaimedAt.IsZero() && key.RotationClaimedAt.After(at.Add(-lease))) {
+		return errs.FailedPrecondition("claimed or changed")
+	}
+	key.RotationClaimedAt = at
+	m.keys[name] = key
+
+	return nil
+}
+
+func (m *masterKeys) ReleaseMasterKeyRotation(_ context.Context, name string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if key, ok := m.keys[name]; ok && key.RotationClaimedAt.Equal(at) {
+		key.RotationClaimedAt = time.Time{}
+		m.keys[name] = key
+	}
+
+	return nil
+}
+
+func (m *masterKeys) RotateMasterKey(_ context.Context, name string, from int, at time.Time, versions []models.KeyVersion) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.failRecord {
+		return errors.New("connection reset")
+	}
+
+	key, ok := m.keys[name]
+	if !ok || key.Version != from || !key.RotationClaimedAt.Equal(at) {
+		return errs.FailedPrecondition("changed while rotating")
+	}
+	key.Version = versions[len(versions)-1].Version
+	key.Versions = versions
+	key.RotationClaimedAt = time.Time{}
+	m.keys[name] = key
+
+	if m.lostAck {
+		return errors.New("connection reset")
+	}
+
+	return nil
+}
+
+func (m *masterKeys) RemoveMasterKeyVersion(_ context.Context, name string, version int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := m.keys[name]
+	for i, v := range key.Versions {
+		if v.Version == version {
+			key.Versions = append(key.Versions[:i:i], key.Versions[i+1:]...)
+			break
+		}
+	}
+	m.keys[name] = key
+
+	return nil
+}
+
+func newService(t *testing.T) (*DocumentService, *software.Store, *masterKeys) {
+	t.Helper()
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	store, err := software.New(log, software.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := &masterKeys{keys: make(map[string]models.MasterKey)}
+
+	return New(log, store, nil, provider, nil), store, provider
+}
+
+// wrapped wraps a known data key under backendLabel, so that the key can be
+// recognised later.
+func wrapped(t *testing.T, store *software.Store, backendLabel string) ([]byte, []byte) {
+	t.Helper()
+
+	dataKey := bytes.Repeat([]byte{0x5a}, 32)
+
+	wrappedKey, err := store.WrapDataKey(context.Background(), backendLabel, dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dataKey, wrappedKey
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	ctx := context.Background()
+	service, _, _ := newService(t)
+
+	masterKey, err := service.RotateMasterKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if masterKey.Version != 2 || len(masterKey.Versions) != 2 {
+		t.Fatalf("rotated to %+v, want version 2 of 2", masterKey)
+	}
+	if masterKey.Versions[0].RetiredAt.IsZero() {
+		t.Fatal("version 1 was not retired")
+	}
+	if !masterKey.RotationClaimedAt.IsZero() {
+		t.Fatal("rotation claim was not released")
+	}
+}
+
+// A version left in the backend by a rotation that failed before recording
+// it is recorded as it is, never replaced.
+func TestRotateMasterKeyKeepsLeftover(t *testing.T) {
+	ctx := context.Background()
+	service, store, _ := newService(t)
+
+	if _, err := service.masterKey(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	leftover := models.VersionLabel(masterKeyName, 2)
+	if err := store.GenerateMasterKey(ctx, leftover); err != nil {
+		t.Fatal(err)
+	}
+	dataKey, wrappedKey := wrapped(t, store, leftover)
+
+	masterKey, err := service.RotateMasterKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if masterKey.Current().BackendLabel != leftover {
+		t.Fatalf("current version is %q, want %q", masterKey.Current().BackendLabel, leftover)
+	}
+
+	got, err := store.UnwrapDataKey(ctx, leftover, wrappedKey)
+	if err != nil || !bytes.Equal(got, dataKey) {
+		t.Fatalf("leftover master key was replaced: %v", err)
+	}
+}
+
+func TestRotateMasterKeyClaimed(t *testing.T) {
+	ctx := context.Background()
+	service, store, provider := newService(t)
+
+	if _, err := service.masterKey(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.ClaimMasterKeyRotation(ctx, masterKeyName, 1, time.Now().UTC(), masterKeyRotationLease); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := service.RotateMasterKey(ctx)
+	if !errors.Is(err, errs.KindFailedPrecondition) {
+		t.Fatalf("RotateMasterKey = %v, want FailedPrecondition", err)
+	}
+
+	if err := store.GenerateMasterKey(ctx, models.VersionLabel(masterKeyName, 2)); err != nil {
+		t.Fatalf("a claimed rotation generated a key: %v", err)
+	}
+}
+
+// A rotation recorded although recording reported a failure is adopted.
+func TestRotateMasterKeyAdoptsRecorded(t *testing.T) {
+	ctx := context.Background()
+	service, store, provider := newService(t)
+
+	if _, err := service.masterKey(ctx); err != nil {
+		t.Fatal(err)
+	}
+	provider.lostAck = true
+
+	masterKey, err := service.RotateMasterKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if masterKey.Version != 2 {
+		t.Fatalf("rotated to version %d, want 2", masterKey.Version)
+	}
+
+	wrapped(t, store, masterKey.Current().BackendLabel)
+}
+
+// A rotation that failed to record keeps its key and releases its claim, so
+// that the next rotation records the same key.
+func TestRotateMasterKeyFailedRecord(t *testing.T) {
+	ctx := context.Background()
+	service, store, provider := newService(t)
+
+	if _, err := service.masterKey(ctx); err != nil {
+		t.Fatal(err)
+	}
+	provider.failRecord = true
+
+	if _, err := service.RotateMasterKey(ctx); err == nil {
+		t.Fatal("RotateMasterKey succeeded although recording failed")
+	}
+
+	next := models.VersionLabel(masterKeyName, 2)
+	dataKey, wrappedKey := wrapped(t, store, next)
+
+	provider.failRecord = false
+
+	masterKey, err := service.RotateMasterKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if masterKey.Current().BackendLabel != next {
+		t.Fatalf("current version is %q, want %q", masterKey.Current().BackendLabel, next)
+	}
+
+	got, err := store.UnwrapDataKey(ctx, next, wrappedKey)
+	if err != nil || !bytes.Equal(got, dataKey) {
+		t.Fatalf("unrecorded master key was replaced: %v", err)
+	}
+}
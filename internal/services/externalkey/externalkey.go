@@ -0,0 +1,150 @@
+package externalkey
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"time"
+	"tms/internal/domain/errs"
+	"tms/internal/domain/models"
+	"tms/internal/services/crypto"
+	"tms/internal/storage"
+)
+
+// ExternalKeyService registers public keys and certificates of partners so
+// that signatures made outside this service can be verified. Registered
+// keys are trusted as they are: certificates are pinned, not chained.
+type ExternalKeyService struct {
+	log         *slog.Logger
+	keyProvider Provider
+	authorizer  Authorizer
+}
+
+type Provider interface {
+	SaveExternalKey(ctx context.Context, key models.ExternalKey) error
+	DeleteExternalKey(ctx context.Context, userId string, label string) (bool, error)
+	KeyPair(ctx context.Context, label string) (models.Key, error)
+}
+
+type Authorizer interface {
+	AuthorizeExternalKey(ctx context.Context, userId string, label string) (models.ExternalKey, error)
+}
+
+func New(
+	log *slog.Logger,
+	keyProvider Provider,
+	authorizer Authorizer,
+) *ExternalKeyService {
+	return &ExternalKeyService{
+		log:         log,
+		keyProvider: keyProvider,
+		authorizer:  authorizer,
+	}
+}
+
+// ImportExternalKey registers the PEM encoded public key or certificate
+// under label for userId. Certificates must allow signing and be valid now.
+func (s *ExternalKeyService) ImportExternalKey(
+	ctx context.Context,
+	userId string,
+	label string,
+	pemData string,
+) (models.ExternalKey, error) {
+	const op = "services.externalkey.ImportExternalKey"
+
+	publicKey, certificate, err := crypto.ParsePublicKeyPEM([]byte(pemData))
+	if err != nil {
+		return models.ExternalKey{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	algorithm, err := crypto.AlgorithmOf(publicKey)
+	if err != nil {
+		return models.ExternalKey{}, fmt.Errorf("%s: %w", op, err)
+	}
+	fingerprint, err := crypto.Fingerprint(publicKey)
+	if err != nil {
+		return models.ExternalKey{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	now := time.Now().UTC()
+	key := models.ExternalKey{
+		Label:       label,
+		UserId:      userId,
+		Kind:        models.ExternalKeyPublicKey,
+		PEM:         pemData,
+		Algorithm:   string(algorithm),
+		Fingerprint: fingerprint,
+		CreatedAt:   now,
+	}
+
+	if certificate != nil {
+		if err := checkCertificate(certificate, now); err != nil {
+			return models.ExternalKey{}, fmt.Errorf("%s: %w", op, err)
+		}
+
+		key.Kind = models.ExternalKeyCertificate
+		key.Subject = certificate.Subject.String()
+		key.Issuer = certificate.Issuer.String()
+		key.NotBefore = certificate.NotBefore.UTC()
+		key.NotAfter = certificate.NotAfter.UTC()
+	}
+
+	_, err = s.keyProvider.KeyPair(ctx, label)
+	switch {
+	case err == nil:
+		return models.ExternalKey{}, fmt.Errorf("%s: %w", op, errs.AlreadyExists(storage.ResourceKeyPair, label))
+	case !errors.Is(err, errs.KindNotFound):
+		return models.ExternalKey{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := s.keyProvider.SaveExternalKey(ctx, key); err != nil {
+		return models.ExternalKey{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.log.Info("external key imported",
+		slog.String("op", op),
+		slog.String("label", label),
+		slog.String("kind", key.Kind),
+		slog.String("fingerprint", fingerprint),
+	)
+
+	return key, nil
+}
+
+// DeleteExternalKey forgets an external key owned by userId.
+func (s *ExternalKeyService) DeleteExternalKey(ctx context.Context, userId string, label string) (models.ExternalKey, error) {
+	const op = "services.externalkey.DeleteExternalKey"
+
+	key, err := s.authorizer.AuthorizeExternalKey(ctx, userId, label)
+	if err != nil {
+		return models.ExternalKey{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if _, err := s.keyProvider.DeleteExternalKey(ctx, userId, label); err != nil {
+		return models.ExternalKey{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.log.Info("external key deleted", slog.String("op", op), slog.String("label", label))
+
+	return key, nil
+}
+
+// checkCertificate rejects certificates that may not sign or are not valid
+// at now.
+func checkCertificate(certificate *x509.Certificate, now time.Time) error {
+	const signing = x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment
+
+	if certificate.KeyUsage != 0 && certificate.KeyUsage&signing == 0 {
+		return errs.InvalidField("pem", "certificate does not allow digital signatures")
+	}
+	if now.Before(certificate.NotBefore) || now.After(certificate.NotAfter) {
+		return errs.InvalidField("pem", fmt.Sprintf("certificate is only valid from %s to %s",
+			certificate.NotBefore.UTC().Format(time.RFC3339),
+			certificate.NotAfter.UTC().Format(time.RFC3339),
+		))
+	}
+
+	return nil
+}
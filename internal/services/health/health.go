@@ -0,0 +1,191 @@
+package health
+
+import (
+	"context"
+	"golang.org/x/exp/slog"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"sync"
+	"time"
+)
+
+const (
+	// LivenessService is SERVING for as long as the process accepts calls.
+	LivenessService = "liveness"
+	// ReadinessService is SERVING only while the probes passed to
+	// SetReadiness pass. Other failing dependencies only affect the
+	// services that declared them, so that the pod keeps receiving the
+	// calls it can still serve.
+	ReadinessService = "readiness"
+)
+
+// Probe checks a single dependency and returns an error when it is unusable.
+type Probe func(ctx context.Context) error
+
+// Checker periodically runs dependency probes and publishes the result as
+// per-service statuses on a grpc.health.v1 server.
+type Checker struct {
+	log      *slog.Logger
+	server   *health.Server
+	interval time.Duration
+	timeout  time.Duration
+
+	mu        sync.Mutex
+	probes    map[string]Probe
+	services  map[string][]string
+	readiness []string
+	failing   map[string]bool
+}
+
+func New(
+	log *slog.Logger,
+	server *health.Server,
+	interval time.Duration,
+	timeout time.Duration,
+) *Checker {
+	server.SetServingStatus(LivenessService, healthpb.HealthCheckResponse_SERVING)
+	server.SetServingStatus(ReadinessService, healthpb.HealthCheckResponse_NOT_SERVING)
+	server.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+
+	return &Checker{
+		log:      log,
+		server:   server,
+		interval: interval,
+		timeout:  timeout,
+		probes:   make(map[string]Probe),
+		services: make(map[string][]string),
+		failing:  make(map[string]bool),
+	}
+}
+
+// AddProbe registers a named dependency probe.
+func (c *Checker) AddProbe(name string, probe Probe) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.probes[name] = probe
+}
+
+// AddService declares a gRPC service as SERVING only while all of the named
+// dependencies are healthy. The service starts as NOT_SERVING until the
+// first check has run.
+func (c *Checker) AddService(service string, dependencies ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.services[service] = dependencies
+	c.server.SetServingStatus(service, healthpb.HealthCheckResponse_NOT_SERVING)
+}
+
+// SetReadiness declares the dependencies readiness and the overall ("")
+// status depend on. Without any, the server is ready once checked.
+func (c *Checker) SetReadiness(dependencies ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readiness = dependencies
+}
+
+// Run checks the dependencies immediately and then on every interval until
+// ctx is cancelled.
+func (c *Checker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		c.Check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check runs every probe once, concurrently, and updates the published
+// statuses. The probes run without holding the lock, so a slow dependency
+// delays its own status only.
+func (c *Checker) Check(ctx context.Context) {
+	const op = "services.health.Check"
+
+	log := c.log.With(slog.String("op", op))
+
+	c.mu.Lock()
+	names := make([]string, 0, len(c.probes))
+	probes := make([]Probe, 0, len(c.probes))
+	for name, probe := range c.probes {
+		names = append(names, name)
+		probes = append(probes, probe)
+	}
+	c.mu.Unlock()
+
+	results := make([]error, len(probes))
+
+	var wg sync.WaitGroup
+	for i, probe := range probes {
+		wg.Add(1)
+		go func(i int, probe Probe) {
+			defer wg.Done()
+
+			probeCtx, cancel := context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+
+			results[i] = probe(probeCtx)
+		}(i, probe)
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	healthy := make(map[string]bool, len(names))
+
+	for i, name := range names {
+		err := results[i]
+
+		healthy[name] = err == nil
+
+		switch {
+		case err != nil && !c.failing[name]:
+			log.Warn("dependency is unhealthy", slog.String("dependency", name), slog.Any("error", err))
+		case err == nil && c.failing[name]:
+			log.Info("dependency recovered", slog.String("dependency", name))
+		}
+		c.failing[name] = err != nil
+	}
+
+	for service, dependencies := range c.services {
+		c.server.SetServingStatus(service, servingStatus(allHealthy(healthy, dependencies)))
+	}
+
+	ready := allHealthy(healthy, c.readiness)
+	c.server.SetServingStatus(ReadinessService, servingStatus(ready))
+	c.server.SetServingStatus("", servingStatus(ready))
+}
+
+// allHealthy reports whether every one of dependencies passed its probe.
+// Dependencies without a probe count as failing.
+func allHealthy(healthy map[string]bool, dependencies []string) bool {
+	for _, dependency := range dependencies {
+		if !healthy[dependency] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Shutdown reports every service as NOT_SERVING so that load balancers stop
+// routing new calls while the server drains.
+func (c *Checker) Shutdown() {
+	c.server.Shutdown()
+}
+
+func servingStatus(serving bool) healthpb.HealthCheckResponse_ServingStatus {
+	if serving {
+		return healthpb.HealthCheckResponse_SERVING
+	}
+
+	return healthpb.HealthCheckResponse_NOT_SERVING
+}
@@ -0,0 +1,141 @@
+package keypair
+
+import (
+	"context"
+	gocrypto "crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"tms/internal/domain/errs"
+	"tms/internal/domain/models"
+	"tms/internal/services/crypto"
+)
+
+// wrappingKeyLabel addresses the key imported keys are wrapped for. The '#'
+// cannot appear in labels users choose.
+const wrappingKeyLabel = "#wrapping"
+
+// WrappingKey returns the public key customers wrap their private keys for
+// before ImportKeyPair, generating it in the backend on first use.
+func (s *KeyPairService) WrappingKey(ctx context.Context) (models.WrappingKey, error) {
+	const op = "services.keypair.WrappingKey"
+
+	publicKey, err := s.keyManager.WrappingKey(ctx, wrappingKeyLabel)
+	if err != nil {
+		return models.WrappingKey{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return models.WrappingKey{}, fmt.Errorf("%s: %w", op, err)
+	}
+	sum := sha256.Sum256(der)
+
+	return models.WrappingKey{
+		Algorithm:   string(crypto.WrappingAlgorithm),
+		Scheme:      crypto.WrappingScheme,
+		PEM:         string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		Fingerprint: hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+// ImportKeyPair brings a key generated by its owner into the backend under
+// label for userId. wrapped is the private key in crypto.WrappingScheme
+// format, wrapped for the key WrappingKey returns; publicKeyPEM holds its
+// public half, which the backend cannot derive. The key is unwrapped inside
+// the backend, proven to match the public key with a test signature and
+// recorded as imported. Otherwise it behaves like a key from CreateKeyPair,
+// except that it cannot be rotated.
+func (s *KeyPairService) ImportKeyPair(
+	ctx context.Context,
+	userId string,
+	label string,
+	publicKeyPEM string,
+	wrapped []byte,
+	scheme crypto.Scheme,
+	preActive bool,
+) (models.Key, error) {
+	const op = "services.keypair.ImportKeyPair"
+
+	log := s.log.With(slog.String("op", op))
+
+	publicKey, _, err := crypto.ParsePublicKeyPEM([]byte(publicKeyPEM))
+	if err != nil {
+		return models.Key{}, fmt.Errorf("%s: %w", op, err)
+	}
+	algorithm, err := crypto.AlgorithmOf(publicKey)
+	if err != nil {
+		return models.Key{}, fmt.Errorf("%s: %w", op, errs.InvalidField("pem", err.Error()))
+	}
+
+	if scheme == "" {
+		scheme = crypto.DefaultScheme(algorithm)
+	}
+	if err := crypto.CheckScheme(algorithm, scheme); err != nil {
+		return models.Key{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := s.checkLabel(ctx, label); err != nil {
+		return models.Key{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// Make sure the wrapping key exists, so that a customer who wrapped for
+	// a key that was never generated gets a decryption error, not NotFound.
+	if _, err := s.keyManager.WrappingKey(ctx, wrappingKeyLabel); err != nil {
+		return models.Key{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	info, err := s.keyManager.ImportKeyPair(ctx, label, wrappingKeyLabel, wrapped, publicKey)
+	if err != nil {
+		return models.Key{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := s.checkImported(ctx, label, scheme, publicKey); err != nil {
+		if deleteErr := s.keyManager.DeleteKeyPair(context.WithoutCancel(ctx), label); deleteErr != nil {
+			log.Error("failed to remove rejected imported key", slog.String("label", label), slog.Any("error", deleteErr))
+		}
+		return models.Key{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	key := newKey(userId, info, scheme, preActive, models.KeyProvenanceImported)
+	if err := s.save(ctx, key); err != nil {
+		return models.Key{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("key pair imported",
+		slog.String("label", label),
+		slog.String("algorithm", string(info.Algorithm)),
+		slog.String("scheme", string(scheme)),
+	)
+
+	return key, nil
+}
+
+// checkImported signs random data with the imported private key and checks
+// the signature against the public key the customer submitted. The PKCS#11
+// backend stores the public key as given, so nothing else ties the halves.
+func (s *KeyPairService) checkImported(ctx context.Context, label string, scheme crypto.Scheme, publicKey gocrypto.PublicKey) error {
+	probe := make([]byte, 32)
+	if _, err := rand.Read(probe); err != nil {
+		return err
+	}
+
+	signature, err := s.keyManager.Sign(ctx, label, scheme, probe)
+	if err != nil {
+		return err
+	}
+
+	valid, err := crypto.Verify(publicKey, scheme, probe, signature)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return errs.InvalidField("pem", "does not match the wrapped private key")
+	}
+
+	return nil
+}
@@ -0,0 +1,626 @@
+package keypair
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"slices"
+	"time"
+	"tms/internal/domain/errs"
+	"tms/internal/domain/models"
+	"tms/internal/services/crypto"
+	"tms/internal/storage"
+)
+
+// KeyPairService ties key pairs in a crypto.KeyManager backend to the users
+// that own them. The backend holds the keys, the provider their metadata.
+type KeyPairService struct {
+	log         *slog.Logger
+	keyManager  crypto.KeyManager
+	keyProvider Provider
+	authorizer  Authorizer
+	// deletionGrace is how long a deleted key can be restored.
+	deletionGrace time.Duration
+}
+
+// keyRotationLease is how long a claimed rotation keeps other rotations of
+// the key out. A rotation that crashed is taken over once it has run out.
+const keyRotationLease = 10 * time.Minute
+
+type Provider interface {
+	SaveKeyPair(ctx context.Context, key models.Key) error
+	KeyPair(ctx context.Context, label string) (models.Key, error)
+	KeyPairsByUser(ctx context.Context, userId string) ([]models.Key, error)
+	ExternalKey(ctx context.Context, label string) (models.ExternalKey, error)
+	ClaimKeyRotation(ctx context.Context, label string, from int, at time.Time, lease time.Duration) error
+	ReleaseKeyRotation(ctx context.Context, label string, at time.Time) error
+	RotateKeyPair(ctx context.Context, label string, from int, at time.Time, versions []models.KeyVersion) error
+	KeyPairsDueForRotation(ctx context.Context, cutoff time.Time) ([]models.Key, error)
+	ChangeKeyState(ctx context.Context, label string, change models.KeyStateChange, compromisedAt time.Time) error
+	ScheduleKeyDeletion(ctx context.Context, userId string, label string, deletion models.KeyDeletion) error
+	CancelKeyDeletion(ctx context.Context, label string) error
+	KeyPairsDueForDeletion(ctx context.Context, now time.Time) ([]models.Key, error)
+	ClaimKeyDeletion(ctx context.Context, label string, at time.Time, lease time.Duration) error
+	RecordKeyDeletionFailure(ctx context.Context, label string, cause string) error
+	MarkKeyDestroyed(ctx context.Context, label string, change models.KeyStateChange) error
+	DeleteKeyPair(ctx context.Context, userId string, keyLabel string) (bool, error)
+}
+
+type Authorizer interface {
+	AuthorizeKey(ctx context.Context, userId string, label string) (models.Key, error)
+}
+
+func New(
+	log *slog.Logger,
+	keyManager crypto.KeyManager,
+	keyProvider Provider,
+	authorizer Authorizer,
+	deletionGrace time.Duration,
+) *KeyPairService {
+	return &KeyPairService{
+		log:           log,
+		keyManager:    keyManager,
+		keyProvider:   keyProvider,
+		authorizer:    authorizer,
+		deletionGrace: deletionGrace,
+	}
+}
+
+// CreateKeyPair generates a key pair of the given algorithm under label for
+// userId. The key signs with scheme, or with the default scheme of its
+// algorithm when scheme is empty. A preActive key cannot sign until it is
+// activated. Labels are unique: a label already known to storage or to the
+// backend is rejected with AlreadyExists rather than shadowed.
+func (s *KeyPairService) CreateKeyPair(
+	ctx context.Context,
+	userId string,
+	label string,
+	algorithm crypto.Algorithm,
+	scheme crypto.Scheme,
+	preActive bool,
+) (models.Key, error) {
+	const op = "services.keypair.CreateKeyPair"
+
+	log := s.log.With(slog.String("op", op))
+
+	if scheme == "" {
+		scheme = crypto.DefaultScheme(algorithm)
+	}
+	if err := crypto.CheckScheme(algorithm, scheme); err != nil {
+		return models.Key{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := s.checkLabel(ctx, label); err != nil {
+		return models.Key{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	info, err := s.keyManager.GenerateKeyPair(ctx, label, algorithm)
+	if err != nil {
+		return models.Key{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	key := newKey(userId, info, scheme, preActive, models.KeyProvenanceGenerated)
+	if err := s.save(ctx, key); err != nil {
+		return models.Key{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("key pair created",
+		slog.String("label", label),
+		slog.String("algorithm", string(info.Algorithm)),
+		slog.String("scheme", string(scheme)),
+	)
+
+	return key, nil
+}
+
+// checkLabel rejects a label already taken. External keys share the label
+// namespace, so verification never has to choose between two keys. A label
+// only the backend knows is rejected by the backend itself.
+func (s *KeyPairService) checkLabel(ctx context.Context, label string) error {
+	_, err := s.keyProvider.KeyPair(ctx, label)
+	switch {
+	case err == nil:
+		return errs.AlreadyExists(storage.ResourceKeyPair, label)
+	case !errors.Is(err, errs.KindNotFound):
+		return err
+	}
+
+	_, err = s.keyProvider.ExternalKey(ctx, label)
+	switch {
+	case err == nil:
+		return errs.AlreadyExists(storage.ResourceExternalKey, label)
+	case !errors.Is(err, errs.KindNotFound):
+		return err
+	}
+
+	return nil
+}
+
+// newKey describes version 1 of a key that was just put into the backend.
+func newKey(userId string, info crypto.KeyInfo, scheme crypto.Scheme, preActive bool, provenance string) models.Key {
+	state := models.KeyStateActive
+	if preActive {
+		state = models.KeyStatePreActive
+	}
+
+	now := time.Now().UTC()
+	return models.Key{
+		Label:     info.Label,
+		Algorithm: string(info.Algorithm),
+		Scheme:    string(scheme),
+		User:      models.KeyUser{ID: userId},
+		Version:   1,
+		Versions: []models.KeyVersion{{
+			Version:      1,
+			BackendLabel: models.VersionLabel(info.Label, 1),
+			CreatedAt:    now,
+		}},
+		VersionCreatedAt: now,
+		State:            state,
+		StateChangedAt:   now,
+		StateHistory:     []models.KeyStateChange{{To: state, At: now}},
+		Provenance:       provenance,
+	}
+}
+
+// save records a new key. When that fails the key is removed from the
+// backend, so no keys are left there that no user owns.
+func (s *KeyPairService) save(ctx context.Context, key models.Key) error {
+	if err := s.keyProvider.SaveKeyPair(ctx, key); err != nil {
+		if deleteErr := s.keyManager.DeleteKeyPair(context.WithoutCancel(ctx), key.Label); deleteErr != nil {
+			s.log.Error("failed to remove orphaned key pair", slog.String("label", key.Label), slog.Any("error", deleteErr))
+		}
+		return err
+	}
+
+	return nil
+}
+
+// RotateKey generates the next version of a key owned by userId. The new
+// version signs from now on; the previous one is kept to verify the
+// signatures it made.
+func (s *KeyPairService) RotateKey(ctx context.Context, userId string, label string) (models.Key, error) {
+	const op = "services.keypair.RotateKey"
+
+	key, err := s.authorizer.AuthorizeKey(ctx, userId, label)
+	if err != nil {
+		return models.Key{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	key, err = s.rotate(ctx, key)
+	if err != nil {
+		return models.Key{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return key, nil
+}
+
+// RunRotation rotates every key whose current version is older than maxAge,
+// checking every interval until ctx is done. Rotations are claimed, so a key
+// another replica or a RotateKey call is rotating is skipped.
+func (s *KeyPairService) RunRotation(ctx context.Context, interval time.Duration, maxAge time.Duration) {
+	const op = "services.keypair.RunRotation"
+
+	log := s.log.With(slog.String("op", op))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		keys, err := s.keyProvider.KeyPairsDueForRotation(ctx, time.Now().Add(-maxAge))
+		if err != nil {
+			log.Error("failed to list keys due for rotation", slog.Any("error", err))
+		}
+
+		for _, key := range keys {
+			if ctx.Err() != nil {
+				return
+			}
+			_, err := s.rotate(ctx, key)
+			if errors.Is(err, errs.KindFailedPrecondition) {
+				log.Debug("key rotation claimed elsewhere or key changed", slog.String("label", key.Label), slog.Any("error", err))
+				continue
+			}
+			if err != nil {
+				log.Error("automatic key rotation failed", slog.String("label", key.Label), slog.Any("error", err))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// rotate claims the rotation of key for keyRotationLease, so that only one
+// rotation of a key runs at a time, and makes backendLabel its next version.
+func (s *KeyPairService) rotate(ctx context.Context, key models.Key) (models.Key, error) {
+	if key.Deletion != nil {
+		return models.Key{}, errs.FailedPrecondition(fmt.Sprintf("key pair %q is scheduled for deletion", key.Label))
+	}
+	if state := key.CurrentState(); state != models.KeyStateActive {
+		return models.Key{}, errs.FailedPrecondition(fmt.Sprintf("key pair %q is %s, only active keys are rotated", key.Label, state))
+	}
+	// A new version would be generated here, which defeats the point of
+	// bringing your own key.
+	if key.CurrentProvenance() == models.KeyProvenanceImported {
+		return models.Key{}, errs.FailedPrecondition(fmt.Sprintf("key pair %q was imported, import a new key instead of rotating it", key.Label))
+	}
+
+	from := key.CurrentVersion()
+	next := from + 1
+	backendLabel := models.VersionLabel(key.Label, next)
+
+	claimedAt := time.Now().UTC()
+	if err := s.keyProvider.ClaimKeyRotation(ctx, key.Label, from, claimedAt, keyRotationLease); err != nil {
+		return models.Key{}, err
+	}
+
+	rotated, err := s.rotateTo(ctx, key, claimedAt, backendLabel)
+	if err != nil {
+		if releaseErr := s.keyProvider.ReleaseKeyRotation(context.WithoutCancel(ctx), key.Label, claimedAt); releaseErr != nil {
+			s.log.Error("failed to release key rotation", slog.String("label", key.Label), slog.Any("error", releaseErr))
+		}
+		return models.Key{}, err
+	}
+
+	s.log.Info("key rotated", slog.String("label", key.Label), slog.Int("version", rotated.CurrentVersion()))
+
+	return rotated, nil
+}
+
+// rotateTo generates backendLabel and records it as the version after the
+// current one of key. A key is never deleted here: one that is already in
+// the backend but not recorded was left by a rotation that failed before
+// recording it, so nothing has signed with it and it is recorded as it is.
+// When recording fails, the key is read again and the version is adopted if
+// another rotation recorded it.
+func (s *KeyPairService) rotateTo(ctx context.Context, key models.Key, claimedAt time.Time, backendLabel string) (models.Key, error) {
+	_, err := s.keyManager.GenerateKeyPair(ctx, backendLabel, crypto.StoredAlgorithm(key.Algorithm))
+	if errors.Is(err, errs.KindAlreadyExists) {
+		s.log.Warn("recording key left by an interrupted rotation", slog.String("label", backendLabel))
+	} else if err != nil {
+		return models.Key{}, err
+	}
+
+	from := key.CurrentVersion()
+	now := time.Now().UTC()
+
+	versions := append([]models.KeyVersion(nil), key.Versions...)
+	if len(versions) == 0 {
+		versions = []models.KeyVersion{{Version: 1, BackendLabel: key.Label}}
+	}
+	versions[len(versions)-1].RetiredAt = now
+	versions = append(versions, models.KeyVersion{
+		Version:      from + 1,
+		BackendLabel: backendLabel,
+		CreatedAt:    now,
+	})
+
+	err = s.keyProvider.RotateKeyPair(ctx, key.Label, from, claimedAt, versions)
+	if err == nil {
+		key.Version = from + 1
+		key.Versions = versions
+		key.VersionCreatedAt = now
+		return key, nil
+	}
+
+	recorded, readErr := s.keyProvider.KeyPair(context.WithoutCancel(ctx), key.Label)
+	if readErr != nil {
+		return models.Key{}, errors.Join(err, readErr)
+	}
+	if current, _ := recorded.BackendLabel(recorded.CurrentVersion()); current == backendLabel {
+		return recorded, nil
+	}
+
+	return models.Key{}, err
+}
+
+// DeleteKeyPair schedules a key pair owned by userId for destruction once
+// the grace period is over. Until then the key cannot sign and the deletion
+// can be cancelled. Deleting a key that is already scheduled returns the
+// existing schedule.
+func (s *KeyPairService) DeleteKeyPair(ctx context.Context, userId string, label string) (models.Key, error) {
+	const op = "services.keypair.DeleteKeyPair"
+
+	key, err := s.authorizer.AuthorizeKey(ctx, userId, label)
+	if err != nil {
+		return models.Key{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	key, err = s.scheduleDeletion(ctx, userId, key, models.KeyDeletion{})
+	if err != nil {
+		return models.Key{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return key, nil
+}
+
+// scheduleDeletion schedules the destruction of key after the grace period,
+// unless it is already scheduled. deletion holds what to keep afterwards.
+func (s *KeyPairService) scheduleDeletion(ctx context.Context, userId string, key models.Key, deletion models.KeyDeletion) (models.Key, error) {
+	if key.Deletion != nil {
+		return key, nil
+	}
+
+	now := time.Now().UTC()
+	deletion.RequestedAt = now
+	deletion.DestroyAfter = now.Add(s.deletionGrace)
+
+	if err := s.keyProvider.ScheduleKeyDeletion(ctx, userId, key.Label, deletion); err != nil {
+		return models.Key{}, err
+	}
+	key.Deletion = &deletion
+
+	s.log.Info("key pair scheduled for deletion",
+		slog.String("label", key.Label),
+		slog.Bool("keep_metadata", deletion.KeepMetadata),
+		slog.Time("destroy_after", deletion.DestroyAfter),
+	)
+
+	return key, nil
+}
+
+// CancelKeyDeletion keeps a key scheduled for deletion whose destruction has
+// not started yet.
+func (s *KeyPairService) CancelKeyDeletion(ctx context.Context, userId string, label string) (models.Key, error) {
+	const op = "services.keypair.CancelKeyDeletion"
+
+	key, err := s.authorizer.AuthorizeKey(ctx, userId, label)
+	if err != nil {
+		return models.Key{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if key.Deletion == nil {
+		return models.Key{}, fmt.Errorf("%s: %w", op, errs.FailedPrecondition(fmt.Sprintf("key pair %q is not scheduled for deletion", label)))
+	}
+
+	if err := s.keyProvider.CancelKeyDeletion(ctx, label); err != nil {
+		return models.Key{}, fmt.Errorf("%s: %w", op, err)
+	}
+	key.Deletion = nil
+
+	s.log.Info("key pair deletion cancelled", slog.String("op", op), slog.String("label", label))
+
+	return key, nil
+}
+
+// RunDeletion destroys the keys whose grace period is over, every interval
+// until ctx is done. Each destruction is claimed first, so that replicas
+// running this concurrently do not destroy the same key: a key claimed by
+// another replica is skipped, and taken over only once its lease is over.
+// A destruction that fails releases its claim and is resumed on the next
+// run.
+func (s *KeyPairService) RunDeletion(ctx context.Context, interval time.Duration, lease time.Duration) {
+	const op = "services.keypair.RunDeletion"
+
+	log := s.log.With(slog.String("op", op))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		keys, err := s.keyProvider.KeyPairsDueForDeletion(ctx, time.Now().UTC())
+		if err != nil {
+			log.Error("failed to list keys due for deletion", slog.Any("error", err))
+		}
+
+		for _, key := range keys {
+			if ctx.Err() != nil {
+				return
+			}
+
+			err := s.keyProvider.ClaimKeyDeletion(ctx, key.Label, time.Now().UTC(), lease)
+			if errors.Is(err, errs.KindFailedPrecondition) {
+				log.Debug("key pair destruction claimed elsewhere or cancelled", slog.String("label", key.Label))
+				continue
+			}
+			if err != nil {
+				log.Error("failed to claim key pair destruction", slog.String("label", key.Label), slog.Any("error", err))
+				continue
+			}
+
+			if err := s.destroy(ctx, key); err != nil {
+				log.Error("key pair destruction failed", slog.String("label", key.Label), slog.Any("error", err))
+				if recordErr := s.keyProvider.RecordKeyDeletionFailure(ctx, key.Label, err.Error()); recordErr != nil {
+					log.Error("failed to record destruction failure", slog.String("label", key.Label), slog.Any("error", recordErr))
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// destroy removes every version of a claimed key from the backend, then its
+// metadata, or only marks it destroyed when the metadata is kept. Every
+// step can be repeated, so a destruction that started is simply run again
+// until it completes.
+func (s *KeyPairService) destroy(ctx context.Context, key models.Key) error {
+	log := s.log.With(slog.String("label", key.Label))
+
+	if key.Deletion.StartedAt.IsZero() {
+		log.Info("key pair destruction started")
+	} else {
+		log.Warn("resuming key pair destruction",
+			slog.Time("started_at", key.Deletion.StartedAt),
+			slog.Int("attempts", key.Deletion.Attempts),
+		)
+	}
+
+	// A version already gone from the backend was destroyed by an earlier attempt.
+	for _, backendLabel := range key.BackendLabels() {
+		if err := s.keyManager.DeleteKeyPair(ctx, backendLabel); err != nil && !errors.Is(err, errs.KindNotFound) {
+			return err
+		}
+		log.Info("key version destroyed", slog.String("backend_label", backendLabel))
+	}
+
+	if key.Deletion.KeepMetadata {
+		change := models.KeyStateChange{
+			From:   key.CurrentState(),
+			To:     models.KeyStateDestroyed,
+			Reason: key.Deletion.Reason,
+			At:     time.Now().UTC(),
+		}
+		if err := s.keyProvider.MarkKeyDestroyed(ctx, key.Label, change); err != nil {
+			return err
+		}
+
+		log.Info("key pair destroyed, metadata kept")
+
+		return nil
+	}
+
+	if _, err := s.keyProvider.DeleteKeyPair(ctx, key.User.ID, key.Label); err != nil && !errors.Is(err, errs.KindNotFound) {
+		return err
+	}
+
+	log.Info("key pair destroyed")
+
+	return nil
+}
+
+// transitions lists the states each lifecycle state may move to. Active keys
+// have to be suspended or revoked before they are destroyed.
+var transitions = map[string][]string{
+	models.KeyStatePreActive: {models.KeyStateActive, models.KeyStateDestroyed},
+	models.KeyStateActive:    {models.KeyStateSuspended, models.KeyStateRevoked},
+	models.KeyStateSuspended: {models.KeyStateActive, models.KeyStateRevoked, models.KeyStateDestroyed},
+	models.KeyStateRevoked:   {models.KeyStateDestroyed},
+}
+
+// ActivateKey lets a pre-active or suspended key sign.
+func (s *KeyPairService) ActivateKey(ctx context.Context, userId string, label string, reason string) (models.Key, error) {
+	const op = "services.keypair.ActivateKey"
+
+	key, err := s.transition(ctx, userId, label, models.KeyStateActive, reason, time.Time{})
+	if err != nil {
+		return models.Key{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return key, nil
+}
+
+// SuspendKey stops a key from signing until it is activated again.
+func (s *KeyPairService) SuspendKey(ctx context.Context, userId string, label string, reason string) (models.Key, error) {
+	const op = "services.keypair.SuspendKey"
+
+	key, err := s.transition(ctx, userId, label, models.KeyStateSuspended, reason, time.Time{})
+	if err != nil {
+		return models.Key{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return key, nil
+}
+
+// RevokeKey stops a key from signing for good. Signatures made from
+// compromisedAt on are no longer trusted; a zero compromisedAt means now.
+func (s *KeyPairService) RevokeKey(
+	ctx context.Context,
+	userId string,
+	label string,
+	reason string,
+	compromisedAt time.Time,
+) (models.Key, error) {
+	const op = "services.keypair.RevokeKey"
+
+	now := time.Now().UTC()
+	if compromisedAt.IsZero() {
+		compromisedAt = now
+	}
+	if compromisedAt.After(now) {
+		return models.Key{}, fmt.Errorf("%s: %w", op, errs.InvalidField("compromised_at", "must not be in the future"))
+	}
+
+	key, err := s.transition(ctx, userId, label, models.KeyStateRevoked, reason, compromisedAt.UTC())
+	if err != nil {
+		return models.Key{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return key, nil
+}
+
+// DestroyKey schedules the destruction of every version of a key in the
+// backend, like DeleteKeyPair: until the grace period is over the key cannot
+// sign and the destruction can be cancelled. Afterwards the metadata stays
+// in the destroyed state, so verifying an old signature reports the key as
+// destroyed rather than unknown. Destroying a key that is already scheduled
+// returns the existing schedule.
+func (s *KeyPairService) DestroyKey(ctx context.Context, userId string, label string, reason string) (models.Key, error) {
+	const op = "services.keypair.DestroyKey"
+
+	key, err := s.authorizer.AuthorizeKey(ctx, userId, label)
+	if err != nil {
+		return models.Key{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if from := key.CurrentState(); key.Deletion == nil && !slices.Contains(transitions[from], models.KeyStateDestroyed) {
+		return models.Key{}, fmt.Errorf("%s: %w", op, errs.FailedPrecondition(fmt.Sprintf("key pair %q cannot go from %s to %s", label, from, models.KeyStateDestroyed)))
+	}
+
+	key, err = s.scheduleDeletion(ctx, userId, key, models.KeyDeletion{KeepMetadata: true, Reason: reason})
+	if err != nil {
+		return models.Key{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return key, nil
+}
+
+func (s *KeyPairService) transition(
+	ctx context.Context,
+	userId string,
+	label string,
+	to string,
+	reason string,
+	compromisedAt time.Time,
+) (models.Key, error) {
+	key, err := s.authorizer.AuthorizeKey(ctx, userId, label)
+	if err != nil {
+		return models.Key{}, err
+	}
+
+	return s.changeState(ctx, key, to, reason, compromisedAt)
+}
+
+func (s *KeyPairService) changeState(
+	ctx context.Context,
+	key models.Key,
+	to string,
+	reason string,
+	compromisedAt time.Time,
+) (models.Key, error) {
+	from := key.CurrentState()
+	if !slices.Contains(transitions[from], to) {
+		return models.Key{}, errs.FailedPrecondition(fmt.Sprintf("key pair %q cannot go from %s to %s", key.Label, from, to))
+	}
+
+	change := models.KeyStateChange{From: from, To: to, Reason: reason, At: time.Now().UTC()}
+	if err := s.keyProvider.ChangeKeyState(ctx, key.Label, change, compromisedAt); err != nil {
+		return models.Key{}, err
+	}
+
+	key.State = to
+	key.StateReason = reason
+	key.StateChangedAt = change.At
+	if !compromisedAt.IsZero() {
+		key.CompromisedAt = compromisedAt
+	}
+	key.StateHistory = append(key.StateHistory, change)
+
+	s.log.Info("key state changed",
+		slog.String("label", key.Label),
+		slog.String("from", from),
+		slog.String("to", to),
+		slog.String("reason", reason),
+	)
+
+	return key, nil
+}
@@ -0,0 +1,357 @@
+package keypair
+
+import (
+	"context"
+	gocrypto "crypto"
+	"errors"
+	"golang.org/x/exp/slog"
+	"io"
+	"sync"
+	"testing"
+	"time"
+	"tms/internal/domain/errs"
+	"tms/internal/domain/models"
+	"tms/internal/services/crypto"
+	"tms/internal/services/crypto/software"
+	"tms/internal/storage"
+)
+
+// keyPairs is an in-memory Provider with the rotation semantics of the
+// MongoDB one. Methods the tests do not use are left to the embedded nil
+// interface.
+type keyPairs struct {
+	Provider
+
+	mu   sync.Mutex
+	keys map[string]models.Key
+	// lostAck makes RotateKeyPair record the rotation and still fail, as
+	// when the reply is lost.
+	lostAck bool
+	// failRecord makes RotateKeyPair fail without recording anything.
+	failRecord bool
+}
+
+func (p *keyPairs) KeyPair(_ context.Context, label string) (models.Key, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, ok := p.keys[label]
+	if !ok {
+		return models.Key{}, errs.NotFound(storage.ResourceKeyPair, label)
+	}
+
+	return key, nil
+}
+
+func (p *keyPairs) ClaimKeyRotation(_ context.Context, label string, from int, at time.Time, lease time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, ok := p.keys[label]
+	if !ok || key.CurrentVersion() != from || (!key.RotationClaimedAt.IsZero() && key.RotationClaimedAt.After(at.Add(-lease))) {
+		return errs.FailedPrecondition("claimed or changed")
+	}
+	key.RotationClaimedAt = at
+	p.keys[label] = key
+
+	return nil
+}
+
+func (p *keyPairs) ReleaseKeyRotation(_ context.Context, label string, at time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[label]; ok && key.RotationClaimedAt.Equal(at) {
+		key.RotationClaimedAt = time.Time{}
+		p.keys[label] = key
+	}
+
+	return nil
+}
+
+func (p *keyPairs) RotateKeyPair(_ context.Context, label string, from int, at time.Time, versions []models.KeyVersion) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.failRecord {
+		return errors.New("connection reset")
+	}
+
+	key, ok := p.keys[label]
+	if !ok || key.CurrentVersion() != from || !key.RotationClaimedAt.Equal(at) {
+		return errs.FailedPrecondition("changed while rotating")
+	}
+	key.Version = versions[len(versions)-1].Version
+	key.Versions = versions
+	key.RotationClaimedAt = time.Time{}
+	p.keys[label] = key
+
+	if p.lostAck {
+		return errors.New("connection reset")
+	}
+
+	return nil
+}
+
+func (p *keyPairs) ChangeKeyState(_ context.Context, label string, change models.KeyStateChange, _ time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := p.keys[label]
+	if key.CurrentState() != change.From {
+		return errs.FailedPrecondition("state changed")
+	}
+	key.State = change.To
+	key.StateHistory = append(key.StateHistory, change)
+	p.keys[label] = key
+
+	return nil
+}
+
+func (p *keyPairs) ScheduleKeyDeletion(_ context.Context, _ string, label string, deletion models.KeyDeletion) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := p.keys[label]
+	if key.Deletion != nil {
+		return errs.FailedPrecondition("already scheduled")
+	}
+	key.Deletion = &deletion
+	p.keys[label] = key
+
+	return nil
+}
+
+func (p *keyPairs) MarkKeyDestroyed(_ context.Context, label string, change models.KeyStateChange) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := p.keys[label]
+	key.State = change.To
+	key.StateReason = change.Reason
+	key.StateHistory = append(key.StateHistory, change)
+	key.Deletion = nil
+	p.keys[label] = key
+
+	return nil
+}
+
+// owner lets every caller act on every key of provider.
+type owner struct {
+	provider *keyPairs
+}
+
+func (o owner) AuthorizeKey(ctx context.Context, _ string, label string) (models.Key, error) {
+	return o.provider.KeyPair(ctx, label)
+}
+
+func newService(t *testing.T) (*KeyPairService, *software.Store, *keyPairs, models.Key) {
+	t.Helper()
+
+	ctx := context.Background()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	store, err := software.New(log, software.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := store.GenerateKeyPair(ctx, "signing", crypto.AlgorithmECP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := models.Key{
+		Label:     info.Label,
+		Algorithm: string(info.Algorithm),
+		Scheme:    string(crypto.SchemeECDSASHA256),
+		User:      models.KeyUser{ID: "user"},
+	}
+
+	provider := &keyPairs{keys: map[string]models.Key{key.Label: key}}
+
+	return New(log, store, provider, owner{provider}, time.Hour), store, provider, key
+}
+
+// unchanged checks that backendLabel still holds the key whose public half
+// is public.
+func unchanged(t *testing.T, store *software.Store, backendLabel string, public gocrypto.PublicKey) {
+	t.Helper()
+
+	got, err := store.PublicKey(context.Background(), backendLabel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.(interface{ Equal(gocrypto.PublicKey) bool }).Equal(public) {
+		t.Fatalf("key %q was replaced", backendLabel)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	service, _, provider, key := newService(t)
+
+	rotated, err := service.rotate(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.CurrentVersion() != 2 || len(rotated.Versions) != 2 {
+		t.Fatalf("rotated to %+v, want version 2 of 2", rotated)
+	}
+	if rotated.Versions[0].RetiredAt.IsZero() {
+		t.Fatal("version 1 was not retired")
+	}
+	if !provider.keys[key.Label].RotationClaimedAt.IsZero() {
+		t.Fatal("rotation claim was not released")
+	}
+}
+
+// A version left in the backend by a rotation that failed before recording
+// it is recorded as it is, never replaced.
+func TestRotateKeepsLeftover(t *testing.T) {
+	ctx := context.Background()
+	service, store, _, key := newService(t)
+
+	leftover := models.VersionLabel(key.Label, 2)
+	if _, err := store.GenerateKeyPair(ctx, leftover, crypto.AlgorithmECP256); err != nil {
+		t.Fatal(err)
+	}
+	public, err := store.PublicKey(ctx, leftover)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := service.rotate(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := rotated.BackendLabel(rotated.CurrentVersion()); current != leftover {
+		t.Fatalf("current version is %q, want %q", current, leftover)
+	}
+
+	unchanged(t, store, leftover, public)
+}
+
+// Two rotations of the same version do not both run: the second one neither
+// generates nor deletes anything.
+func TestRotateClaimed(t *testing.T) {
+	ctx := context.Background()
+	service, store, provider, key := newService(t)
+
+	if err := provider.ClaimKeyRotation(ctx, key.Label, 1, time.Now().UTC(), keyRotationLease); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := service.rotate(ctx, key)
+	if !errors.Is(err, errs.KindFailedPrecondition) {
+		t.Fatalf("rotate = %v, want FailedPrecondition", err)
+	}
+
+	if _, err := store.FindKey(ctx, models.VersionLabel(key.Label, 2)); !errors.Is(err, errs.KindNotFound) {
+		t.Fatalf("a claimed rotation generated a key: %v", err)
+	}
+}
+
+// A rotation racing one that already recorded the version fails without
+// touching the recorded key.
+func TestRotateStale(t *testing.T) {
+	ctx := context.Background()
+	service, store, _, key := newService(t)
+
+	rotated, err := service.rotate(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, _ := rotated.BackendLabel(rotated.CurrentVersion())
+	public, err := store.PublicKey(ctx, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := service.rotate(ctx, key); !errors.Is(err, errs.KindFailedPrecondition) {
+		t.Fatalf("rotate of a stale key = %v, want FailedPrecondition", err)
+	}
+
+	unchanged(t, store, current, public)
+}
+
+// A rotation recorded although recording reported a failure is adopted.
+func TestRotateAdoptsRecorded(t *testing.T) {
+	ctx := context.Background()
+	service, store, provider, key := newService(t)
+	provider.lostAck = true
+
+	rotated, err := service.rotate(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.CurrentVersion() != 2 {
+		t.Fatalf("rotated to version %d, want 2", rotated.CurrentVersion())
+	}
+
+	if _, err := store.FindKey(ctx, models.VersionLabel(key.Label, 2)); err != nil {
+		t.Fatalf("recorded version is gone: %v", err)
+	}
+}
+
+// A rotation that failed to record keeps its key and releases its claim, so
+// that the next rotation records the same key.
+func TestRotateFailedRecord(t *testing.T) {
+	ctx := context.Background()
+	service, store, provider, key := newService(t)
+	provider.failRecord = true
+
+	if _, err := service.rotate(ctx, key); err == nil {
+		t.Fatal("rotate succeeded although recording failed")
+	}
+
+	next := models.VersionLabel(key.Label, 2)
+	public, err := store.PublicKey(ctx, next)
+	if err != nil {
+		t.Fatalf("unrecorded version was deleted: %v", err)
+	}
+
+	provider.failRecord = false
+
+	if _, err := service.rotate(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+
+	unchanged(t, store, next, public)
+}
+
+// Destroying a key goes through the grace period like deleting it, and
+// keeps its metadata once the versions are gone.
+func TestDestroyKey(t *testing.T) {
+	ctx := context.Background()
+	service, store, provider, key := newService(t)
+
+	if _, err := service.DestroyKey(ctx, "user", key.Label, "retired"); !errors.Is(err, errs.KindFailedPrecondition) {
+		t.Fatalf("DestroyKey of an active key = %v, want FailedPrecondition", err)
+	}
+
+	if _, err := service.SuspendKey(ctx, "user", key.Label, "retiring"); err != nil {
+		t.Fatal(err)
+	}
+
+	scheduled, err := service.DestroyKey(ctx, "user", key.Label, "retired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scheduled.Deletion == nil || !scheduled.Deletion.KeepMetadata || scheduled.Deletion.DestroyAfter.Before(time.Now().Add(time.Hour-time.Minute)) {
+		t.Fatalf("DestroyKey scheduled %+v, want the grace period with metadata kept", scheduled.Deletion)
+	}
+	if _, err := store.FindKey(ctx, key.Label); err != nil {
+		t.Fatalf("DestroyKey destroyed the key before the grace period: %v", err)
+	}
+
+	if err := service.destroy(ctx, provider.keys[key.Label]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.FindKey(ctx, key.Label); !errors.Is(err, errs.KindNotFound) {
+		t.Fatalf("key is still in the backend: %v", err)
+	}
+
+	destroyed := provider.keys[key.Label]
+	if destroyed.CurrentState() != models.KeyStateDestroyed || destroyed.StateReason != "retired" || destroyed.Deletion != nil {
+		t.Fatalf("metadata after destruction = %+v, want destroyed", destroyed)
+	}
+}
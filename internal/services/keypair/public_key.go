@@ -0,0 +1,175 @@
+package keypair
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"tms/internal/domain/errs"
+	"tms/internal/domain/models"
+	"tms/internal/lib/jwk"
+	"tms/internal/services/crypto"
+)
+
+// PublicKey exports version of a key owned by userId; version 0 is the
+// current version.
+func (s *KeyPairService) PublicKey(ctx context.Context, userId string, label string, version int) (models.PublicKey, error) {
+	const op = "services.keypair.PublicKey"
+
+	key, err := s.authorizer.AuthorizeKey(ctx, userId, label)
+	if err != nil {
+		return models.PublicKey{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if version == 0 {
+		version = key.CurrentVersion()
+	}
+
+	publicKey, _, err := s.exportPublicKey(ctx, key, version)
+	if err != nil {
+		return models.PublicKey{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return publicKey, nil
+}
+
+// PublicKeySet exports every version of every key owned by userId, along
+// with a JWK Set document of the keys whose signatures can still be trusted,
+// for verifiers that work offline. Revoked and destroyed keys are left out
+// of the set; destroyed keys are not listed at all.
+func (s *KeyPairService) PublicKeySet(ctx context.Context, userId string) ([]models.PublicKey, string, error) {
+	const op = "services.keypair.PublicKeySet"
+
+	keys, err := s.keyProvider.KeyPairsByUser(ctx, userId)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	var publicKeys []models.PublicKey
+	set := jwk.Set{Keys: []jwk.Key{}}
+
+	for _, key := range keys {
+		state := key.CurrentState()
+		if state == models.KeyStateDestroyed {
+			continue
+		}
+
+		for _, version := range keyVersions(key) {
+			publicKey, jwkKey, err := s.exportPublicKey(ctx, key, version)
+			if err != nil {
+				return nil, "", fmt.Errorf("%s: %w", op, err)
+			}
+
+			publicKeys = append(publicKeys, publicKey)
+			if state != models.KeyStateRevoked {
+				set.Keys = append(set.Keys, jwkKey)
+			}
+		}
+	}
+
+	document, err := json.Marshal(set)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return publicKeys, string(document), nil
+}
+
+func (s *KeyPairService) exportPublicKey(ctx context.Context, key models.Key, version int) (models.PublicKey, jwk.Key, error) {
+	if key.CurrentState() == models.KeyStateDestroyed {
+		return models.PublicKey{}, jwk.Key{}, errs.FailedPrecondition(fmt.Sprintf("key pair %q is destroyed", key.Label))
+	}
+
+	backendLabel, ok := key.BackendLabel(version)
+	if !ok {
+		return models.PublicKey{}, jwk.Key{}, errs.NotFound("key version", fmt.Sprintf("%s v%d", key.Label, version))
+	}
+
+	publicKey, err := s.keyManager.PublicKey(ctx, backendLabel)
+	if err != nil {
+		return models.PublicKey{}, jwk.Key{}, err
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return models.PublicKey{}, jwk.Key{}, err
+	}
+	sum := sha256.Sum256(der)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	algorithm := crypto.StoredAlgorithm(key.Algorithm)
+	scheme := crypto.StoredScheme(key.Algorithm, key.Scheme)
+
+	jwkKey, err := jwk.FromPublicKey(publicKey)
+	if err != nil {
+		return models.PublicKey{}, jwk.Key{}, err
+	}
+	jwkKey.KeyID = fingerprint
+	jwkKey.Use = "sig"
+	jwkKey.Algorithm = joseAlgorithm(algorithm, scheme)
+
+	jwkJSON, err := json.Marshal(jwkKey)
+	if err != nil {
+		return models.PublicKey{}, jwk.Key{}, err
+	}
+
+	return models.PublicKey{
+		Label:       key.Label,
+		Version:     version,
+		Algorithm:   string(algorithm),
+		Scheme:      string(scheme),
+		State:       key.CurrentState(),
+		DER:         der,
+		PEM:         string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		JWK:         string(jwkJSON),
+		Fingerprint: fingerprint,
+	}, jwkKey, nil
+}
+
+// keyVersions lists the versions of a key, oldest first.
+func keyVersions(key models.Key) []int {
+	if len(key.Versions) == 0 {
+		return []int{1}
+	}
+
+	versions := make([]int, 0, len(key.Versions))
+	for _, v := range key.Versions {
+		versions = append(versions, v.Version)
+	}
+
+	return versions
+}
+
+// joseAlgorithm names scheme as a JWA "alg" (RFC 7518, RFC 8037), or returns
+// "" when JOSE has no name for it, e.g. ECDSA on P-256 with SHA-512.
+func joseAlgorithm(algorithm crypto.Algorithm, scheme crypto.Scheme) string {
+	switch scheme {
+	case crypto.SchemeRSAPKCS1SHA256:
+		return "RS256"
+	case crypto.SchemeRSAPKCS1SHA384:
+		return "RS384"
+	case crypto.SchemeRSAPKCS1SHA512:
+		return "RS512"
+	case crypto.SchemeRSAPSSSHA256:
+		return "PS256"
+	case crypto.SchemeRSAPSSSHA384:
+		return "PS384"
+	case crypto.SchemeRSAPSSSHA512:
+		return "PS512"
+	case crypto.SchemeECDSASHA256:
+		if algorithm == crypto.AlgorithmECP256 {
+			return "ES256"
+		}
+	case crypto.SchemeECDSASHA384:
+		if algorithm == crypto.AlgorithmECP384 {
+			return "ES384"
+		}
+	case crypto.SchemeEd25519:
+		return "EdDSA"
+	}
+
+	return ""
+}
@@ -0,0 +1,312 @@
+package signature_issuer
+
+import (
+	"bytes"
+	"context"
+	gocrypto "crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+	"tms/internal/domain/errs"
+	"tms/internal/domain/models"
+	"tms/internal/services/crypto"
+)
+
+// content is what a payload signature covers: the bytes themselves, or only
+// their digest under the hash of the scheme.
+type content struct {
+	data []byte
+	// isDigest is set when only the digest is given. An empty payload is
+	// data like any other.
+	isDigest bool
+	digest   []byte
+}
+
+// check rejects a digest that does not fit scheme.
+func (c content) check(scheme crypto.Scheme) error {
+	if !c.isDigest {
+		return nil
+	}
+
+	return crypto.CheckDigest(scheme, c.digest)
+}
+
+// digestFor returns the digest c is identified by under scheme. Ed25519
+// signs the data itself, so its payloads are identified by their SHA-256.
+func (c content) digestFor(scheme crypto.Scheme) []byte {
+	switch {
+	case c.isDigest:
+		return c.digest
+	case scheme.Hash() == 0:
+		sum := sha256.Sum256(c.data)
+		return sum[:]
+	default:
+		return scheme.Digest(c.data)
+	}
+}
+
+func (c content) verify(publicKey gocrypto.PublicKey, scheme crypto.Scheme, signature []byte) (bool, error) {
+	if c.isDigest {
+		return crypto.VerifyDigest(publicKey, scheme, c.digest, signature)
+	}
+
+	return crypto.Verify(publicKey, scheme, c.data, signature)
+}
+
+// payloadId is the id a payload signature is anchored under. Unlike
+// document ids it holds the scheme, so that signing the same content with
+// another scheme does not replace the anchored signature.
+func payloadId(scheme crypto.Scheme, digest []byte, userId string, keyLabel string) string {
+	return fmt.Sprintf("%s:%s-%s-%s", scheme, hex.EncodeToString(digest), userId, keyLabel)
+}
+
+// SignPayload signs payload with the key labelled keyLabel. scheme
+// overrides the key's signature scheme when set. With anchor the signature
+// is also saved on the blockchain, as SignData does for documents.
+func (s *IssuerService) SignPayload(
+	ctx context.Context,
+	keyLabel string,
+	userId string,
+	payload []byte,
+	scheme crypto.Scheme,
+	anchor bool,
+) (models.PayloadSignature, error) {
+	const op = "services.signature_issuer.SignPayload"
+
+	signature, err := s.signContent(ctx, keyLabel, userId, content{data: payload}, scheme, anchor)
+	if err != nil {
+		return models.PayloadSignature{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return signature, nil
+}
+
+// SignDigest signs a digest the caller computed with the hash of the
+// scheme. The signature is the one SignPayload makes over the content the
+// digest was computed from. Ed25519 keys cannot sign digests.
+func (s *IssuerService) SignDigest(
+	ctx context.Context,
+	keyLabel string,
+	userId string,
+	digest []byte,
+	scheme crypto.Scheme,
+	anchor bool,
+) (models.PayloadSignature, error) {
+	const op = "services.signature_issuer.SignDigest"
+
+	signature, err := s.signContent(ctx, keyLabel, userId, content{isDigest: true, digest: digest}, scheme, anchor)
+	if err != nil {
+		return models.PayloadSignature{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return signature, nil
+}
+
+// VerifyPayload checks a signature over payload. Anchored signatures are
+// checked against the blockchain and verified with the key version they
+// were made with; otherwise keyVersion is used, or the current version when
+// it is 0. keyLabel may also name an external key, whose signatures are
+// never anchored.
+func (s *IssuerService) VerifyPayload(
+	ctx context.Context,
+	signature string,
+	payload []byte,
+	keyLabel string,
+	userId string,
+	scheme crypto.Scheme,
+	keyVersion int,
+	anchored bool,
+) (models.Signature, error) {
+	const op = "services.signature_issuer.VerifyPayload"
+
+	result, err := s.verifyContent(ctx, signature, content{data: payload}, keyLabel, userId, scheme, keyVersion, anchored)
+	if err != nil {
+		return models.Signature{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return result, nil
+}
+
+// VerifyDigest is VerifyPayload for a digest computed with the hash of the
+// scheme.
+func (s *IssuerService) VerifyDigest(
+	ctx context.Context,
+	signature string,
+	digest []byte,
+	keyLabel string,
+	userId string,
+	scheme crypto.Scheme,
+	keyVersion int,
+	anchored bool,
+) (models.Signature, error) {
+	const op = "services.signature_issuer.VerifyDigest"
+
+	result, err := s.verifyContent(ctx, signature, content{isDigest: true, digest: digest}, keyLabel, userId, scheme, keyVersion, anchored)
+	if err != nil {
+		return models.Signature{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return result, nil
+}
+
+func (s *IssuerService) signContent(
+	ctx context.Context,
+	keyLabel string,
+	userId string,
+	c content,
+	scheme crypto.Scheme,
+	anchor bool,
+) (models.PayloadSignature, error) {
+	signer, err := s.signingKey(ctx, userId, keyLabel, scheme)
+	if err != nil {
+		return models.PayloadSignature{}, err
+	}
+
+	if err := c.check(signer.scheme); err != nil {
+		return models.PayloadSignature{}, err
+	}
+
+	var signature []byte
+	if c.isDigest {
+		signature, err = s.keyManager.SignDigest(ctx, signer.backendLabel, signer.scheme, c.digest)
+	} else {
+		signature, err = s.keyManager.Sign(ctx, signer.backendLabel, signer.scheme, c.data)
+	}
+	if err != nil {
+		return models.PayloadSignature{}, err
+	}
+
+	digest := c.digestFor(signer.scheme)
+	result := models.PayloadSignature{
+		Signature:  base64.StdEncoding.EncodeToString(signature),
+		Scheme:     string(signer.scheme),
+		KeyLabel:   keyLabel,
+		KeyVersion: signer.version,
+		Digest:     digest,
+		Size:       int64(len(c.data)),
+	}
+
+	if anchor {
+		record := models.SignatureRecord{
+			Id:         payloadId(signer.scheme, digest, userId, keyLabel),
+			UserId:     userId,
+			KeyLabel:   keyLabel,
+			KeyVersion: signer.version,
+			Scheme:     string(signer.scheme),
+			Signature:  result.Signature,
+			SignedAt:   time.Now().UTC(),
+		}
+		if err := s.anchor(ctx, record); err != nil {
+			return models.PayloadSignature{}, err
+		}
+		result.AnchorId = record.Id
+	}
+
+	return result, nil
+}
+
+func (s *IssuerService) verifyContent(
+	ctx context.Context,
+	signature string,
+	c content,
+	keyLabel string,
+	userId string,
+	scheme crypto.Scheme,
+	keyVersion int,
+	anchored bool,
+) (models.Signature, error) {
+	key, err := s.keyAuthorizer.AuthorizeKey(ctx, userId, keyLabel)
+	if errors.Is(err, errs.KindNotFound) {
+		external, externalErr := s.keyAuthorizer.AuthorizeExternalKey(ctx, userId, keyLabel)
+		if externalErr == nil {
+			if anchored {
+				return models.Signature{}, errs.FailedPrecondition(fmt.Sprintf("signatures of external key %q are not anchored", keyLabel))
+			}
+			return s.verifyExternal(external, signature, c, scheme)
+		}
+		if !errors.Is(externalErr, errs.KindNotFound) {
+			err = externalErr
+		}
+	}
+	if err != nil {
+		return models.Signature{}, err
+	}
+
+	if key.CurrentState() == models.KeyStateDestroyed {
+		return models.Signature{}, errs.FailedPrecondition(fmt.Sprintf("key pair %q is destroyed", keyLabel))
+	}
+
+	if scheme == "" {
+		scheme = crypto.StoredScheme(key.Algorithm, key.Scheme)
+	}
+	if err := c.check(scheme); err != nil {
+		return models.Signature{}, err
+	}
+
+	providedSign, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return models.Signature{}, errs.InvalidField("signature", "must be base64 encoded")
+	}
+
+	// An unanchored signature has no signing time, so predatesRevocation
+	// does not trust it once the key is revoked.
+	record := models.SignatureRecord{KeyVersion: keyVersion}
+
+	if anchored {
+		id := payloadId(scheme, c.digestFor(scheme), userId, keyLabel)
+
+		anchoredSign, err := s.anchoredSignature(ctx, id)
+		if err != nil {
+			return models.Signature{}, err
+		}
+
+		sign, err := base64.StdEncoding.DecodeString(anchoredSign)
+		if err != nil {
+			return models.Signature{}, err
+		}
+
+		if !bytes.Equal(providedSign, sign) {
+			return models.Signature{
+				Signature: signature,
+				Valid:     false,
+				KeyState:  key.CurrentState(),
+			}, nil
+		}
+
+		record, err = s.signatureStore.SignatureRecord(ctx, id)
+		if err != nil {
+			return models.Signature{}, err
+		}
+	}
+
+	if record.KeyVersion == 0 {
+		record.KeyVersion = key.CurrentVersion()
+	}
+	backendLabel, ok := key.BackendLabel(record.KeyVersion)
+	if !ok {
+		return models.Signature{}, errs.FailedPrecondition(fmt.Sprintf("key pair %q has no version %d", keyLabel, record.KeyVersion))
+	}
+
+	publicKey, err := s.keyManager.PublicKey(ctx, backendLabel)
+	if err != nil {
+		return models.Signature{}, err
+	}
+
+	valid, err := c.verify(publicKey, scheme, providedSign)
+	if err != nil {
+		return models.Signature{}, err
+	}
+
+	predates := predatesRevocation(key, record)
+
+	return models.Signature{
+		Signature:          signature,
+		Valid:              valid && predates,
+		Scheme:             string(scheme),
+		KeyState:           key.CurrentState(),
+		PredatesRevocation: predates,
+	}, nil
+}
@@ -0,0 +1,52 @@
+package signature_issuer
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+	"tms/internal/services/crypto"
+)
+
+func TestContentEmptyPayload(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, payload := range [][]byte{nil, {}} {
+		c := content{data: payload}
+
+		if err := c.check(crypto.SchemeEd25519); err != nil {
+			t.Fatalf("check(%#v): %v", payload, err)
+		}
+
+		empty := sha256.Sum256(nil)
+		if digest := c.digestFor(crypto.SchemeECDSASHA256); !bytes.Equal(digest, empty[:]) {
+			t.Fatalf("digestFor(%#v) = %x, want %x", payload, digest, empty)
+		}
+
+		valid, err := c.verify(publicKey, crypto.SchemeEd25519, ed25519.Sign(privateKey, nil))
+		if err != nil || !valid {
+			t.Fatalf("verify(%#v) = %v, %v, want true", payload, valid, err)
+		}
+	}
+}
+
+func TestContentDigest(t *testing.T) {
+	c := content{isDigest: true, digest: make([]byte, sha256.Size)}
+
+	if err := c.check(crypto.SchemeEd25519); err == nil {
+		t.Fatal("Ed25519 accepted a digest")
+	}
+	if err := c.check(crypto.SchemeECDSASHA384); err == nil {
+		t.Fatal("ECDSA_SHA384 accepted a SHA-256 digest")
+	}
+	if err := c.check(crypto.SchemeECDSASHA256); err != nil {
+		t.Fatal(err)
+	}
+	if digest := c.digestFor(crypto.SchemeECDSASHA256); !bytes.Equal(digest, c.digest) {
+		t.Fatalf("digestFor = %x, want the digest itself", digest)
+	}
+}
@@ -4,54 +4,124 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	blockchainv1 "github.com/alexprishmont/masters-protos/gen/go/blockchain-processor"
 	"golang.org/x/exp/slog"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"time"
+	"tms/internal/domain/errs"
 	"tms/internal/domain/models"
 	"tms/internal/services/crypto"
 )
 
 type IssuerService struct {
 	log                 *slog.Logger
-	cryptoOperator      crypto.Operator
+	keyManager          crypto.KeyManager
 	documentProvider    Provider
+	signatureStore      SignatureStore
+	keyAuthorizer       KeyAuthorizer
+	blockchainConn      *grpc.ClientConn
 	blockchainProcessor blockchainv1.BlockchainProcessorClient
+	blockchainTimeout   time.Duration
 }
 
 type Provider interface {
 	GetDocument(ctx context.Context, id string) (models.Document, error)
+	UserDocument(ctx context.Context, userId string, id string) (models.Document, error)
+}
+
+// SignatureStore keeps the record of how each anchored signature was made.
+type SignatureStore interface {
+	SaveSignature(ctx context.Context, record models.SignatureRecord) error
+	SignatureRecord(ctx context.Context, id string) (models.SignatureRecord, error)
+}
+
+type KeyAuthorizer interface {
+	AuthorizeKey(ctx context.Context, userId string, label string) (models.Key, error)
+	AuthorizeExternalKey(ctx context.Context, userId string, label string) (models.ExternalKey, error)
 }
 
 func New(
 	log *slog.Logger,
-	cryptoOperator crypto.Operator,
+	keyManager crypto.KeyManager,
 	documentProvider Provider,
+	signatureStore SignatureStore,
+	keyAuthorizer KeyAuthorizer,
+	blockchainAddress string,
+	blockchainTimeout time.Duration,
+	blockchainCreds credentials.TransportCredentials,
 ) *IssuerService {
-	conn, err := grpc.Dial("localhost:44046", grpc.WithInsecure())
+	conn, err := grpc.Dial(blockchainAddress, grpc.WithTransportCredentials(blockchainCreds))
 	if err != nil {
-		log.Error("could not connect to blockchain processor: %v", err)
+		log.Error("could not connect to blockchain processor", slog.Any("error", err))
 	}
 
 	client := blockchainv1.NewBlockchainProcessorClient(conn)
 
 	return &IssuerService{
 		log:                 log,
-		cryptoOperator:      cryptoOperator,
+		keyManager:          keyManager,
 		documentProvider:    documentProvider,
+		signatureStore:      signatureStore,
+		keyAuthorizer:       keyAuthorizer,
+		blockchainConn:      conn,
 		blockchainProcessor: client,
+		blockchainTimeout:   blockchainTimeout,
 	}
 }
 
+// Ping reports whether the blockchain processor connection is usable. An idle
+// connection is asked to connect so that the next probe sees its real state.
+func (s *IssuerService) Ping(_ context.Context) error {
+	if s.blockchainConn == nil {
+		return fmt.Errorf("blockchain processor is not connected")
+	}
+
+	switch state := s.blockchainConn.GetState(); state {
+	case connectivity.Idle:
+		s.blockchainConn.Connect()
+		return nil
+	case connectivity.TransientFailure, connectivity.Shutdown:
+		return fmt.Errorf("blockchain processor connection is %s", state)
+	default:
+		return nil
+	}
+}
+
+// Close releases the connection to the blockchain processor. It must only be
+// called once no more signing calls are in flight.
+func (s *IssuerService) Close() error {
+	if s.blockchainConn == nil {
+		return nil
+	}
+
+	return s.blockchainConn.Close()
+}
+
+// SignData signs a document with the key labelled keyLabel and anchors the
+// signature on the blockchain. scheme overrides the key's signature scheme
+// when set.
 func (s *IssuerService) SignData(
 	ctx context.Context,
 	keyLabel string,
 	userId string,
 	documentId string,
+	scheme crypto.Scheme,
 ) (models.Signature, error) {
 	const op = "services.signature_issuer.SignData"
-	// get document
-	document, err := s.documentProvider.GetDocument(ctx, documentId)
+
+	signer, err := s.signingKey(ctx, userId, keyLabel, scheme)
+	if err != nil {
+		return models.Signature{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// get document, which has to belong to the user like the key
+	document, err := s.documentProvider.UserDocument(ctx, userId, documentId)
 
 	if err != nil {
 		return models.Signature{}, fmt.Errorf("%s: %w", op, err)
@@ -59,67 +129,137 @@ func (s *IssuerService) SignData(
 
 	// sign document
 	documentContent := []byte(document.Content)
-	signature, err := s.cryptoOperator.SignData(keyLabel, documentContent)
+	signature, err := s.keyManager.Sign(ctx, signer.backendLabel, signer.scheme, documentContent)
 
 	if err != nil {
 		return models.Signature{}, fmt.Errorf("%s: %w", op, err)
 	}
 
 	// send signature to blockchain processor to save
-	req := &blockchainv1.SaveRequest{
-		Id:        fmt.Sprintf("%s-%s-%s", documentId, userId, keyLabel),
-		Signature: base64.StdEncoding.EncodeToString(signature),
+	record := models.SignatureRecord{
+		Id:         fmt.Sprintf("%s-%s-%s", documentId, userId, keyLabel),
+		DocumentId: documentId,
+		UserId:     userId,
+		KeyLabel:   keyLabel,
+		KeyVersion: signer.version,
+		Scheme:     string(signer.scheme),
+		Signature:  base64.StdEncoding.EncodeToString(signature),
+		SignedAt:   time.Now().UTC(),
+	}
+	if err := s.anchor(ctx, record); err != nil {
+		return models.Signature{}, fmt.Errorf("%s: %w", op, err)
 	}
 
-	res, err := s.blockchainProcessor.SaveSignature(ctx, req)
+	return models.Signature{
+		Signature:          record.Signature,
+		Valid:              true,
+		Scheme:             string(signer.scheme),
+		KeyState:           signer.key.CurrentState(),
+		PredatesRevocation: true,
+	}, nil
+}
 
+// signer is the key version a new signature is made with.
+type signer struct {
+	key          models.Key
+	scheme       crypto.Scheme
+	version      int
+	backendLabel string
+}
+
+// signingKey authorizes userId to sign with the key labelled keyLabel and picks
+// its current version. scheme overrides the key's signature scheme when set.
+func (s *IssuerService) signingKey(ctx context.Context, userId string, keyLabel string, scheme crypto.Scheme) (signer, error) {
+	key, err := s.keyAuthorizer.AuthorizeKey(ctx, userId, keyLabel)
 	if err != nil {
-		return models.Signature{}, fmt.Errorf("%s: failed to send signature to blockchain. (%w)", op, err)
+		return signer{}, err
 	}
 
-	if !res.Success {
-		return models.Signature{}, fmt.Errorf("%s: failed to save signature (%w)", op, err)
+	if key.Deletion != nil {
+		return signer{}, errs.FailedPrecondition(fmt.Sprintf("key pair %q is scheduled for deletion", keyLabel))
+	}
+	if state := key.CurrentState(); state != models.KeyStateActive {
+		return signer{}, errs.FailedPrecondition(fmt.Sprintf("key pair %q is %s and cannot sign", keyLabel, state))
 	}
 
-	return models.Signature{
-		Signature: base64.StdEncoding.EncodeToString(signature),
-		Valid:     true,
-	}, nil
+	if scheme == "" {
+		scheme = crypto.StoredScheme(key.Algorithm, key.Scheme)
+	}
+	if err := crypto.CheckScheme(crypto.StoredAlgorithm(key.Algorithm), scheme); err != nil {
+		return signer{}, err
+	}
+
+	version := key.CurrentVersion()
+	backendLabel, ok := key.BackendLabel(version)
+	if !ok {
+		return signer{}, errs.FailedPrecondition(fmt.Sprintf("key pair %q has no version %d", keyLabel, version))
+	}
+
+	return signer{key: key, scheme: scheme, version: version, backendLabel: backendLabel}, nil
 }
 
+// VerifySignature checks a signature over a document. Signatures made by
+// key pairs of this service are checked against the blockchain and verified
+// with the scheme recorded when signing. keyLabel may also name an external
+// key, in which case the signature is verified with scheme, or with the
+// default scheme of the key when scheme is empty.
 func (s *IssuerService) VerifySignature(
 	ctx context.Context,
 	signature string,
 	documentId string,
 	keyLabel string,
 	userId string,
+	scheme crypto.Scheme,
 ) (models.Signature, error) {
 	const op = "services.signature_issuer.VerifySignature"
 
-	document, err := s.documentProvider.GetDocument(ctx, documentId)
+	key, err := s.keyAuthorizer.AuthorizeKey(ctx, userId, keyLabel)
+	if errors.Is(err, errs.KindNotFound) {
+		external, externalErr := s.keyAuthorizer.AuthorizeExternalKey(ctx, userId, keyLabel)
+		if externalErr == nil {
+			document, err := s.documentProvider.GetDocument(ctx, documentId)
+			if err != nil {
+				return models.Signature{}, fmt.Errorf("%s: %w", op, err)
+			}
 
+			result, err := s.verifyExternal(external, signature, content{data: []byte(document.Content)}, scheme)
+			if err != nil {
+				return models.Signature{}, fmt.Errorf("%s: %w", op, err)
+			}
+			return result, nil
+		}
+		if !errors.Is(externalErr, errs.KindNotFound) {
+			err = externalErr
+		}
+	}
 	if err != nil {
 		return models.Signature{}, fmt.Errorf("%s: %w", op, err)
 	}
 
-	// send data & signature to blockchain processor for verification
-	req := &blockchainv1.GetRequest{
-		Id: fmt.Sprintf("%s-%s-%s", documentId, userId, keyLabel),
+	if key.CurrentState() == models.KeyStateDestroyed {
+		return models.Signature{}, fmt.Errorf("%s: %w", op, errs.FailedPrecondition(fmt.Sprintf("key pair %q is destroyed", keyLabel)))
 	}
 
-	res, err := s.blockchainProcessor.GetSignature(ctx, req)
+	document, err := s.documentProvider.GetDocument(ctx, documentId)
 
 	if err != nil {
-		return models.Signature{}, fmt.Errorf("%s: failed to get signature from blockchain", op)
+		return models.Signature{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// get the signature anchored on the blockchain for verification
+	id := fmt.Sprintf("%s-%s-%s", documentId, userId, keyLabel)
+	anchored, err := s.anchoredSignature(ctx, id)
+	if err != nil {
+		return models.Signature{}, fmt.Errorf("%s: %w", op, err)
 	}
 
 	providedSign, err := base64.StdEncoding.DecodeString(signature)
 
 	if err != nil {
-		return models.Signature{}, fmt.Errorf("%s: %w", op, err)
+		return models.Signature{}, fmt.Errorf("%s: %w", op, errs.InvalidField("signature", "must be base64 encoded"))
 	}
 
-	sign, err := base64.StdEncoding.DecodeString(res.Signature)
+	sign, err := base64.StdEncoding.DecodeString(anchored)
 
 	if err != nil {
 		return models.Signature{}, fmt.Errorf("%s: %w", op, err)
@@ -129,11 +269,29 @@ func (s *IssuerService) VerifySignature(
 		return models.Signature{
 			Signature: signature,
 			Valid:     false,
+			KeyState:  key.CurrentState(),
 		}, nil
 	}
 
-	success, err := s.cryptoOperator.VerifySignature(
-		keyLabel,
+	record, err := s.signatureRecord(ctx, id)
+	if err != nil {
+		return models.Signature{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	recordedScheme, err := crypto.ParseScheme(record.Scheme)
+	if err != nil {
+		return models.Signature{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	backendLabel, ok := key.BackendLabel(record.KeyVersion)
+	if !ok {
+		return models.Signature{}, fmt.Errorf("%s: %w", op, errs.FailedPrecondition(fmt.Sprintf("key pair %q has no version %d", keyLabel, record.KeyVersion)))
+	}
+
+	success, err := s.keyManager.Verify(
+		ctx,
+		backendLabel,
+		recordedScheme,
 		[]byte(document.Content),
 		sign,
 	)
@@ -142,8 +300,145 @@ func (s *IssuerService) VerifySignature(
 		return models.Signature{}, fmt.Errorf("%s: %w", op, err)
 	}
 
+	predates := predatesRevocation(key, record)
+
 	return models.Signature{
-		Signature: res.Signature,
-		Valid:     success,
+		Signature:          anchored,
+		Valid:              success && predates,
+		Scheme:             string(recordedScheme),
+		KeyState:           key.CurrentState(),
+		PredatesRevocation: predates,
 	}, nil
 }
+
+// verifyExternal verifies a signature made outside this service with a
+// registered external key. Certificates are only used while they are valid.
+func (s *IssuerService) verifyExternal(
+	key models.ExternalKey,
+	signature string,
+	c content,
+	scheme crypto.Scheme,
+) (models.Signature, error) {
+	if key.Kind == models.ExternalKeyCertificate {
+		now := time.Now()
+		if now.Before(key.NotBefore) || now.After(key.NotAfter) {
+			return models.Signature{}, errs.FailedPrecondition(fmt.Sprintf("certificate of external key %q is not valid now", key.Label))
+		}
+	}
+
+	publicKey, _, err := crypto.ParsePublicKeyPEM([]byte(key.PEM))
+	if err != nil {
+		return models.Signature{}, err
+	}
+
+	if scheme == "" {
+		scheme = crypto.DefaultScheme(crypto.Algorithm(key.Algorithm))
+	}
+
+	providedSign, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return models.Signature{}, errs.InvalidField("signature", "must be base64 encoded")
+	}
+
+	valid, err := c.verify(publicKey, scheme, providedSign)
+	if err != nil {
+		return models.Signature{}, err
+	}
+
+	return models.Signature{
+		Signature:          signature,
+		Valid:              valid,
+		Scheme:             string(scheme),
+		KeyState:           models.KeyStateActive,
+		PredatesRevocation: true,
+	}, nil
+}
+
+// anchor saves a signature on the blockchain under record.Id and keeps the
+// record of how it was made.
+func (s *IssuerService) anchor(ctx context.Context, record models.SignatureRecord) error {
+	req := &blockchainv1.SaveRequest{
+		Id:        record.Id,
+		Signature: record.Signature,
+	}
+
+	bcCtx, cancel := context.WithTimeout(ctx, s.blockchainTimeout)
+	defer cancel()
+
+	res, err := s.blockchainProcessor.SaveSignature(bcCtx, req)
+
+	if err != nil {
+		return fmt.Errorf("failed to send signature to blockchain: %w", blockchainError(err, req.Id))
+	}
+
+	if !res.Success {
+		return fmt.Errorf("blockchain processor did not save signature %q", req.Id)
+	}
+
+	return s.signatureStore.SaveSignature(ctx, record)
+}
+
+// anchoredSignature returns the base64 signature anchored under id.
+func (s *IssuerService) anchoredSignature(ctx context.Context, id string) (string, error) {
+	req := &blockchainv1.GetRequest{
+		Id: id,
+	}
+
+	bcCtx, cancel := context.WithTimeout(ctx, s.blockchainTimeout)
+	defer cancel()
+
+	res, err := s.blockchainProcessor.GetSignature(bcCtx, req)
+
+	if err != nil {
+		return "", fmt.Errorf("failed to get signature from blockchain: %w", blockchainError(err, req.Id))
+	}
+
+	return res.Signature, nil
+}
+
+// predatesRevocation reports whether a signature was made before its key was
+// compromised. A signature without a signing time cannot be placed and is
+// not trusted once the key is revoked.
+func predatesRevocation(key models.Key, record models.SignatureRecord) bool {
+	if key.CurrentState() != models.KeyStateRevoked {
+		return true
+	}
+
+	compromisedAt := key.CompromisedAt
+	if compromisedAt.IsZero() {
+		compromisedAt = key.StateChangedAt
+	}
+
+	return !record.SignedAt.IsZero() && record.SignedAt.Before(compromisedAt)
+}
+
+// signatureRecord returns how the signature id was made. Signatures
+// anchored before records were kept were all made with the legacy scheme
+// by the first version of their key.
+func (s *IssuerService) signatureRecord(ctx context.Context, id string) (models.SignatureRecord, error) {
+	record, err := s.signatureStore.SignatureRecord(ctx, id)
+	switch {
+	case errors.Is(err, errs.KindNotFound):
+		return models.SignatureRecord{Id: id, Scheme: string(crypto.LegacyScheme), KeyVersion: 1}, nil
+	case err != nil:
+		return models.SignatureRecord{}, err
+	}
+
+	if record.KeyVersion == 0 {
+		record.KeyVersion = 1
+	}
+
+	return record, nil
+}
+
+// blockchainError classifies a failed call to the blockchain processor.
+func blockchainError(err error, id string) error {
+	switch status.Code(err) {
+	case codes.NotFound:
+		return errs.NotFound("signature", id)
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return errs.Unavailable(err, "blockchain processor unavailable")
+	default:
+		return err
+	}
+}
@@ -0,0 +1,57 @@
+package signature_issuer
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"tms/internal/domain/errs"
+	"tms/internal/domain/models"
+	"tms/internal/services/crypto"
+)
+
+// SignReader signs the content read from r with the key labelled keyLabel.
+// The content is hashed as it is read, so only the digest reaches the key
+// backend and content of any size is signed in bounded memory. The
+// signature is the one SignData makes over the same bytes with the scheme. It
+// is not anchored on the blockchain.
+func (s *IssuerService) SignReader(
+	ctx context.Context,
+	keyLabel string,
+	userId string,
+	scheme crypto.Scheme,
+	r io.Reader,
+) (models.PayloadSignature, error) {
+	const op = "services.signature_issuer.SignReader"
+
+	signer, err := s.signingKey(ctx, userId, keyLabel, scheme)
+	if err != nil {
+		return models.PayloadSignature{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// Checked before reading so that the content is not uploaded in vain.
+	if signer.scheme.Hash() == 0 {
+		return models.PayloadSignature{}, fmt.Errorf("%s: %w", op, errs.FailedPrecondition(fmt.Sprintf("%s signs the message itself and cannot sign streamed content", signer.scheme)))
+	}
+
+	hash := signer.scheme.Hash().New()
+	size, err := io.Copy(hash, r)
+	if err != nil {
+		return models.PayloadSignature{}, fmt.Errorf("%s: %w", op, err)
+	}
+	digest := hash.Sum(nil)
+
+	signature, err := s.keyManager.SignDigest(ctx, signer.backendLabel, signer.scheme, digest)
+	if err != nil {
+		return models.PayloadSignature{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return models.PayloadSignature{
+		Signature:  base64.StdEncoding.EncodeToString(signature),
+		Scheme:     string(signer.scheme),
+		KeyLabel:   keyLabel,
+		KeyVersion: signer.version,
+		Digest:     digest,
+		Size:       size,
+	}, nil
+}
@@ -8,6 +8,11 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+	"strings"
+	"time"
+	"tms/internal/domain/errs"
 	"tms/internal/domain/models"
 	"tms/internal/storage"
 )
@@ -18,12 +23,18 @@ type Storage struct {
 }
 
 // New creates a new instance of the MongoDB storage.
-func New(uri string, database string) (*Storage, error) {
+// connectTimeout bounds the initial connect and ping, timeout bounds every later operation.
+func New(
+	uri string,
+	database string,
+	connectTimeout time.Duration,
+	timeout time.Duration,
+) (*Storage, error) {
 	const op = "storage.mongodb.New"
 
-	clientOptions := options.Client().ApplyURI(uri)
+	clientOptions := options.Client().ApplyURI(uri).SetTimeout(timeout)
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
 	defer cancel()
 
 	client, err := mongo.Connect(ctx, clientOptions)
@@ -33,13 +44,90 @@ func New(uri string, database string) (*Storage, error) {
 
 	err = client.Ping(ctx, nil)
 	if err != nil {
-		return nil, fmt.Errorf("%s: %w", op, err)
+		return nil, fmt.Errorf("%s: %w", op, errs.Unavailable(err, "database unavailable"))
 	}
 
-	return &Storage{
+	s := &Storage{
 		client:   client,
 		database: database,
-	}, nil
+	}
+
+	if err := s.ensureIndexes(ctx); err != nil {
+		_ = client.Disconnect(context.Background())
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return s, nil
+}
+
+// ensureIndexes creates the indexes the storage relies on. Key labels are
+// unique so two concurrent CreateKeyPair calls cannot both claim a label.
+// Databases from before labels were unique may hold duplicates, which
+// cannot be indexed; they are listed so that they can be renamed or
+// removed.
+func (s *Storage) ensureIndexes(ctx context.Context) error {
+	for _, collection := range []string{"keyPairs", "externalKeys"} {
+		_, err := s.client.Database(s.database).Collection(collection).Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "label", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		})
+		if err == nil {
+			continue
+		}
+
+		duplicates, dupErr := s.duplicateLabels(ctx, collection)
+		if dupErr != nil || len(duplicates) == 0 {
+			return fmt.Errorf("failed to create the unique label index on %s: %w", collection, err)
+		}
+
+		return fmt.Errorf(
+			"cannot create the unique label index on %s: labels are used by more than one document "+
+				"(%s); rename or delete the duplicates, then restart: %w",
+			collection, strings.Join(duplicates, "; "), err,
+		)
+	}
+
+	return nil
+}
+
+// maxReportedDuplicates bounds the duplicate labels listed on startup.
+const maxReportedDuplicates = 20
+
+// duplicateLabels lists labels of collection held by more than one
+// document, each with the ids of its documents.
+func (s *Storage) duplicateLabels(ctx context.Context, collection string) ([]string, error) {
+	cursor, err := s.client.Database(s.database).Collection(collection).Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": "$label", "count": bson.M{"$sum": 1}, "ids": bson.M{"$push": "$_id"}}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+		{{Key: "$limit", Value: maxReportedDuplicates}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var groups []struct {
+		Label any   `bson:"_id"`
+		IDs   []any `bson:"ids"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+
+	duplicates := make([]string, 0, len(groups))
+	for _, group := range groups {
+		ids := make([]string, 0, len(group.IDs))
+		for _, id := range group.IDs {
+			if oid, ok := id.(primitive.ObjectID); ok {
+				ids = append(ids, oid.Hex())
+				continue
+			}
+			ids = append(ids, fmt.Sprint(id))
+		}
+		duplicates = append(duplicates, fmt.Sprintf("%v: %s", group.Label, strings.Join(ids, ", ")))
+	}
+
+	return duplicates, nil
 }
 
 // Close closes instated mongodb connection.
@@ -50,6 +138,17 @@ func (s *Storage) Close(ctx context.Context) error {
 	return nil
 }
 
+// Ping checks that the primary is reachable.
+func (s *Storage) Ping(ctx context.Context) error {
+	const op = "storage.mongodb.Ping"
+
+	if err := s.client.Ping(ctx, readpref.Primary()); err != nil {
+		return fmt.Errorf("%s: %w", op, errs.Unavailable(err, "database unavailable"))
+	}
+
+	return nil
+}
+
 func (s *Storage) UpdateUser(ctx context.Context, email string, updateData bson.M) error {
 	const op = "storage.mongodb.UpdateUser"
 
@@ -60,7 +159,7 @@ func (s *Storage) UpdateUser(ctx context.Context, email string, updateData bson.
 
 	result, err := collection.UpdateOne(ctx, filter, update)
 	if err != nil {
-		return fmt.Errorf("%s: %w", op, err)
+		return wrap(op, err, storage.ResourceUser, email)
 	}
 
 	if result.MatchedCount == 0 {
@@ -80,7 +179,7 @@ func (s *Storage) DeleteUser(ctx context.Context, email string) error {
 
 	result, err := collection.DeleteOne(ctx, filter)
 	if err != nil {
-		return fmt.Errorf("%s: %w", op, err)
+		return wrap(op, err, storage.ResourceUser, email)
 	}
 
 	if result.DeletedCount == 0 {
@@ -90,36 +189,425 @@ func (s *Storage) DeleteUser(ctx context.Context, email string) error {
 	return nil
 }
 
-func (s *Storage) SaveKeyPair(
-	ctx context.Context,
-	keyLabel string,
-	userId string,
-) error {
+// SaveKeyPair stores a new key owned by key.User.ID, filling in the name
+// and email of the owner.
+func (s *Storage) SaveKeyPair(ctx context.Context, key models.Key) error {
 	const op = "storage.mongodb.SaveKeyPair"
 
-	filter := bson.M{"uniqueId": userId}
+	filter := bson.M{"uniqueId": key.User.ID}
 	var user models.User
 
 	collection := s.client.Database(s.database).Collection("users")
 	err := collection.FindOne(ctx, filter).Decode(&user)
 
 	if err != nil {
-		return fmt.Errorf("%s: %s", op, "User not found")
+		return wrap(op, err, storage.ResourceUser, key.User.ID)
 	}
 
+	key.User.Name = user.Name
+	key.User.Email = user.Email
+
 	collection = s.client.Database(s.database).Collection("keyPairs")
-	doc := bson.M{
-		"label": keyLabel,
-		"user": bson.M{
-			"id":    userId,
-			"name":  user.Name,
-			"email": user.Email,
+	_, err = collection.InsertOne(ctx, key)
+	if err != nil {
+		return wrap(op, err, storage.ResourceKeyPair, key.Label)
+	}
+
+	return nil
+}
+
+// KeyPairs returns every key, sorted by label.
+func (s *Storage) KeyPairs(ctx context.Context) ([]models.Key, error) {
+	const op = "storage.mongodb.KeyPairs"
+
+	collection := s.client.Database(s.database).Collection("keyPairs")
+
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "label", Value: 1}}))
+	if err != nil {
+		return nil, wrap(op, err, storage.ResourceKeyPair, "")
+	}
+
+	var keys []models.Key
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, wrap(op, err, storage.ResourceKeyPair, "")
+	}
+
+	return keys, nil
+}
+
+// RestoreKeyPair inserts key as it was backed up, owner details included,
+// so it can be restored before its owner is.
+func (s *Storage) RestoreKeyPair(ctx context.Context, key models.Key) error {
+	const op = "storage.mongodb.RestoreKeyPair"
+
+	collection := s.client.Database(s.database).Collection("keyPairs")
+
+	if _, err := collection.InsertOne(ctx, key); err != nil {
+		return wrap(op, err, storage.ResourceKeyPair, key.Label)
+	}
+
+	return nil
+}
+
+// KeyPairsByUser returns every key owned by userId.
+func (s *Storage) KeyPairsByUser(ctx context.Context, userId string) ([]models.Key, error) {
+	const op = "storage.mongodb.KeyPairsByUser"
+
+	collection := s.client.Database(s.database).Collection("keyPairs")
+
+	cursor, err := collection.Find(ctx, bson.M{"user.id": userId}, options.Find().SetSort(bson.D{{Key: "label", Value: 1}}))
+	if err != nil {
+		return nil, wrap(op, err, storage.ResourceKeyPair, "")
+	}
+
+	var keys []models.Key
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, wrap(op, err, storage.ResourceKeyPair, "")
+	}
+
+	return keys, nil
+}
+
+// rotationFilter matches an active key whose current version is still from.
+func rotationFilter(label string, from int) bson.M {
+	filter := bson.M{"label": label, "version": from, "state": stateFilter(models.KeyStateActive)}
+	if from == 1 {
+		// Keys created before rotation existed have no version field.
+		filter["version"] = bson.M{"$in": bson.A{nil, 1}}
+	}
+
+	return filter
+}
+
+// ClaimKeyRotation claims the rotation of an active key whose current
+// version is still from for lease. A rotation claimed by someone else and
+// not yet expired, or a key that changed, makes it fail with
+// FailedPrecondition.
+func (s *Storage) ClaimKeyRotation(
+	ctx context.Context,
+	label string,
+	from int,
+	at time.Time,
+	lease time.Duration,
+) error {
+	const op = "storage.mongodb.ClaimKeyRotation"
+
+	collection := s.client.Database(s.database).Collection("keyPairs")
+
+	filter := rotationFilter(label, from)
+	filter["$or"] = bson.A{
+		bson.M{"rotationClaimedAt": bson.M{"$exists": false}},
+		bson.M{"rotationClaimedAt": bson.M{"$lte": at.Add(-lease)}},
+	}
+	update := bson.M{"$set": bson.M{"rotationClaimedAt": at}}
+
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return wrap(op, err, storage.ResourceKeyPair, label)
+	}
+
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("%s: %w", op, errs.FailedPrecondition(fmt.Sprintf("key pair %q is being rotated or changed from version %d", label, from)))
+	}
+
+	return nil
+}
+
+// ReleaseKeyRotation gives up the rotation claimed at, unless it has been
+// claimed again since.
+func (s *Storage) ReleaseKeyRotation(ctx context.Context, label string, at time.Time) error {
+	const op = "storage.mongodb.ReleaseKeyRotation"
+
+	collection := s.client.Database(s.database).Collection("keyPairs")
+
+	filter := bson.M{"label": label, "rotationClaimedAt": at}
+	update := bson.M{"$unset": bson.M{"rotationClaimedAt": ""}}
+
+	if _, err := collection.UpdateOne(ctx, filter, update); err != nil {
+		return wrap(op, err, storage.ResourceKeyPair, label)
+	}
+
+	return nil
+}
+
+// RotateKeyPair replaces the version history of an active key whose current
+// version is still from, making the last entry of versions current, and
+// releases the rotation claimed at. A rotation whose claim was taken over,
+// or a state change, makes it fail with FailedPrecondition.
+func (s *Storage) RotateKeyPair(
+	ctx context.Context,
+	label string,
+	from int,
+	at time.Time,
+	versions []models.KeyVersion,
+) error {
+	const op = "storage.mongodb.RotateKeyPair"
+
+	collection := s.client.Database(s.database).Collection("keyPairs")
+
+	filter := rotationFilter(label, from)
+	filter["rotationClaimedAt"] = at
+
+	current := versions[len(versions)-1]
+	update := bson.M{
+		"$set": bson.M{
+			"version":          current.Version,
+			"versions":         versions,
+			"versionCreatedAt": current.CreatedAt,
 		},
+		"$unset": bson.M{"rotationClaimedAt": ""},
 	}
 
-	_, err = collection.InsertOne(ctx, doc)
+	result, err := collection.UpdateOne(ctx, filter, update)
 	if err != nil {
-		return fmt.Errorf("%s: %w", op, err)
+		return wrap(op, err, storage.ResourceKeyPair, label)
+	}
+
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("%s: %w", op, errs.FailedPrecondition(fmt.Sprintf("key pair %q changed while rotating from version %d", label, from)))
+	}
+
+	return nil
+}
+
+// ChangeKeyState records a lifecycle transition of a key that is still in
+// change.From. compromisedAt is stored when set. A concurrent transition
+// makes it fail with FailedPrecondition.
+func (s *Storage) ChangeKeyState(
+	ctx context.Context,
+	label string,
+	change models.KeyStateChange,
+	compromisedAt time.Time,
+) error {
+	const op = "storage.mongodb.ChangeKeyState"
+
+	collection := s.client.Database(s.database).Collection("keyPairs")
+
+	set := bson.M{
+		"state":          change.To,
+		"stateReason":    change.Reason,
+		"stateChangedAt": change.At,
+	}
+	if !compromisedAt.IsZero() {
+		set["compromisedAt"] = compromisedAt
+	}
+	update := bson.M{
+		"$set":  set,
+		"$push": bson.M{"stateHistory": change},
+	}
+
+	result, err := collection.UpdateOne(ctx, bson.M{"label": label, "state": stateFilter(change.From)}, update)
+	if err != nil {
+		return wrap(op, err, storage.ResourceKeyPair, label)
+	}
+
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("%s: %w", op, errs.FailedPrecondition(fmt.Sprintf("key pair %q is no longer %s", label, change.From)))
+	}
+
+	return nil
+}
+
+// KeyPairsDueForRotation returns the active generated keys whose current
+// version was created before cutoff, including keys from before versions
+// were recorded.
+func (s *Storage) KeyPairsDueForRotation(ctx context.Context, cutoff time.Time) ([]models.Key, error) {
+	const op = "storage.mongodb.KeyPairsDueForRotation"
+
+	collection := s.client.Database(s.database).Collection("keyPairs")
+
+	filter := bson.M{
+		"state":      stateFilter(models.KeyStateActive),
+		"deletion":   bson.M{"$exists": false},
+		"provenance": bson.M{"$ne": models.KeyProvenanceImported},
+		"$or": bson.A{
+			bson.M{"versionCreatedAt": bson.M{"$lt": cutoff}},
+			bson.M{"versionCreatedAt": bson.M{"$exists": false}},
+		},
+	}
+
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return nil, wrap(op, err, storage.ResourceKeyPair, "")
+	}
+
+	var keys []models.Key
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, wrap(op, err, storage.ResourceKeyPair, "")
+	}
+
+	return keys, nil
+}
+
+func (s *Storage) KeyPair(ctx context.Context, label string) (models.Key, error) {
+	const op = "storage.mongodb.KeyPair"
+
+	collection := s.client.Database(s.database).Collection("keyPairs")
+
+	var key models.Key
+
+	err := collection.FindOne(ctx, bson.M{"label": label}).Decode(&key)
+	if err != nil {
+		return models.Key{}, wrap(op, err, storage.ResourceKeyPair, label)
+	}
+
+	return key, nil
+}
+
+// ScheduleKeyDeletion schedules the destruction of a key owned by userId
+// that is not scheduled yet.
+func (s *Storage) ScheduleKeyDeletion(
+	ctx context.Context,
+	userId string,
+	label string,
+	deletion models.KeyDeletion,
+) error {
+	const op = "storage.mongodb.ScheduleKeyDeletion"
+
+	collection := s.client.Database(s.database).Collection("keyPairs")
+
+	filter := bson.M{"label": label, "user.id": userId, "deletion": bson.M{"$exists": false}}
+
+	result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"deletion": deletion}})
+	if err != nil {
+		return wrap(op, err, storage.ResourceKeyPair, label)
+	}
+
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("%s: %w", op, errs.FailedPrecondition(fmt.Sprintf("key pair %q is already scheduled for deletion", label)))
+	}
+
+	return nil
+}
+
+// CancelKeyDeletion drops a scheduled deletion that has not started yet.
+func (s *Storage) CancelKeyDeletion(ctx context.Context, label string) error {
+	const op = "storage.mongodb.CancelKeyDeletion"
+
+	collection := s.client.Database(s.database).Collection("keyPairs")
+
+	filter := bson.M{
+		"label":              label,
+		"deletion":           bson.M{"$exists": true},
+		"deletion.startedAt": bson.M{"$exists": false},
+	}
+
+	result, err := collection.UpdateOne(ctx, filter, bson.M{"$unset": bson.M{"deletion": ""}})
+	if err != nil {
+		return wrap(op, err, storage.ResourceKeyPair, label)
+	}
+
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("%s: %w", op, errs.FailedPrecondition(fmt.Sprintf("deletion of key pair %q is not pending", label)))
+	}
+
+	return nil
+}
+
+// MarkKeyDestroyed records that the versions of a key scheduled for
+// destruction are gone, keeping its metadata in the destroyed state.
+func (s *Storage) MarkKeyDestroyed(ctx context.Context, label string, change models.KeyStateChange) error {
+	const op = "storage.mongodb.MarkKeyDestroyed"
+
+	collection := s.client.Database(s.database).Collection("keyPairs")
+
+	filter := bson.M{"label": label, "deletion": bson.M{"$exists": true}}
+	update := bson.M{
+		"$set": bson.M{
+			"state":          change.To,
+			"stateReason":    change.Reason,
+			"stateChangedAt": change.At,
+		},
+		"$push":  bson.M{"stateHistory": change},
+		"$unset": bson.M{"deletion": ""},
+	}
+
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return wrap(op, err, storage.ResourceKeyPair, label)
+	}
+
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("%s: %w", op, errs.FailedPrecondition(fmt.Sprintf("key pair %q is not scheduled for destruction", label)))
+	}
+
+	return nil
+}
+
+// KeyPairsDueForDeletion returns the keys whose grace period ended before
+// now, including those whose destruction started but did not finish.
+func (s *Storage) KeyPairsDueForDeletion(ctx context.Context, now time.Time) ([]models.Key, error) {
+	const op = "storage.mongodb.KeyPairsDueForDeletion"
+
+	collection := s.client.Database(s.database).Collection("keyPairs")
+
+	cursor, err := collection.Find(ctx, bson.M{"deletion.destroyAfter": bson.M{"$lte": now}})
+	if err != nil {
+		return nil, wrap(op, err, storage.ResourceKeyPair, "")
+	}
+
+	var keys []models.Key
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, wrap(op, err, storage.ResourceKeyPair, "")
+	}
+
+	return keys, nil
+}
+
+// ClaimKeyDeletion claims the destruction of a due key for lease. The
+// first claim marks the destruction as started, which makes it impossible
+// to cancel. It fails with FailedPrecondition when another claim is still
+// running or the deletion was cancelled in the meantime.
+func (s *Storage) ClaimKeyDeletion(ctx context.Context, label string, at time.Time, lease time.Duration) error {
+	const op = "storage.mongodb.ClaimKeyDeletion"
+
+	collection := s.client.Database(s.database).Collection("keyPairs")
+
+	filter := bson.M{
+		"label":                 label,
+		"deletion.destroyAfter": bson.M{"$lte": at},
+		"$or": bson.A{
+			bson.M{"deletion.claimedAt": bson.M{"$exists": false}},
+			bson.M{"deletion.claimedAt": bson.M{"$lte": at.Add(-lease)}},
+		},
+	}
+
+	// startedAt keeps the time of the first claim.
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"deletion.startedAt": bson.M{"$ifNull": bson.A{"$deletion.startedAt", at}},
+			"deletion.claimedAt": at,
+		}}},
+	}
+
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return wrap(op, err, storage.ResourceKeyPair, label)
+	}
+
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("%s: %w", op, errs.FailedPrecondition(fmt.Sprintf("deletion of key pair %q is claimed or not due", label)))
+	}
+
+	return nil
+}
+
+// RecordKeyDeletionFailure notes a failed destruction attempt in the journal
+// and releases its claim, so that the next run retries.
+func (s *Storage) RecordKeyDeletionFailure(ctx context.Context, label string, cause string) error {
+	const op = "storage.mongodb.RecordKeyDeletionFailure"
+
+	collection := s.client.Database(s.database).Collection("keyPairs")
+
+	update := bson.M{
+		"$inc":   bson.M{"deletion.attempts": 1},
+		"$set":   bson.M{"deletion.lastError": cause},
+		"$unset": bson.M{"deletion.claimedAt": ""},
+	}
+
+	_, err := collection.UpdateOne(ctx, bson.M{"label": label, "deletion": bson.M{"$exists": true}}, update)
+	if err != nil {
+		return wrap(op, err, storage.ResourceKeyPair, label)
 	}
 
 	return nil
@@ -136,46 +624,128 @@ func (s *Storage) DeleteKeyPair(
 
 	result, err := collection.DeleteOne(
 		ctx, bson.M{
-			"label": keyLabel,
-			"user": bson.M{
-				"id": userId,
-			},
+			"label":   keyLabel,
+			"user.id": userId,
 		})
 
 	if err != nil {
-		return false, fmt.Errorf("%s: %w", op, err)
+		return false, wrap(op, err, storage.ResourceKeyPair, keyLabel)
 	}
 
 	if result.DeletedCount == 0 {
-		return false, fmt.Errorf("%s: No matched key pair was deleted", op)
+		return false, fmt.Errorf("%s: %w", op, errs.NotFound(storage.ResourceKeyPair, keyLabel))
 	}
 
 	return true, nil
 }
 
+func (s *Storage) SaveExternalKey(ctx context.Context, key models.ExternalKey) error {
+	const op = "storage.mongodb.SaveExternalKey"
+
+	collection := s.client.Database(s.database).Collection("externalKeys")
+
+	_, err := collection.InsertOne(ctx, key)
+	if err != nil {
+		return wrap(op, err, storage.ResourceExternalKey, key.Label)
+	}
+
+	return nil
+}
+
+func (s *Storage) ExternalKey(ctx context.Context, label string) (models.ExternalKey, error) {
+	const op = "storage.mongodb.ExternalKey"
+
+	collection := s.client.Database(s.database).Collection("externalKeys")
+
+	var key models.ExternalKey
+
+	err := collection.FindOne(ctx, bson.M{"label": label}).Decode(&key)
+	if err != nil {
+		return models.ExternalKey{}, wrap(op, err, storage.ResourceExternalKey, label)
+	}
+
+	return key, nil
+}
+
+func (s *Storage) DeleteExternalKey(ctx context.Context, userId string, label string) (bool, error) {
+	const op = "storage.mongodb.DeleteExternalKey"
+
+	collection := s.client.Database(s.database).Collection("externalKeys")
+
+	result, err := collection.DeleteOne(ctx, bson.M{"label": label, "userId": userId})
+	if err != nil {
+		return false, wrap(op, err, storage.ResourceExternalKey, label)
+	}
+
+	if result.DeletedCount == 0 {
+		return false, fmt.Errorf("%s: %w", op, errs.NotFound(storage.ResourceExternalKey, label))
+	}
+
+	return true, nil
+}
+
+// SaveSignature stores the record of a signature, replacing the record of an
+// earlier signature by the same user and key over the same document.
+func (s *Storage) SaveSignature(ctx context.Context, record models.SignatureRecord) error {
+	const op = "storage.mongodb.SaveSignature"
+
+	collection := s.client.Database(s.database).Collection("signatures")
+
+	opts := options.Replace().SetUpsert(true)
+	_, err := collection.ReplaceOne(ctx, bson.M{"_id": record.Id}, record, opts)
+	if err != nil {
+		return wrap(op, err, storage.ResourceSignature, record.Id)
+	}
+
+	return nil
+}
+
+func (s *Storage) SignatureRecord(ctx context.Context, id string) (models.SignatureRecord, error) {
+	const op = "storage.mongodb.SignatureRecord"
+
+	collection := s.client.Database(s.database).Collection("signatures")
+
+	var record models.SignatureRecord
+
+	err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&record)
+	if err != nil {
+		return models.SignatureRecord{}, wrap(op, err, storage.ResourceSignature, id)
+	}
+
+	return record, nil
+}
+
+// SaveDocument stores a new document under id with its content sealed.
 func (s *Storage) SaveDocument(
 	ctx context.Context,
+	id string,
 	title string,
 	ownerId string,
-	content string,
-) (string, error) {
+	content models.SealedContent,
+) error {
 	const op = "storage.mongodb.SaveDocument"
 
+	documentId, err := objectID(id)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
 	filter := bson.M{"uniqueId": ownerId}
 	var user models.User
 
 	collection := s.client.Database(s.database).Collection("users")
-	err := collection.FindOne(ctx, filter).Decode(&user)
+	err = collection.FindOne(ctx, filter).Decode(&user)
 
 	if err != nil {
-		return "", fmt.Errorf("%s: User not found", op)
+		return wrap(op, err, storage.ResourceUser, ownerId)
 	}
 
 	collection = s.client.Database(s.database).Collection("documents")
 
 	document := bson.D{
+		{Key: "_id", Value: documentId},
 		{Key: "title", Value: title},
-		{Key: "content", Value: content},
+		{Key: "sealed", Value: content},
 		{Key: "owner", Value: bson.D{
 			{Key: "id", Value: ownerId},
 			{Key: "name", Value: user.Name},
@@ -183,15 +753,11 @@ func (s *Storage) SaveDocument(
 		}},
 	}
 
-	result, err := collection.InsertOne(ctx, document)
-	if err != nil {
-
-	}
-	if _, ok := result.InsertedID.(primitive.ObjectID); ok {
-		return result.InsertedID.(primitive.ObjectID).Hex(), nil
+	if _, err := collection.InsertOne(ctx, document); err != nil {
+		return wrap(op, err, storage.ResourceDocument, id)
 	}
 
-	return "", fmt.Errorf("%s: failed to get inserted document ID", op)
+	return nil
 }
 
 func (s *Storage) GetDocument(ctx context.Context, id string) (models.Document, error) {
@@ -199,40 +765,48 @@ func (s *Storage) GetDocument(ctx context.Context, id string) (models.Document,
 
 	collection := s.client.Database(s.database).Collection("documents")
 
-	documentId, _ := primitive.ObjectIDFromHex(id)
+	documentId, err := objectID(id)
+	if err != nil {
+		return models.Document{}, fmt.Errorf("%s: %w", op, err)
+	}
 	filter := bson.M{"_id": documentId}
 
 	var document models.Document
 
-	err := collection.FindOne(ctx, filter).Decode(&document)
+	err = collection.FindOne(ctx, filter).Decode(&document)
 
 	if err != nil {
-		return models.Document{}, fmt.Errorf("%s: %w", op, err)
+		return models.Document{}, wrap(op, err, storage.ResourceDocument, id)
 	}
 
 	return document, nil
 }
 
+// UpdateDocument replaces the title, sealed content and owner of a
+// document. Plaintext content left from before encryption is removed.
 func (s *Storage) UpdateDocument(
 	ctx context.Context,
 	id string,
 	title string,
-	content string,
+	content models.SealedContent,
 	ownerId string,
 ) (models.Document, error) {
 	const op = "storage.mongodb.UpdateDocument"
 
-	documentId, _ := primitive.ObjectIDFromHex(id)
+	documentId, err := objectID(id)
+	if err != nil {
+		return models.Document{}, fmt.Errorf("%s: %w", op, err)
+	}
 
 	var owner models.User
 
 	filter := bson.M{"uniqueId": ownerId}
 
 	collection := s.client.Database(s.database).Collection("users")
-	err := collection.FindOne(ctx, filter).Decode(&owner)
+	err = collection.FindOne(ctx, filter).Decode(&owner)
 
 	if err != nil {
-		return models.Document{}, fmt.Errorf("%s: %w", op, "Owner not found")
+		return models.Document{}, wrap(op, err, storage.ResourceUser, ownerId)
 	}
 
 	collection = s.client.Database(s.database).Collection("documents")
@@ -240,29 +814,34 @@ func (s *Storage) UpdateDocument(
 	update := bson.D{
 		{Key: "$set", Value: bson.D{
 			{Key: "title", Value: title},
-			{Key: "content", Value: content},
+			{Key: "sealed", Value: content},
 			{Key: "owner", Value: bson.D{
 				{Key: "id", Value: ownerId},
 				{Key: "name", Value: owner.Name},
 				{Key: "email", Value: owner.Email},
 			}},
 		}},
+		{Key: "$unset", Value: bson.D{{Key: "content", Value: ""}}},
 	}
 
-	_, err = collection.UpdateOne(
+	result, err := collection.UpdateOne(
 		ctx,
 		bson.M{"_id": documentId},
 		update,
 	)
 
 	if err != nil {
-		return models.Document{}, fmt.Errorf("%s: %w", op, err)
+		return models.Document{}, wrap(op, err, storage.ResourceDocument, id)
+	}
+
+	if result.MatchedCount == 0 {
+		return models.Document{}, fmt.Errorf("%s: %w", op, errs.NotFound(storage.ResourceDocument, id))
 	}
 
 	return models.Document{
-		Id:      id,
-		Title:   title,
-		Content: content,
+		Id:     id,
+		Title:  title,
+		Sealed: &content,
 		Owner: models.Owner{
 			Id:    ownerId,
 			Name:  owner.Name,
@@ -274,28 +853,274 @@ func (s *Storage) UpdateDocument(
 func (s *Storage) DeleteDocument(ctx context.Context, id string) (bool, error) {
 	const op = "storage.mongodb.DeleteDocument"
 
-	documentId, _ := primitive.ObjectIDFromHex(id)
+	documentId, err := objectID(id)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
 	collection := s.client.Database(s.database).Collection("documents")
 
 	result, err := collection.DeleteOne(ctx, bson.M{"_id": documentId})
 
 	if err != nil {
-		return false, fmt.Errorf("%s: %w", op, err)
+		return false, wrap(op, err, storage.ResourceDocument, id)
 	}
 
 	if result.DeletedCount == 0 {
-		return false, fmt.Errorf("%s: No matched document was deleted", op)
+		return false, fmt.Errorf("%s: %w", op, errs.NotFound(storage.ResourceDocument, id))
 	}
 
 	return true, nil
 }
 
+// DocumentsToRewrap returns up to limit documents whose content is not
+// sealed under masterKey, in id order starting after the id after. The
+// sealed content itself is left out: rewrapping only needs the data key.
+func (s *Storage) DocumentsToRewrap(ctx context.Context, masterKey string, after string, limit int) ([]models.Document, error) {
+	const op = "storage.mongodb.DocumentsToRewrap"
+
+	collection := s.client.Database(s.database).Collection("documents")
+
+	filter := bson.M{"sealed.masterKey": bson.M{"$ne": masterKey}}
+	if after != "" {
+		afterId, err := objectID(after)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		filter["_id"] = bson.M{"$gt": afterId}
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(int64(limit)).
+		SetProjection(bson.M{"sealed.ciphertext": 0})
+
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, wrap(op, err, storage.ResourceDocument, "")
+	}
+
+	var documents []models.Document
+	if err := cursor.All(ctx, &documents); err != nil {
+		return nil, wrap(op, err, storage.ResourceDocument, "")
+	}
+
+	return documents, nil
+}
+
+// RewrapDocumentKey replaces the wrapped data key of a document whose data
+// key is still from. A document updated in the meantime makes it fail with
+// FailedPrecondition.
+func (s *Storage) RewrapDocumentKey(ctx context.Context, id string, from []byte, masterKey string, dataKey []byte) error {
+	const op = "storage.mongodb.RewrapDocumentKey"
+
+	documentId, err := objectID(id)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	collection := s.client.Database(s.database).Collection("documents")
+
+	filter := bson.M{"_id": documentId, "sealed.dataKey": from}
+	update := bson.M{"$set": bson.M{
+		"sealed.masterKey": masterKey,
+		"sealed.dataKey":   dataKey,
+	}}
+
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return wrap(op, err, storage.ResourceDocument, id)
+	}
+
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("%s: %w", op, errs.FailedPrecondition(fmt.Sprintf("document %q changed while rewrapping", id)))
+	}
+
+	return nil
+}
+
+// SealDocument replaces the plaintext content of a document written before
+// encryption, provided it is still content. A document updated in the
+// meantime makes it fail with FailedPrecondition.
+func (s *Storage) SealDocument(ctx context.Context, id string, content string, sealed models.SealedContent) error {
+	const op = "storage.mongodb.SealDocument"
+
+	documentId, err := objectID(id)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	collection := s.client.Database(s.database).Collection("documents")
+
+	filter := bson.M{"_id": documentId, "sealed": bson.M{"$exists": false}, "content": content}
+	if content == "" {
+		filter["content"] = bson.M{"$in": bson.A{nil, ""}}
+	}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{{Key: "sealed", Value: sealed}}},
+		{Key: "$unset", Value: bson.D{{Key: "content", Value: ""}}},
+	}
+
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return wrap(op, err, storage.ResourceDocument, id)
+	}
+
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("%s: %w", op, errs.FailedPrecondition(fmt.Sprintf("document %q changed while sealing", id)))
+	}
+
+	return nil
+}
+
+// CountDocumentsWrappedWith counts the documents whose data key is wrapped
+// under masterKey.
+func (s *Storage) CountDocumentsWrappedWith(ctx context.Context, masterKey string) (int64, error) {
+	const op = "storage.mongodb.CountDocumentsWrappedWith"
+
+	collection := s.client.Database(s.database).Collection("documents")
+
+	count, err := collection.CountDocuments(ctx, bson.M{"sealed.masterKey": masterKey})
+	if err != nil {
+		return 0, wrap(op, err, storage.ResourceDocument, "")
+	}
+
+	return count, nil
+}
+
+func (s *Storage) MasterKey(ctx context.Context, name string) (models.MasterKey, error) {
+	const op = "storage.mongodb.MasterKey"
+
+	collection := s.client.Database(s.database).Collection("masterKeys")
+
+	var key models.MasterKey
+
+	err := collection.FindOne(ctx, bson.M{"_id": name}).Decode(&key)
+	if err != nil {
+		return models.MasterKey{}, wrap(op, err, storage.ResourceMasterKey, name)
+	}
+
+	return key, nil
+}
+
+// SaveMasterKey records a new master key. A name already recorded is
+// rejected with AlreadyExists.
+func (s *Storage) SaveMasterKey(ctx context.Context, key models.MasterKey) error {
+	const op = "storage.mongodb.SaveMasterKey"
+
+	collection := s.client.Database(s.database).Collection("masterKeys")
+
+	if _, err := collection.InsertOne(ctx, key); err != nil {
+		return wrap(op, err, storage.ResourceMasterKey, key.Name)
+	}
+
+	return nil
+}
+
+// ClaimMasterKeyRotation claims the rotation of a master key whose current
+// version is still from for lease. A rotation claimed by someone else and
+// not yet expired, or a version that moved on, makes it fail with
+// FailedPrecondition.
+func (s *Storage) ClaimMasterKeyRotation(ctx context.Context, name string, from int, at time.Time, lease time.Duration) error {
+	const op = "storage.mongodb.ClaimMasterKeyRotation"
+
+	collection := s.client.Database(s.database).Collection("masterKeys")
+
+	filter := bson.M{
+		"_id":     name,
+		"version": from,
+		"$or": bson.A{
+			bson.M{"rotationClaimedAt": bson.M{"$exists": false}},
+			bson.M{"rotationClaimedAt": bson.M{"$lte": at.Add(-lease)}},
+		},
+	}
+	update := bson.M{"$set": bson.M{"rotationClaimedAt": at}}
+
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return wrap(op, err, storage.ResourceMasterKey, name)
+	}
+
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("%s: %w", op, errs.FailedPrecondition(fmt.Sprintf("master key %q is being rotated or changed from version %d", name, from)))
+	}
+
+	return nil
+}
+
+// ReleaseMasterKeyRotation gives up the rotation claimed at, unless it has
+// been claimed again since.
+func (s *Storage) ReleaseMasterKeyRotation(ctx context.Context, name string, at time.Time) error {
+	const op = "storage.mongodb.ReleaseMasterKeyRotation"
+
+	collection := s.client.Database(s.database).Collection("masterKeys")
+
+	filter := bson.M{"_id": name, "rotationClaimedAt": at}
+	update := bson.M{"$unset": bson.M{"rotationClaimedAt": ""}}
+
+	if _, err := collection.UpdateOne(ctx, filter, update); err != nil {
+		return wrap(op, err, storage.ResourceMasterKey, name)
+	}
+
+	return nil
+}
+
+// RotateMasterKey replaces the version history of a master key whose
+// current version is still from, making the last entry of versions current,
+// and releases the rotation claimed at. A rotation whose claim was taken
+// over meanwhile fails with FailedPrecondition.
+func (s *Storage) RotateMasterKey(ctx context.Context, name string, from int, at time.Time, versions []models.KeyVersion) error {
+	const op = "storage.mongodb.RotateMasterKey"
+
+	collection := s.client.Database(s.database).Collection("masterKeys")
+
+	filter := bson.M{"_id": name, "version": from, "rotationClaimedAt": at}
+	update := bson.M{
+		"$set": bson.M{
+			"version":  versions[len(versions)-1].Version,
+			"versions": versions,
+		},
+		"$unset": bson.M{"rotationClaimedAt": ""},
+	}
+
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return wrap(op, err, storage.ResourceMasterKey, name)
+	}
+
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("%s: %w", op, errs.FailedPrecondition(fmt.Sprintf("master key %q changed while rotating from version %d", name, from)))
+	}
+
+	return nil
+}
+
+// RemoveMasterKeyVersion forgets a retired version of a master key.
+func (s *Storage) RemoveMasterKeyVersion(ctx context.Context, name string, version int) error {
+	const op = "storage.mongodb.RemoveMasterKeyVersion"
+
+	collection := s.client.Database(s.database).Collection("masterKeys")
+
+	filter := bson.M{"_id": name, "version": bson.M{"$ne": version}}
+	update := bson.M{"$pull": bson.M{"versions": bson.M{"version": version}}}
+
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return wrap(op, err, storage.ResourceMasterKey, name)
+	}
+
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("%s: %w", op, errs.FailedPrecondition(fmt.Sprintf("version %d of master key %q is current", version, name)))
+	}
+
+	return nil
+}
+
 func (s *Storage) SaveUser(
 	ctx context.Context,
 	id string,
 	name string,
 	email string,
 ) (models.User, error) {
+	const op = "storage.mongodb.SaveUser"
+
 	collection := s.client.Database(s.database).Collection("users")
 	user := models.User{UniqueId: id, Name: name, Email: email}
 
@@ -303,7 +1128,7 @@ func (s *Storage) SaveUser(
 	filter := bson.M{"uniqueId": id}
 	_, err := collection.ReplaceOne(ctx, filter, user, opts)
 	if err != nil {
-		return models.User{}, fmt.Errorf("could not save user: %w", err)
+		return models.User{}, wrap(op, err, storage.ResourceUser, id)
 	}
 	return user, nil
 }
@@ -312,28 +1137,88 @@ func (s *Storage) RemoveUser(
 	ctx context.Context,
 	id string,
 ) (bool, error) {
+	const op = "storage.mongodb.RemoveUser"
+
 	collection := s.client.Database(s.database).Collection("users")
-	filter := bson.M{"_id": id}
+	filter := bson.M{"uniqueId": id}
 	result, err := collection.DeleteOne(ctx, filter)
 	if err != nil {
-		return false, fmt.Errorf("could not remove user: %w", err)
+		return false, wrap(op, err, storage.ResourceUser, id)
+	}
+	if result.DeletedCount == 0 {
+		return false, fmt.Errorf("%s: %w", op, errs.NotFound(storage.ResourceUser, id))
 	}
-	return result.DeletedCount > 0, nil
+	return true, nil
 }
 
 func (s *Storage) GetUser(
 	ctx context.Context,
 	id string,
 ) (models.User, error) {
+	const op = "storage.mongodb.GetUser"
+
 	collection := s.client.Database(s.database).Collection("users")
-	filter := bson.M{"_id": id}
+	filter := bson.M{"uniqueId": id}
 	var user models.User
 	err := collection.FindOne(ctx, filter).Decode(&user)
+	if err != nil {
+		return models.User{}, wrap(op, err, storage.ResourceUser, id)
+	}
+	return user, nil
+}
+
+// APIKey looks up an API key by the hex SHA-256 hash of its secret.
+func (s *Storage) APIKey(ctx context.Context, hash string) (models.APIKey, error) {
+	const op = "storage.mongodb.APIKey"
+
+	collection := s.client.Database(s.database).Collection("apiKeys")
+
+	var key models.APIKey
+
+	err := collection.FindOne(ctx, bson.M{"hash": hash}).Decode(&key)
 	if err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
-			return models.User{}, fmt.Errorf("no user found with id %s", id)
+			return models.APIKey{}, fmt.Errorf("%s: %w", op, storage.ErrorAPIKeyNotFound)
 		}
-		return models.User{}, fmt.Errorf("could not retrieve user: %w", err)
+		return models.APIKey{}, wrap(op, err, storage.ResourceAPIKey, "")
 	}
-	return user, nil
+
+	return key, nil
+}
+
+// wrap classifies a driver error: missing documents become NotFound for the
+// given resource, duplicate keys AlreadyExists, and network failures,
+// timeouts and failed server selection Unavailable.
+func wrap(op string, err error, resourceType string, name string) error {
+	var selectionErr topology.ServerSelectionError
+
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		err = errs.NotFound(resourceType, name)
+	case mongo.IsDuplicateKeyError(err):
+		err = errs.AlreadyExists(resourceType, name)
+	case mongo.IsNetworkError(err), mongo.IsTimeout(err), errors.As(err, &selectionErr):
+		err = errs.Unavailable(err, "database unavailable")
+	}
+
+	return fmt.Errorf("%s: %w", op, err)
+}
+
+// stateFilter matches keys in state. Keys created before states were
+// recorded have none and are active.
+func stateFilter(state string) any {
+	if state == models.KeyStateActive {
+		return bson.M{"$in": bson.A{nil, models.KeyStateActive}}
+	}
+
+	return state
+}
+
+func objectID(id string) (primitive.ObjectID, error) {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return primitive.NilObjectID, errs.InvalidField("id", "must be a 24 character hex object id")
+	}
+
+	return objectId, nil
 }
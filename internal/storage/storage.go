@@ -1,10 +1,22 @@
 package storage
 
-import "errors"
+import "tms/internal/domain/errs"
+
+// Resource types reported in errors about stored objects.
+const (
+	ResourceUser        = "user"
+	ResourceDocument    = "document"
+	ResourceKeyPair     = "key pair"
+	ResourceAPIKey      = "api key"
+	ResourceSignature   = "signature"
+	ResourceExternalKey = "external key"
+	ResourceMasterKey   = "master key"
+)
 
 var (
-	ErrorUserExists         = errors.New("user already exists")
-	ErrorUserNotFound       = errors.New("user not found")
-	ErrorAppNotFound        = errors.New("app not found")
-	ErrorValidationNotFound = errors.New("validation not found")
+	ErrorUserExists         = errs.AlreadyExists(ResourceUser, "")
+	ErrorUserNotFound       = errs.NotFound(ResourceUser, "")
+	ErrorAppNotFound        = errs.NotFound("app", "")
+	ErrorValidationNotFound = errs.NotFound("validation", "")
+	ErrorAPIKeyNotFound     = errs.NotFound(ResourceAPIKey, "")
 )